@@ -0,0 +1,427 @@
+package uviews
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+// Query keys of the email links
+const (
+	linkUserKey  = "u"
+	linkTokenKey = "t"
+)
+
+// Flash formats of the email flows, localized by the printer
+const (
+	flashResetSent        = "If the account exists, we sent you an email to reset your password"
+	flashInvalidLink      = "This link is not valid or has expired"
+	flashEmailNotVerified = "Please confirm your email before resetting your password"
+	flashPasswordChanged  = "Your password has been changed, please sign in"
+	flashEmailConfirmed   = "Your email is confirmed"
+	flashAlreadyConfirmed = "Your email was already confirmed"
+	flashConfirmationSent = "We sent you a new confirmation email"
+)
+
+// TokenLink - The link to put in the emails of the ustore mailer: to and
+// token are the mailer arguments, baseURL the scheme and host of the App
+// and path the ConfirmPath of the AuthViews. The mailer sends the same
+// token for both flows, so the ConfirmPath landing confirms the email of
+// unconfirmed users and sends the others to the new password form
+func TokenLink(baseURL string, path string, to string, token string) string {
+	q := url.Values{}
+	q.Set(linkUserKey, to)
+	q.Set(linkTokenKey, token)
+
+	return baseURL + path + "?" + q.Encode()
+}
+
+// ForgotPasswordForm - Fields of the forgot password view
+type ForgotPasswordForm struct {
+	DefaultForm
+	Username string `schema:"username,required"`
+}
+
+// ResetPasswordForm - Fields of the new password view
+type ResetPasswordForm struct {
+	DefaultForm
+	Username string `schema:"u,required"`
+	// Never kept in the session
+	Token           string `schema:"t,required" json:"-"`
+	Password        string `schema:"password,required" json:"-"`
+	PasswordConfirm string `schema:"password_confirm,required" json:"-"`
+}
+
+func (app *App) mountAccountViews(av *AuthViews) {
+	newForgot := func() View { return &ForgotPasswordView{views: av} }
+	newReset := func() View { return &ResetPasswordView{views: av} }
+	newConfirm := func() View { return &ConfirmEmailView{views: av} }
+	newResend := func() View { return &ResendConfirmationView{views: av} }
+
+	app.Router.HandleFunc(av.ForgotPath, app.BypassAuthentication(newForgot, app.ViewGetHandler)).Methods(http.MethodGet)
+	app.Router.HandleFunc(av.ForgotPath, app.BypassAuthentication(newForgot, app.ViewPostHandler)).Methods(http.MethodPost)
+	app.Router.HandleFunc(av.ResetPath, app.BypassAuthentication(newReset, app.ViewGetHandler)).Methods(http.MethodGet)
+	app.Router.HandleFunc(av.ResetPath, app.BypassAuthentication(newReset, app.ViewPostHandler)).Methods(http.MethodPost)
+	app.Router.HandleFunc(av.ConfirmPath, app.BypassAuthentication(newConfirm, app.ViewGetHandler)).Methods(http.MethodGet)
+	app.Router.HandleFunc(av.ResendPath, app.BypassAuthentication(newResend, app.ViewPostHandler)).Methods(http.MethodPost)
+}
+
+// flashAndRedirect - Shows the flash on the page at path
+func flashAndRedirect(w http.ResponseWriter, r *http.Request, session *ustore.Session, level string, format string, path string) {
+	if err := AddFlash(w, r, session, level, format); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
+
+// sendUserToken - Replaces the token of the user and emails it. ustore has
+// no call doing only this: listing the raw tokens of a user is what makes
+// it generate a new token and hand it to the mailer, the listed entities
+// are of no use. Callers that only want the old token dead, e.g. after a
+// reset, send an email too
+func sendUserToken(ctx context.Context, userID ustore.SIDType) error {
+	ents := make([]ustore.Entity, 0)
+	return ustore.NewRawToken().List(ctx, &ustore.Filter{}, &ents, userID)
+}
+
+// Bag flash key of the email link handed to the reset view, so that the
+// token does not travel in a redirect URL
+const sessionResetLinkKey = "uviews.reset_link"
+
+// resetLink - The user and token of an email link
+type resetLink struct {
+	Username string `json:"u"`
+	Token    string `json:"t"`
+}
+
+// flashResetLink - Keeps the link for the next reset view GET
+func flashResetLink(w http.ResponseWriter, r *http.Request, session *ustore.Session, username string, token string) error {
+	bag := SessionData(w, r, session)
+	if err := bag.SetFlash(sessionResetLinkKey, &resetLink{Username: username, Token: token}); err != nil {
+		return err
+	}
+
+	return saveSessionData(w, r, bag)
+}
+
+// tokenUser - The user of an email link, nil if the link is not valid
+func tokenUser(ctx context.Context, username string, token string) *ustore.User {
+	if username == "" || token == "" {
+		return nil
+	}
+
+	u := ustore.NewUser().(*ustore.User)
+	u.Username = username
+	if err := u.GetByName(ctx); err != nil {
+		return nil
+	}
+	if err := u.ValidateToken(token); err != nil {
+		return nil
+	}
+
+	return u
+}
+
+// ForgotPasswordView - Emails a password reset link
+type ForgotPasswordView struct {
+	DefaultView
+	views *AuthViews
+}
+
+// CanRead - Anyone can ask for a reset
+func (v *ForgotPasswordView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+// CanWrite - Anyone can ask for a reset
+func (v *ForgotPasswordView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (v *ForgotPasswordView) Get(w http.ResponseWriter, r *http.Request) {
+	f := &ForgotPasswordForm{}
+	if err := RestoreFormFromSession(w, r, v.Session, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	v.views.render(w, r, v.views.ForgotTemplates, forgotTemplate, v, f)
+}
+
+// Post - The answer is the same whether the user exists or not
+func (v *ForgotPasswordView) Post(w http.ResponseWriter, r *http.Request) {
+	f := &ForgotPasswordForm{}
+	if err := DecodeForm(w, r, v.Session, f, func(Form) bool { return true }); err != nil {
+		return
+	}
+
+	if !v.views.allowed(r, f.Username) {
+		if err := StoreFormInSession(w, r, v.Session, f); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		flashAndRedirect(w, r, v.Session, FlashError, flashTooManyAttempts, r.URL.Path)
+		return
+	}
+
+	u := ustore.NewUser().(*ustore.User)
+	u.Username = f.Username
+	if err := u.GetByName(r.Context()); err == nil {
+		if err := sendUserToken(r.Context(), u.ID); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+	}
+
+	flashAndRedirect(w, r, v.Session, FlashInfo, flashResetSent, v.views.LoginPath)
+}
+
+// ResetPasswordView - Landing of the reset link, sets a new password
+type ResetPasswordView struct {
+	DefaultView
+	views *AuthViews
+}
+
+// CanRead - The token is checked by the view
+func (v *ResetPasswordView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+// CanWrite - The token is checked by the view
+func (v *ResetPasswordView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+// Get - The link comes from the email, or from the session when the view
+// sends the user back to it
+func (v *ResetPasswordView) Get(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	link := &resetLink{Username: q.Get(linkUserKey), Token: q.Get(linkTokenKey)}
+	if link.Token == "" {
+		bag := SessionData(w, r, v.Session)
+		if _, err := bag.Flash(sessionResetLinkKey, link); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := saveSessionData(w, r, bag); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+	}
+
+	if !v.views.allowed(r, link.Username) {
+		flashAndRedirect(w, r, v.Session, FlashError, flashTooManyAttempts, v.views.ForgotPath)
+		return
+	}
+	if tokenUser(r.Context(), link.Username, link.Token) == nil {
+		flashAndRedirect(w, r, v.Session, FlashError, flashInvalidLink, v.views.ForgotPath)
+		return
+	}
+
+	f := &ResetPasswordForm{}
+	if err := RestoreFormFromSession(w, r, v.Session, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Username = link.Username
+	f.Token = link.Token
+
+	v.views.render(w, r, v.views.ResetTemplates, resetTemplate, v, f)
+}
+
+func (v *ResetPasswordView) Post(w http.ResponseWriter, r *http.Request) {
+	f := &ResetPasswordForm{}
+	if err := DecodeForm(w, r, v.Session, f, func(Form) bool { return true }); err != nil {
+		return
+	}
+
+	if !v.views.allowed(r, f.Username) {
+		flashAndRedirect(w, r, v.Session, FlashError, flashTooManyAttempts, v.views.ForgotPath)
+		return
+	}
+
+	u := tokenUser(r.Context(), f.Username, f.Token)
+	switch {
+	case u == nil:
+		flashAndRedirect(w, r, v.Session, FlashError, flashInvalidLink, v.views.ForgotPath)
+		return
+	case !u.EmailConfirmed:
+		flashAndRedirect(w, r, v.Session, FlashError, flashEmailNotVerified, v.views.LoginPath)
+		return
+	case f.Password != f.PasswordConfirm:
+		f.SetMissing("password_confirm")
+		if err := StoreFormInSession(w, r, v.Session, f); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		if err := flashResetLink(w, r, v.Session, f.Username, f.Token); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		flashAndRedirect(w, r, v.Session, FlashError, flashPasswordsMismatch, r.URL.Path)
+		return
+	}
+
+	u.Password = []byte(f.Password)
+	if err := u.Update(r.Context(), u.ID); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+	// The mailer replaces the token, so that the link cannot be used again
+	if err := sendUserToken(r.Context(), u.ID); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	// A new password signs out every other login
+	revokeRemembered(r, u.ID)
+	if _, err := RevokeOtherSessions(r, u.ID, v.Session.ID); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	flashAndRedirect(w, r, v.Session, FlashSuccess, flashPasswordChanged, v.views.LoginPath)
+}
+
+// ConfirmEmailView - Landing of the confirmation link
+type ConfirmEmailView struct {
+	DefaultView
+	views *AuthViews
+}
+
+// CanRead - The token is checked by the view
+func (v *ConfirmEmailView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+// CanWrite - Confirmation is a GET
+func (v *ConfirmEmailView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return false, nil
+}
+
+func (v *ConfirmEmailView) Get(w http.ResponseWriter, r *http.Request) {
+	next := v.views.LoginPath
+	if v.User != nil {
+		next = v.views.HomePath
+	}
+
+	q := r.URL.Query()
+	if !v.views.allowed(r, q.Get(linkUserKey)) {
+		flashAndRedirect(w, r, v.Session, FlashError, flashTooManyAttempts, next)
+		return
+	}
+	u := tokenUser(r.Context(), q.Get(linkUserKey), q.Get(linkTokenKey))
+	if u == nil {
+		flashAndRedirect(w, r, v.Session, FlashError, flashInvalidLink, next)
+		return
+	}
+	if u.EmailConfirmed {
+		// A password reset link
+		if err := flashResetLink(w, r, v.Session, q.Get(linkUserKey), q.Get(linkTokenKey)); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		http.Redirect(w, r, v.views.ResetPath, http.StatusSeeOther)
+		return
+	}
+
+	u.EmailConfirmed = true
+	if err := u.UpdateEmailConfirmed(r.Context(), time.Now().In(time.UTC), u.ID); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	flashAndRedirect(w, r, v.Session, FlashSuccess, flashEmailConfirmed, next)
+
+	publishEvent(r, EventEmailConfirmed, u, []ustore.SIDType{u.ID})
+}
+
+// ResendConfirmationView - Emails a new confirmation link to the signed in
+// user
+type ResendConfirmationView struct {
+	DefaultView
+	views *AuthViews
+}
+
+// CanRead - Resend is a POST
+func (v *ResendConfirmationView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return false, nil
+}
+
+// CanWrite - Anyone, anonymous users are sent to login
+func (v *ResendConfirmationView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (v *ResendConfirmationView) Get(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, v.views.HomePath, http.StatusSeeOther)
+}
+
+func (v *ResendConfirmationView) Post(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case v.User == nil:
+		// The resend is a POST, users land home once signed in
+		to := v.views.LoginPath
+		if rp := ReturnToValue(r, v.views.HomePath); rp != "" {
+			to = withQuery(to, url.Values{returnToKey: {rp}})
+		}
+		http.Redirect(w, r, to, http.StatusSeeOther)
+		return
+	case v.User.EmailConfirmed:
+		flashAndRedirect(w, r, v.Session, FlashInfo, flashAlreadyConfirmed, v.views.HomePath)
+		return
+	case !v.views.allowed(r, v.User.Username):
+		flashAndRedirect(w, r, v.Session, FlashError, flashTooManyAttempts, v.views.HomePath)
+		return
+	}
+
+	if err := sendUserToken(r.Context(), v.User.ID); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	flashAndRedirect(w, r, v.Session, FlashSuccess, flashConfirmationSent, v.views.HomePath)
+}
+
+// Built-in templates of the email flows
+const (
+	forgotTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{pPrintf "Forgot password"}}</title></head>
+<body>
+{{range flashes}}<p class="flash {{.Level}}">{{.Text}}</p>
+{{end}}<form method="post">
+{{.CsrfField}}
+<label>{{pPrintf "Username"}} <input name="username" value="{{.Username}}" required></label>
+<button type="submit" name="action" value="forgot">{{pPrintf "Send reset link"}}</button>
+</form>
+</body></html>
+`
+
+	resetTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{pPrintf "New password"}}</title></head>
+<body>
+{{range flashes}}<p class="flash {{.Level}}">{{.Text}}</p>
+{{end}}<form method="post">
+{{.CsrfField}}
+<input type="hidden" name="u" value="{{.Username}}">
+<input type="hidden" name="t" value="{{.Token}}">
+<label>{{pPrintf "New password"}} <input type="password" name="password" required></label>
+<label>{{pPrintf "Confirm password"}} <input type="password" name="password_confirm" required></label>
+<button type="submit" name="action" value="reset">{{pPrintf "Change password"}}</button>
+</form>
+</body></html>
+`
+)
+
+// Interface checks
+var (
+	_ View = &ForgotPasswordView{}
+	_ View = &ResetPasswordView{}
+	_ View = &ConfirmEmailView{}
+	_ View = &ResendConfirmationView{}
+)
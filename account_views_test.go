@@ -0,0 +1,158 @@
+package uviews
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestAccountViewsLinks(t *testing.T) {
+	if l := TokenLink("https://example.com", "/confirm-email", "a+b@c.d", "tok"); l != "https://example.com/confirm-email?t=tok&u=a%2Bb%40c.d" {
+		t.Errorf("unexpected link %s\n", l)
+		return
+	}
+
+	napp := NewApp("account_app", []byte("1234"), "11743", "", "", "")
+	napp.SetSessionStore(NewMemorySessionStore())
+	limited := false
+	napp.MountAuthViews(&AuthViews{
+		Limit: func(r *http.Request, username string) bool { return !limited },
+	})
+	b := newBrowser(napp.Router)
+
+	// Links without token are refused
+	rec := b.do(http.MethodGet, "/confirm-email?u=a@b.c", nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("expected a redirect to login, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+	if rec := b.do(http.MethodGet, "/login", nil); !strings.Contains(rec.Body.String(), flashInvalidLink) {
+		t.Errorf("expected the invalid link flash, got %s\n", rec.Body)
+		return
+	}
+
+	// Links are rate limited before their token is checked
+	limited = true
+	for _, link := range []string{"/confirm-email?u=a@b.c&t=tok", "/reset-password?u=a@b.c&t=tok"} {
+		b.do(http.MethodGet, link, nil)
+		if rec := b.do(http.MethodGet, "/login", nil); !strings.Contains(rec.Body.String(), flashTooManyAttempts) {
+			t.Errorf("%s: expected the rate limit flash, got %s\n", link, rec.Body)
+			return
+		}
+	}
+
+	// Anonymous users sign in to resend the confirmation
+	rec = b.do(http.MethodPost, "/confirm-email/resend", url.Values{})
+	if rec.Code != http.StatusSeeOther || !strings.HasPrefix(rec.Header().Get("Location"), "/login?rp=") {
+		t.Errorf("expected a redirect to login, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), appContextKey, napp))
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if p, ok := ReturnPath(req, loc.Query().Get(returnToKey)); !ok || p != "/" {
+		t.Errorf("expected to return home, got %s %v\n", p, ok)
+		return
+	}
+
+	// Reset emails are rate limited
+	rec = b.do(http.MethodPost, "/forgot-password", url.Values{"username": {"a@b.c"}, "action": {"forgot"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/forgot-password" {
+		t.Errorf("expected a redirect back, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+	if rec := b.do(http.MethodGet, "/forgot-password", nil); !strings.Contains(rec.Body.String(), flashTooManyAttempts) {
+		t.Errorf("expected the rate limit flash, got %s\n", rec.Body)
+		return
+	}
+
+	fmt.Printf("TestAccountViewsLinks: OK\n")
+}
+
+func TestAccountViewsResetPassword(t *testing.T) {
+	const uname = "accountviews@example.com"
+	u, err := createTestUser(uname, "Pass123+Q")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer (&ustore.User{}).Erase(context.Background(), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), u.ID)
+
+	napp := NewApp("account_app", []byte("1234"), "11743", "", "", "")
+	napp.SetSessionStore(NewMemorySessionStore())
+	napp.MountAuthViews(&AuthViews{})
+	b := newBrowser(napp.Router)
+
+	etoken = ""
+	b.do(http.MethodPost, "/forgot-password", url.Values{"username": {uname}, "action": {"forgot"}})
+	if etoken == "" {
+		t.Error("expected a token to be mailed")
+		return
+	}
+
+	// Confirmed users land on the new password form
+	rec := b.do(http.MethodGet, TokenLink("", "/confirm-email", uname, etoken), nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/reset-password" {
+		t.Errorf("expected a redirect to the reset form, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+	if rec := b.do(http.MethodGet, rec.Header().Get("Location"), nil); rec.Code != http.StatusOK {
+		t.Errorf("expected the reset form, got %d %s\n", rec.Code, rec.Body)
+		return
+	}
+
+	form := url.Values{
+		"u":                {uname},
+		"t":                {etoken},
+		"password":         {"ssaP321+Y"},
+		"password_confirm": {"other"},
+		"action":           {"reset"},
+	}
+
+	// A mismatch goes back to the form, the token stays out of the URL
+	rec = b.do(http.MethodPost, "/reset-password", form)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/reset-password" {
+		t.Errorf("expected a redirect to the reset form, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+	if rec := b.do(http.MethodGet, "/reset-password", nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), etoken) {
+		t.Errorf("expected the reset form with the link, got %d %s\n", rec.Code, rec.Body)
+		return
+	}
+
+	form.Set("password_confirm", "ssaP321+Y")
+	rec = b.do(http.MethodPost, "/reset-password", form)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("expected a redirect to login, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+
+	// The link is used up
+	if rec := b.do(http.MethodPost, "/reset-password", form); rec.Header().Get("Location") != "/forgot-password" {
+		t.Errorf("expected the used link refused, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+
+	u1 := &ustore.User{}
+	if err := u1.Get(context.Background(), &ustore.Filter{}, u.ID); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := u1.Authenticate("ssaP321+Y"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	fmt.Printf("TestAccountViewsResetPassword: OK\n")
+}
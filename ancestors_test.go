@@ -0,0 +1,77 @@
+package uviews
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/usfsci/ustore"
+)
+
+func TestListAncestors(t *testing.T) {
+	ids := make([]string, 3)
+	for i := range ids {
+		b, err := ustore.NewBase()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ids[i] = b.ID.String()
+	}
+	a, b, c := ids[0], ids[1], ids[2]
+
+	cases := []struct {
+		vars      map[string]string
+		names     []string
+		ancestors []string
+		params    PathParams
+		code      int
+	}{
+		// Numbered vars, with an extra param
+		{map[string]string{"1": b, "0": a, "format": "json"}, nil, []string{a, b}, PathParams{"format": "json"}, http.StatusOK},
+		// Gap in the numbering
+		{map[string]string{"0": a, "2": c}, nil, nil, nil, http.StatusInternalServerError},
+		// Same position twice
+		{map[string]string{"1": a, "01": b}, nil, nil, nil, http.StatusInternalServerError},
+		// Named vars, in the declared order
+		{map[string]string{"client": b, "user": a, "slug": "x"}, []string{"user", "client"}, []string{a, b}, PathParams{"slug": "x"}, http.StatusOK},
+		// Declared var missing from the route
+		{map[string]string{"user": a}, []string{"user", "client"}, nil, nil, http.StatusInternalServerError},
+	}
+
+	for i, tc := range cases {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r = mux.SetURLVars(r, tc.vars)
+
+		ancestors, params, code, apiErr := listAncestors(r, tc.names)
+		if code != tc.code {
+			t.Errorf("case %d: expected status %d, got %d (%+v)\n", i, tc.code, code, apiErr)
+			return
+		}
+		if apiErr != nil {
+			continue
+		}
+
+		if len(ancestors) != len(tc.ancestors) {
+			t.Errorf("case %d: expected %d ancestors, got %d\n", i, len(tc.ancestors), len(ancestors))
+			return
+		}
+		for j := range ancestors {
+			if ancestors[j].String() != tc.ancestors[j] {
+				t.Errorf("case %d: expected ancestor %d = %s, got %s\n", i, j, tc.ancestors[j], ancestors[j])
+				return
+			}
+		}
+
+		if len(params) != len(tc.params) {
+			t.Errorf("case %d: expected params %v, got %v\n", i, tc.params, params)
+			return
+		}
+		for k, v := range tc.params {
+			if params[k] != v {
+				t.Errorf("case %d: expected params %v, got %v\n", i, tc.params, params)
+				return
+			}
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package uviews
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
@@ -17,29 +18,114 @@ const (
 	maxMessageDelayNs = 30 * 1e9
 )
 
-func ApiAdd(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
-	const origin = "add"
+// apiCheck - A handler precondition. Returns nil if it holds
+type apiCheck func() *ApiError
+
+// apiValidate - Runs the checks in order and writes a 400 response with the
+// first one that fails. Returns false if a check failed, the handler
+// must then return without doing any further processing
+func apiValidate(w http.ResponseWriter, r *http.Request, origin string, checks ...apiCheck) bool {
+	for _, check := range checks {
+		if e := check(); e != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+			return false
+		}
+	}
 
-	// Decode the JSON message
-	if err := msgDecoder(r, ent, origin); err != nil {
-		apiErr := &ApiError{
-			Desc:  "unable to decode request JSON",
-			Debug: err.Error(),
+	return true
+}
+
+// checkAncestors - The number of ancestors must be the entity root length
+// plus extra, 0 for collection ops and 1 for item ops
+func checkAncestors(ent ustore.Entity, ancestors []ustore.SIDType, extra int) apiCheck {
+	return func() *ApiError {
+		if n := ent.AncestorsRootLen() + extra; len(ancestors) != n {
+			return newApiError(ErrCodeAncestorsMismatch, fmt.Sprintf("expected %d ancestors, got %d", n, len(ancestors)))
 		}
-		ApiResponseWrite(w, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
-		return
+		return nil
+	}
+}
+
+// checkAncestorsLen - There must be exactly n ancestors
+func checkAncestorsLen(ancestors []ustore.SIDType, n int) apiCheck {
+	return func() *ApiError {
+		if len(ancestors) != n {
+			return newApiError(ErrCodeAncestorsMismatch, fmt.Sprintf("expected %d ancestors, got %d", n, len(ancestors)))
+		}
+		return nil
+	}
+}
+
+// checkMessage - Decodes the request Message into ent
+func checkMessage(r *http.Request, ent ustore.Entity, origin string) apiCheck {
+	return func() *ApiError {
+		if err := msgDecoder(r, ent, origin); err != nil {
+			return decodeApiError(err)
+		}
+		return nil
+	}
+}
+
+// checkModificationTime - Updates should have a non-zero modification time
+func checkModificationTime(ent ustore.Entity) apiCheck {
+	return func() *ApiError {
+		if ent.GetModificationTime().IsZero() {
+			e := newApiError(ErrCodeZeroModificationTime, "got zero modification time on update")
+			e.Field = "modification_time"
+			return e
+		}
+		return nil
+	}
+}
+
+// checkRawToken - ent must be a *RawToken with a token
+func checkRawToken(ent ustore.Entity) apiCheck {
+	return func() *ApiError {
+		// Will crash on development if the passed ent is not a *RawToken
+		if ent.(*ustore.RawToken).Token == "" {
+			e := newApiError(ErrCodeEmptyToken, "")
+			e.Field = "token"
+			return e
+		}
+		return nil
+	}
+}
+
+// checkEmailConfirmed - The user email must have been previously validated
+func checkEmailConfirmed(u *ustore.User) apiCheck {
+	return func() *ApiError {
+		if !u.EmailConfirmed {
+			return newApiError(ErrCodeEmailNotConfirmed, "")
+		}
+		return nil
+	}
+}
+
+// checkUserToken - Validates token vs. the user token
+func checkUserToken(u *ustore.User, token string) apiCheck {
+	return func() *ApiError {
+		if err := u.ValidateToken(token); err != nil {
+			e := newApiError(ErrCodeInvalidToken, err.Error())
+			e.Field = "token"
+			return e
+		}
+		return nil
 	}
+}
 
-	// Check ancestors length
-	if len(ancestors) != ent.AncestorsRootLen() {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected %d ancestors, got %d", ent.AncestorsRootLen(), len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+func ApiAdd(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "add"
+
+	if !apiValidate(w, r, origin,
+		checkAncestors(ent, ancestors, 0),
+		checkMessage(r, ent, origin),
+	) {
+		return
 	}
 
 	// Store add
 	if err := ent.Add(r.Context(), "", ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
@@ -47,101 +133,146 @@ func ApiAdd(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore
 		"id":                ent.GetID(),
 		"modification_time": ent.GetModificationTime().Format(time.RFC3339),
 	}
-	ApiResponseWrite(w, origin, data, nil, http.StatusOK)
+	ApiResponseWrite(w, r, origin, data, nil, http.StatusOK)
+
+	publishEvent(r, EventAdd, ent, ancestors)
 }
 
 func ApiUpdate(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
 	const origin = "update"
 
-	// Decode the JSON message
-	if err := msgDecoder(r, ent, origin); err != nil {
-		apiErr := &ApiError{
-			Desc:  "unable to decode request JSON",
-			Debug: err.Error(),
-		}
-		ApiResponseWrite(w, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin,
+		checkAncestors(ent, ancestors, 1),
+		checkMessage(r, ent, origin),
+		checkModificationTime(ent),
+	) {
+		return
+	}
+
+	storeUpdate(w, r, origin, ent, ancestors, nil)
+}
+
+// ApiPatch - Updates only the fields sent. The stored entity is read and the
+// message data decoded over it, so the fields not sent, secrets included,
+// keep their stored value
+func ApiPatch(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "patch"
+
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
 		return
 	}
 
-	// Check ancestors length
-	if len(ancestors) != (ent.AncestorsRootLen() + 1) {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected %d ancestors, got %d", ent.AncestorsRootLen(), len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if err := ent.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+	var password []byte
+	if user, ok := ent.(*ustore.User); ok {
+		password = user.Password
 	}
 
-	// Updates should have a non-zero modification time
-	if ent.GetModificationTime().IsZero() {
-		e := ApiErrBadRequest
-		e.Debug = "got zero modification time on update"
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin,
+		checkMessage(r, ent, origin),
+		checkModificationTime(ent),
+	) {
+		return
 	}
 
-	// Store update
+	storeUpdate(w, r, origin, ent, ancestors, password)
+}
+
+// storeUpdate - Stores the updated entity and writes the response.
+// password is the stored one of a patched user, nil on full updates
+func storeUpdate(w http.ResponseWriter, r *http.Request, origin string, ent ustore.Entity, ancestors []ustore.SIDType, password []byte) {
 	if err := ent.Update(r.Context(), ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
+	// A new password signs out the remembered logins of the user in the path
+	if user, ok := ent.(*ustore.User); ok && len(user.Password) > 0 && !bytes.Equal(user.Password, password) && len(ancestors) > 0 {
+		revokeRemembered(r, ancestors[len(ancestors)-1])
+	}
+
 	data := map[string]interface{}{
 		"id":                ent.GetID(),
 		"modification_time": ent.GetModificationTime().Format(time.RFC3339),
 	}
-	ApiResponseWrite(w, origin, data, nil, http.StatusOK)
+	ApiResponseWrite(w, r, origin, data, nil, http.StatusOK)
+
+	publishEvent(r, EventUpdate, ent, ancestors)
 }
 
 func ApiDelete(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
 	const origin = "delete"
 
-	// Get op requires 1 more ancestor than Add or List
-	if len(ancestors) != (ent.AncestorsRootLen() + 1) {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected %d ancestors, got %d", ent.AncestorsRootLen(), len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	// Delete op requires 1 more ancestor than Add or List
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
+		return
 	}
 
 	// TODO: How to handle the Time of requests without timestamp (no body)
 	if err := ent.Delete(r.Context(), time.Now().In(time.UTC), ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
-	ApiResponseWrite(w, origin, ent, nil, http.StatusOK)
+	ApiResponseWrite(w, r, origin, ent, nil, http.StatusOK)
+
+	publishEvent(r, EventDelete, ent, ancestors)
 }
 
 func ApiGet(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
 	const origin = "get"
 
 	// Get op requires 1 more ancestor than Add or List
-	if len(ancestors) != (ent.AncestorsRootLen() + 1) {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected %d ancestors, got %d", ent.AncestorsRootLen()+1, len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
+		return
+	}
+
+	rep, apiErr := parseRepresentation(r)
+	if apiErr != nil {
+		ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
+		return
 	}
 
 	if err := ent.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
 	ent.Zero()
 
-	ApiResponseWrite(w, origin, ent, nil, http.StatusOK)
+	if rep == nil {
+		ApiResponseWrite(w, r, origin, ent, nil, http.StatusOK)
+		return
+	}
+
+	data, code, apiErr := rep.render(r, ent, u, ancestors)
+	if apiErr != nil {
+		ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
+		return
+	}
+
+	ApiResponseWrite(w, r, origin, data, nil, http.StatusOK)
 }
 
 func ApiList(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
 	const origin = "list"
 
-	// Check ancestors length
-	if len(ancestors) != ent.AncestorsRootLen() {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected %d ancestors, got %d", ent.AncestorsRootLen(), len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 0)) {
+		return
+	}
+
+	rep, apiErr := parseRepresentation(r)
+	if apiErr != nil {
+		ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
+		return
 	}
 
 	ents := make([]ustore.Entity, 0)
 	if err := ent.List(r.Context(), &ustore.Filter{}, &ents, ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
@@ -149,7 +280,24 @@ func ApiList(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustor
 		e.Zero()
 	}
 
-	ApiResponseWrite(w, origin, ents, nil, http.StatusOK)
+	if rep == nil {
+		ApiResponseWrite(w, r, origin, ents, nil, http.StatusOK)
+		return
+	}
+
+	data := make([]interface{}, len(ents))
+	for i, e := range ents {
+		// Children of each item hang from the item id
+		anc := append(append([]ustore.SIDType{}, ancestors...), e.GetID())
+
+		var code int
+		if data[i], code, apiErr = rep.render(r, e, u, anc); apiErr != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
+			return
+		}
+	}
+
+	ApiResponseWrite(w, r, origin, data, nil, http.StatusOK)
 }
 
 // ApiEmailValidate - Validates posted Token vs Email received token
@@ -157,57 +305,38 @@ func ApiList(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustor
 func ApiEmailValidate(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
 	const origin = "validate-email"
 
-	// Decode the JSON message into an Entity of *User
-	if err := msgDecoder(r, ent, origin); err != nil {
-		apiErr := &ApiError{
-			Desc:  "unable to decode request JSON",
-			Debug: err.Error(),
-		}
-		ApiResponseWrite(w, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
-		return
-	}
-
 	// There must be 1 ancestor (the UserID)
-	if len(ancestors) != 1 {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected 1 ancestor, got %d", len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
-		return
-	}
-
-	// Will crash on development if the passed ent is not a *RawToken
-	rawTok := ent.(*ustore.RawToken)
-	if rawTok.Token == "" {
-		e := ApiErrBadRequest
-		e.Debug = "token cannot be empty"
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin,
+		checkAncestorsLen(ancestors, 1),
+		checkMessage(r, ent, origin),
+		checkRawToken(ent),
+	) {
 		return
 	}
 
 	// Get the user
 	u1 := &ustore.User{}
 	if err := u1.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
 	// Validate token vs. the authenticated user token
-	if err := u1.ValidateToken(rawTok.Token); err != nil {
-		e := ApiErrBadRequest
-		e.Debug = err.Error()
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin, checkUserToken(u1, ent.(*ustore.RawToken).Token)) {
 		return
 	}
 
 	// Mark as valid
 	u1.EmailConfirmed = true
 	if err := u1.UpdateEmailConfirmed(r.Context(), time.Now().In(time.UTC), ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
 	// Response with good status and no body
-	ApiResponseWrite(w, origin, nil, nil, http.StatusOK)
+	ApiResponseWrite(w, r, origin, nil, nil, http.StatusOK)
+
+	publishEvent(r, EventEmailConfirmed, u1, ancestors)
 }
 
 // ApiPasswordReset - Validates posted Token vs Email received token
@@ -216,53 +345,27 @@ func ApiEmailValidate(w http.ResponseWriter, r *http.Request, ent ustore.Entity,
 func ApiPasswordReset(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
 	const origin = "password-reset"
 
-	// Decode the JSON message into an Entity of *User
-	if err := msgDecoder(r, ent, origin); err != nil {
-		apiErr := &ApiError{
-			Desc:  "unable to decode request JSON",
-			Debug: err.Error(),
-		}
-		ApiResponseWrite(w, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
-		return
-	}
-
 	// There must be 1 ancestor (the UserID)
-	if len(ancestors) != 1 {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected 1 ancestor, got %d", len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin,
+		checkAncestorsLen(ancestors, 1),
+		checkMessage(r, ent, origin),
+		checkRawToken(ent),
+	) {
 		return
 	}
-
-	// Will crash on development if the passed ent is not a *RawToken
 	rawTok := ent.(*ustore.RawToken)
-	if rawTok.Token == "" {
-		e := ApiErrBadRequest
-		e.Debug = "token cannot be empty"
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
-		return
-	}
 
 	// Get the user
 	u1 := &ustore.User{}
 	if err := u1.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
-		return
-	}
-
-	// The user email must have been previously validated
-	if !u1.EmailConfirmed {
-		e := ApiErrBadRequest
-		e.Debug = "user email has not been validated yet"
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
-	// Validate token vs. the authenticated user token
-	if err := u1.ValidateToken(rawTok.Token); err != nil {
-		e := ApiErrBadRequest
-		e.Debug = err.Error()
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin,
+		checkEmailConfirmed(u1),
+		checkUserToken(u1, rawTok.Token),
+	) {
 		return
 	}
 
@@ -271,142 +374,164 @@ func ApiPasswordReset(w http.ResponseWriter, r *http.Request, ent ustore.Entity,
 		Base:     ustore.Base{ModificationTime: time.Now().In(time.UTC)},
 		Password: []byte(rawTok.Password),
 	}).Update(r.Context(), ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
+	revokeRemembered(r, ancestors[0])
 
 	// Response with good status and no body
-	ApiResponseWrite(w, origin, nil, nil, http.StatusOK)
+	ApiResponseWrite(w, r, origin, nil, nil, http.StatusOK)
 }
 
 func ApiGetToken(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
 	const origin = "password-reset"
 
-	// Decode the JSON message into an Entity of *User
-	if err := msgDecoder(r, ent, origin); err != nil {
-		apiErr := &ApiError{
-			Desc:  "unable to decode request JSON",
-			Debug: err.Error(),
-		}
-		ApiResponseWrite(w, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
-		return
-	}
-
 	// There must be 1 ancestor (the UserID)
-	if len(ancestors) != 1 {
-		e := ApiErrBadRequest
-		e.Debug = fmt.Sprintf("expected 1 ancestor, got %d", len(ancestors))
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin,
+		checkAncestorsLen(ancestors, 1),
+		checkMessage(r, ent, origin),
+		checkRawToken(ent),
+	) {
 		return
 	}
-
-	// Will crash on development if the passed ent is not a *RawToken
 	rawTok := ent.(*ustore.RawToken)
-	if rawTok.Token == "" {
-		e := ApiErrBadRequest
-		e.Debug = "token cannot be empty"
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
-		return
-	}
 
 	// Get the user
 	u1 := &ustore.User{}
 	if err := u1.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
 
-	// The user email must have been previously validated
-	if !u1.EmailConfirmed {
-		e := ApiErrBadRequest
-		e.Debug = "user email has not been validated yet"
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
-		return
-	}
-
-	// Validate token vs. the authenticated user token
-	if err := u1.ValidateToken(rawTok.Token); err != nil {
-		e := ApiErrBadRequest
-		e.Debug = err.Error()
-		ApiResponseWrite(w, origin, nil, []*ApiError{e}, http.StatusBadRequest)
+	if !apiValidate(w, r, origin,
+		checkEmailConfirmed(u1),
+		checkUserToken(u1, rawTok.Token),
+	) {
 		return
 	}
 
 	// Update Password
 	u1.Password = []byte(rawTok.Password)
 	if err := u1.Update(r.Context(), ancestors...); err != nil {
-		ApiResponseStoreError(w, origin, err)
+		ApiResponseStoreError(w, r, origin, err)
 		return
 	}
+	revokeRemembered(r, ancestors[0])
 
 	// Response with good status and no body
-	ApiResponseWrite(w, origin, nil, nil, http.StatusOK)
+	ApiResponseWrite(w, r, origin, nil, nil, http.StatusOK)
 }
 
-// msgDecoder -
+// msgDecoder - Decodes the Message envelope with the codec matching the
+// request Content-Type and the envelope data into ent
 func msgDecoder(r *http.Request, ent ustore.Entity, origin string) error {
 	defer r.Body.Close()
 
-	msg := &Message{}
+	c, ok := requestCodec(r)
+	if !ok {
+		return fmt.Errorf("unsupported media type %s", r.Header.Get(contentTypeKey))
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
 
-	err := json.NewDecoder(r.Body).Decode(msg)
+	timestamp, data, err := c.UnmarshalMessage(body)
 	if err != nil {
-		log.Printf("Rest.msgDecoder json error: %+v\n", err)
+		log.Printf("Rest.msgDecoder %s error: %+v\n", c.MediaType(), err)
 		return err
 	}
 
 	// Check the timestamp of the message
 	t := time.Now().In(time.UTC).UnixNano()
 
-	if msg.Timestamp > t {
+	if timestamp > t {
 		// A message from the future! hummm...
 		return fmt.Errorf("messages from the future are not allowed yet")
 	}
 
-	if (t - msg.Timestamp) > int64(maxMessageDelayNs) {
+	if (t - timestamp) > int64(maxMessageDelayNs) {
 		// The message is too old
-		return fmt.Errorf("message is %d minutes old", t-msg.Timestamp)
+		return fmt.Errorf("message is %d minutes old", t-timestamp)
 	}
 
-	if err := json.Unmarshal(msg.Data, ent); err != nil {
+	if err := c.Unmarshal(data, ent); err != nil {
 		return err
 	}
 
 	// For Updates the Entity ModificationTime must be before the time stamp
-	if msg.Timestamp < ent.GetModificationTime().UnixNano() {
+	if timestamp < ent.GetModificationTime().UnixNano() {
 		return fmt.Errorf("message timestamp before entity modification")
 	}
 
 	return nil
 }
 
-func listAncestors(r *http.Request) ([]ustore.SIDType, *ApiError) {
+// listAncestors - Extracts the ancestor ids from the path vars, in order, and
+// returns the remaining vars as path params.
+// If names is empty the ancestor vars are the numeric ones, {0}, {1}... and
+// they must be contiguous from 0. Otherwise they are the vars in names.
+// On error also returns the response status code
+func listAncestors(r *http.Request, names []string) ([]ustore.SIDType, PathParams, int, *ApiError) {
 	// Extract parent info from the path
 	vrs := mux.Vars(r)
 
-	ancestors := make([]ustore.SIDType, len(vrs))
-	for k, v := range vrs {
-		// The ancestor position
-		i, err := strconv.Atoi(k)
-		if err != nil {
-			return nil, &ApiError{
-				Desc:  "unable to decode path",
-				Debug: err.Error(),
+	params := PathParams{}
+	ancestorVars := make([]string, 0, len(vrs))
+
+	if len(names) > 0 {
+		for _, name := range names {
+			if _, ok := vrs[name]; !ok {
+				// The route template does not have the declared var
+				return nil, nil, http.StatusInternalServerError, newApiError(ErrCodeBadPath, fmt.Sprintf("missing ancestor var %s", name))
 			}
 		}
+		ancestorVars = names
 
-		sid, err := ustore.SIDFromString(v)
-		if err != nil {
-			return nil, &ApiError{
-				Desc:  "id not properly formatted",
-				Debug: err.Error(),
+		for k, v := range vrs {
+			params[k] = v
+		}
+		for _, name := range names {
+			delete(params, name)
+		}
+	} else {
+		positions := map[int]string{}
+		for k, v := range vrs {
+			// The ancestor position
+			i, err := strconv.Atoi(k)
+			if err != nil {
+				// Not an ancestor
+				params[k] = v
+				continue
+			}
+
+			if _, ok := positions[i]; ok || i < 0 {
+				return nil, nil, http.StatusInternalServerError, newApiError(ErrCodeBadPath, fmt.Sprintf("ancestor var %s is not valid", k))
 			}
+			positions[i] = k
+		}
+
+		for i := 0; i < len(positions); i++ {
+			k, ok := positions[i]
+			if !ok {
+				return nil, nil, http.StatusInternalServerError, newApiError(ErrCodeBadPath, fmt.Sprintf("ancestor var %d is missing", i))
+			}
+			ancestorVars = append(ancestorVars, k)
+		}
+	}
+
+	ancestors := make([]ustore.SIDType, len(ancestorVars))
+	for i, k := range ancestorVars {
+		sid, err := ustore.SIDFromString(vrs[k])
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, newApiError(ErrCodeBadID, err.Error())
 		}
 
 		ancestors[i] = sid
 	}
 
-	return ancestors, nil
+	return ancestors, params, http.StatusOK, nil
 }
 
 func isAuthorized(r *http.Request, ent ustore.Entity, u *ustore.User, ancestors ...ustore.SIDType) (int, *ApiError) {
@@ -416,10 +541,7 @@ func isAuthorized(r *http.Request, ent ustore.Entity, u *ustore.User, ancestors
 		return ApiErrFromStoreErr(err)
 	}
 	if !can {
-		return http.StatusForbidden, &ApiError{
-			Desc:  "user has no authority to perform request",
-			Debug: "",
-		}
+		return http.StatusForbidden, newApiError(ErrCodeForbidden, "")
 	}
 
 	return http.StatusOK, nil
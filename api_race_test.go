@@ -0,0 +1,109 @@
+package uviews
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+// Run with -race. Bad requests are rejected before any store call,
+// so this test does not touch the DB
+func TestConcurrentBadRequests(t *testing.T) {
+	// Users are root entities: collection ops take no ancestors
+	// and item ops take 1
+	cases := []struct {
+		method  string
+		path    string
+		handler ApiHandler
+		// Ancestors sent
+		n int
+	}{
+		// Rejected by the handlers
+		{http.MethodGet, "/race", ApiGet, 0},
+		{http.MethodPut, "/race", ApiUpdate, 0},
+		{http.MethodDelete, "/race", ApiDelete, 0},
+		{http.MethodPost, "/race/{0}", ApiAdd, 1},
+		{http.MethodGet, "/race/{0}", ApiList, 1},
+		// Rejected before the handlers
+		{http.MethodGet, "/race/{0}/{1}", ApiGet, 2},
+		{http.MethodPost, "/race/{0}/{1}/{2}", ApiAdd, 3},
+	}
+
+	for _, c := range cases {
+		app.Router.HandleFunc(c.path, app.ApiBypassAuthentication(ustore.NewUser, c.handler)).Methods(c.method)
+	}
+
+	const rounds = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, rounds*len(cases))
+
+	for i := 0; i < rounds; i++ {
+		for _, c := range cases {
+			wg.Add(1)
+			go func(method string, n int) {
+				defer wg.Done()
+				errs <- badAncestorsRequest(method, n)
+			}(c.method, c.n)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	fmt.Printf("CONCURRENT BAD REQUESTS REJECTED\n")
+}
+
+// badAncestorsRequest - Sends a request with n ancestors and checks that the
+// response is a single 400 error describing this request
+func badAncestorsRequest(method string, n int) error {
+	url := "/race"
+	for i := 0; i < n; i++ {
+		url += "/0123456789abcdef0123456789abcdef"
+	}
+
+	var body *bytes.Buffer
+	if method == http.MethodPost || method == http.MethodPut {
+		b, _ := json.Marshal(NewMessageSim(&ustore.User{Username: "osm1608@gmail.com"}))
+		body = bytes.NewBuffer(b)
+	} else {
+		body = bytes.NewBuffer(nil)
+	}
+
+	req, _ := http.NewRequest(method, url, body)
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeReq(req)
+	if code := response.Result().StatusCode; code != http.StatusBadRequest {
+		return fmt.Errorf("%s %s: expected status code %d, got %d", method, url, http.StatusBadRequest, code)
+	}
+
+	// A handler that falls through would write a second document
+	var r Response
+	if err := json.Unmarshal(response.Body.Bytes(), &r); err != nil {
+		return fmt.Errorf("%s %s: %v", method, url, err)
+	}
+
+	if len(r.Error) != 1 || r.Error[0].Code != ErrCodeAncestorsMismatch {
+		return fmt.Errorf("%s %s: expected a single %s error, got %+v", method, url, ErrCodeAncestorsMismatch, r.Error)
+	}
+
+	if want := fmt.Sprintf("got %d", n); !strings.HasSuffix(r.Error[0].Debug, want) {
+		return fmt.Errorf("%s %s: expected debug ending with %q, got %q", method, url, want, r.Error[0].Debug)
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
@@ -35,8 +36,41 @@ type App struct {
 	name string
 	// CSRF Secret Key
 	csrfKey []byte
+	// CSRF protection is on, see EnableCSRF
+	csrfEnabled bool
 	// Requests with no auth are redirected here
 	notAuthPath string
+	// Prefix of the problem type URI, empty if problem details are disabled
+	problemTypeBase string
+	// ReDoc script of the OpenAPI docs page
+	docsScript openAPIDocsScript
+	// Entity changes made through the API
+	events *eventHub
+	// Live WebSocket connections
+	ws *wsHub
+	// Webhook subscriptions to the events
+	webhooks *webhookDispatcher
+	// Push notification providers by client Os
+	notifiersMu sync.RWMutex
+	notifiers   map[string]Notifier
+	// Client activity and revocations
+	devices *deviceTracker
+	// Where the view sessions live
+	sessions SessionStore
+	// Session cookie and timeouts, set while requests are served
+	sessionMu     sync.RWMutex
+	sessionConfig SessionConfig
+	// Persistent logins, nil if disabled
+	remember *rememberMe
+	// Activity and revocations of the view sessions
+	sessionActivity *sessionTracker
+	// Allowed return-to path prefixes, any local path if empty
+	returnPaths []string
+	// API routes mounted with ApiRoute and Resource
+	apiRoutesMu sync.RWMutex
+	apiRoutes   []*apiRoute
+	// Responses to the requests with an Idempotency-Key, nil if disabled
+	idempotency *idempotency
 }
 
 // NewApp - Creates and configures Router
@@ -47,9 +81,6 @@ type App struct {
 func NewApp(appName string, csrfKey []byte, port string, dataDir string, rootPath string, notAuthPath string) *App {
 	appName = "_" + strings.TrimSpace(strings.ToLower(appName))
 
-	// Sets up the session ID
-	SetupSessions(appName + "sessionid")
-
 	r := mux.NewRouter().StrictSlash(true)
 
 	// File server for static content
@@ -63,7 +94,16 @@ func NewApp(appName string, csrfKey []byte, port string, dataDir string, rootPat
 		notAuthPath: notAuthPath,
 		name:        appName,
 		csrfKey:     csrfKey,
+		events:      newEventHub(defaultEventLogSize),
+		ws:          newWSHub(),
+		notifiers:   map[string]Notifier{},
+		devices:     newDeviceTracker(),
+		sessions:    NewDBSessionStore(),
+
+		sessionConfig:   defaultSessionConfig(appName),
+		sessionActivity: newSessionTracker(),
 	}
+	app.webhooks = newWebhookDispatcher(app.events)
 
 	// CSRF middleware
 	/*csrfMiddleware := csrf.Protect(
@@ -77,6 +117,7 @@ func NewApp(appName string, csrfKey []byte, port string, dataDir string, rootPat
 	log.Printf("MaxAge set\n")*/
 
 	// Enable middlewares
+	r.Use(app.contextMiddleware)
 	r.Use(loggingMiddleware)
 	r.Use(app.redirectMiddleware)
 	//r.Use(csrfMiddleware)
@@ -86,6 +127,7 @@ func NewApp(appName string, csrfKey []byte, port string, dataDir string, rootPat
 }
 
 func (app *App) EnableCSRF() {
+	app.csrfEnabled = true
 	app.Router.Use(
 		csrf.Protect(
 			app.csrfKey,
@@ -98,6 +140,16 @@ func (app *App) EnableCSRF() {
 	)
 }
 
+// EnableProblemDetails - JSON API error responses are written as RFC 7807
+// application/problem+json. The problem type is typeBase followed by the
+// error code, typeBase defaults to "urn:uviews:problem:"
+func (app *App) EnableProblemDetails(typeBase string) {
+	if typeBase == "" {
+		typeBase = defaultProblemTypeBase
+	}
+	app.problemTypeBase = typeBase
+}
+
 func (app *App) RunApp() {
 	// Start server
 	unsecureServerStart(app.Router, app.port)
@@ -229,8 +281,15 @@ func (app *App) RestPostHandler(w http.ResponseWriter, r *http.Request, entity u
 	//v.Post(w, r)
 }
 
+// Authenticate - Serves the view to signed in users with a confirmed
+// email, others are redirected to the not authenticated path. The session
+// data bag (see SessionData) is written back before the response
 func (app *App) Authenticate(newView func() View, viewHandler func(http.ResponseWriter, *http.Request, View)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// Session data is written back before the response
+		w := newSessionWriter(rw, r)
+		defer w.writeBack()
+
 		view := newView()
 		if err := view.Load(w, r); err != nil {
 			return
@@ -245,8 +304,14 @@ func (app *App) Authenticate(newView func() View, viewHandler func(http.Response
 	}
 }
 
+// BypassAuthentication - Serves the view to anyone. The session data bag (see
+// SessionData) is written back before the response
 func (app *App) BypassAuthentication(newView func() View, viewHandler func(http.ResponseWriter, *http.Request, View)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// Session data is written back before the response
+		w := newSessionWriter(rw, r)
+		defer w.writeBack()
+
 		view := newView()
 		if err := view.Load(w, r); err != nil {
 			return
@@ -279,5 +344,6 @@ func templateFuncs(lang string) template.FuncMap {
 			}
 			return ""
 		},
+		"flashes": func() []*Flash { return nil },
 	}
 }
@@ -1,84 +1,287 @@
 package uviews
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/gorilla/mux"
 	"github.com/usfsci/ustore"
 )
 
-var ApiErrNotAuthenticated = &ApiError{
-	//Code:  http.StatusUnauthorized,
-	Desc:  "unauthenticated",
-	Debug: "no debug information",
+// ApiHandler - Handles an API request on ent, once authenticated and authorized.
+// u is nil if the route bypasses authentication
+type ApiHandler func(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType)
+
+// apiRoute - What an API route does, as registered
+type apiRoute struct {
+	newEntity func() ustore.Entity
+	handler   ApiHandler
+	// False if the route bypasses authentication
+	authenticate bool
+	// Users must have confirmed their email
+	checkEmail bool
+	// Names of the ancestor path vars, in order. Empty for numbered vars
+	ancestorVars []string
+	// Resource the route belongs to, nil if registered route by route
+	resource *Resource
+	// Generic operation of the handler, empty for App handlers or routes
+	// not registered with ApiRoute or Resource
+	op ResourceOp
+	// Where the route is mounted, empty if not registered
+	path   string
+	method string
+}
+
+// isAncestorVar - Reports whether the path var holds an ancestor id
+func (route *apiRoute) isAncestorVar(name string) bool {
+	if len(route.ancestorVars) == 0 {
+		_, err := strconv.Atoi(name)
+		return err == nil
+	}
+
+	for _, v := range route.ancestorVars {
+		if v == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enrollsClient - Reports whether the route adds a client, which the
+// request cannot identify itself with yet
+func (route *apiRoute) enrollsClient() bool {
+	if route.op != OpAdd {
+		return false
+	}
+	_, ok := route.newEntity().(*ustore.Client)
+
+	return ok
+}
+
+// ApiRoute - An API route mounted with App.ApiRoute
+type ApiRoute struct {
+	NewEntity func() ustore.Entity
+	// Generic operation of the route, e.g. OpAdd. It is served by its
+	// handler, ApiAdd for OpAdd, and documented as such. Empty for routes
+	// served by an App handler
+	Op ResourceOp
+	// Serves the route instead of the Op handler, e.g. a wrapper of it
+	Handler ApiHandler
+	// Defaults to the method of Op
+	Method string
+	// Bypass authentication
+	Public bool
+	// Accept users that did not confirm their email yet
+	SkipEmailCheck bool
+	// Names of the ancestor path vars, as in ApiAuthenticate
+	AncestorVars []string
+}
+
+// ApiRoute - Mounts an API route on path. Unlike the handlers returned by
+// ApiAuthenticate and ApiBypassAuthentication, the route is known to the
+// App: it is documented by ServeOpenAPI, and OpAdd routes of clients
+// enroll them (see RequireClientID).
+// Panics if the route has neither a Handler nor a known Op, or no method
+func (app *App) ApiRoute(path string, ar ApiRoute) *mux.Route {
+	method, handler, known := opRoute(ar.Op)
+	if ar.Op != "" && !known {
+		panic(fmt.Sprintf("uviews: unknown operation %s on api route %s", ar.Op, path))
+	}
+	if ar.Handler != nil {
+		handler = ar.Handler
+	}
+	if ar.Method != "" {
+		method = ar.Method
+	}
+	if handler == nil || method == "" {
+		panic(fmt.Sprintf("uviews: api route %s needs a handler and a method", path))
+	}
+
+	return app.mountApiRoute(path, method, &apiRoute{
+		newEntity:    ar.NewEntity,
+		handler:      handler,
+		authenticate: !ar.Public,
+		checkEmail:   !ar.Public && !ar.SkipEmailCheck,
+		ancestorVars: ar.AncestorVars,
+		op:           ar.Op,
+	})
+}
+
+// mountApiRoute - Mounts route on path and records it
+func (app *App) mountApiRoute(path string, method string, route *apiRoute) *mux.Route {
+	route.path = path
+	route.method = method
+
+	app.apiRoutesMu.Lock()
+	app.apiRoutes = append(app.apiRoutes, route)
+	app.apiRoutesMu.Unlock()
+
+	return app.Router.HandleFunc(path, app.apiRouteHandler(route)).Methods(method)
+}
+
+// registeredApiRoutes - The routes mounted with mountApiRoute
+func (app *App) registeredApiRoutes() []*apiRoute {
+	app.apiRoutesMu.RLock()
+	defer app.apiRoutesMu.RUnlock()
+
+	return append([]*apiRoute{}, app.apiRoutes...)
 }
 
+// ApiAuthenticate - Handles the route with apiHandler once the Basic Auth
+// user is authenticated and authorized on the entity.
+// ancestorVars are the names of the path vars holding the ancestor ids, in
+// order. If none are given the ancestors are the numbered vars {0}, {1}...
+// The other path vars are available to the handler through Params.
+// The App does not know where the handler is mounted, see ApiRoute
 func (app *App) ApiAuthenticate(
 	newEntity func() ustore.Entity,
-	apiHandler func(http.ResponseWriter, *http.Request, ustore.Entity, *ustore.User, []ustore.SIDType),
+	apiHandler ApiHandler,
 	checkEmail bool,
+	ancestorVars ...string,
 ) http.HandlerFunc {
-	const origin = "authenticate"
+	return app.apiRouteHandler(&apiRoute{
+		newEntity:    newEntity,
+		handler:      apiHandler,
+		authenticate: true,
+		checkEmail:   checkEmail,
+		ancestorVars: ancestorVars,
+	})
+}
 
+// ApiBypassAuthentication - Handles the route with apiHandler, without
+// authentication. ancestorVars work as in ApiAuthenticate
+func (app *App) ApiBypassAuthentication(
+	newEntity func() ustore.Entity,
+	apiHandler ApiHandler,
+	ancestorVars ...string,
+) http.HandlerFunc {
+	return app.apiRouteHandler(&apiRoute{
+		newEntity:    newEntity,
+		handler:      apiHandler,
+		ancestorVars: ancestorVars,
+	})
+}
+
+// apiRouteHandler - Every API route is served by this closure
+func (app *App) apiRouteHandler(route *apiRoute) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		uname, pass, ok := r.BasicAuth()
+		origin := app.name
+		if route.authenticate {
+			origin = "authenticate"
+		}
 
-		if !ok || uname == "" {
-			responseNotAuthenticated(w, app.name)
+		if !negotiateCodecs(w, r, origin) {
 			return
 		}
 
-		// Check user in DB
-		usr := ustore.NewUser().(*ustore.User)
-		usr.Username = uname
+		var usr *ustore.User
+		if route.authenticate {
+			var ok bool
+			if usr, ok = authenticateUser(r, route.checkEmail); !ok {
+				responseNotAuthenticated(w, r, app.name)
+				return
+			}
 
-		if err := usr.GetByName(r.Context()); err != nil {
-			responseNotAuthenticated(w, app.name)
-			return
+			if !app.checkDevice(w, r, usr.ID, route.enrollsClient()) {
+				return
+			}
 		}
 
-		if checkEmail && !usr.EmailConfirmed {
-			responseNotAuthenticated(w, app.name)
+		ancestors, params, code, apiErr := listAncestors(r, route.ancestorVars)
+		if apiErr != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
 			return
 		}
+		ctx := context.WithValue(r.Context(), pathParamsContextKey, params)
+		if route.resource != nil {
+			ctx = context.WithValue(ctx, resourceContextKey, route.resource)
+		}
+		r = r.WithContext(ctx)
 
-		if err := usr.Authenticate(pass); err != nil {
-			responseNotAuthenticated(w, app.name)
+		ent := route.newEntity()
+
+		// Collection ops take the entity root ancestors, item ops one more
+		if n := ent.AncestorsRootLen(); len(ancestors) != n && len(ancestors) != n+1 {
+			e := newApiError(ErrCodeAncestorsMismatch, fmt.Sprintf("expected %d or %d ancestors, got %d", n, n+1, len(ancestors)))
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusBadRequest)
 			return
 		}
 
 		// Check if user is authorized to attempt request on this entity
-		ancestors, apiErr := listAncestors(r)
-		if apiErr != nil {
-			ApiResponseWrite(w, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
-			return
+		if route.authenticate {
+			code, apiErr := isAuthorized(r, ent, usr, ancestors...)
+			if apiErr != nil {
+				ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
+				return
+			}
 		}
 
-		ent := newEntity()
-
-		code, apiErr := isAuthorized(r, ent, usr, ancestors...)
-		if apiErr != nil {
-			ApiResponseWrite(w, origin, nil, []*ApiError{apiErr}, code)
+		if app.idempotency == nil {
+			route.handler(w, r, ent, usr, ancestors)
 			return
 		}
 
-		apiHandler(w, r, ent, usr, ancestors)
+		var userID ustore.SIDType
+		if usr != nil {
+			userID = usr.ID
+		}
+		app.idempotency.serve(w, r, origin, userID, func(w http.ResponseWriter, r *http.Request) {
+			route.handler(w, r, ent, usr, ancestors)
+		})
 	}
 }
 
-func (app *App) ApiBypassAuthentication(
-	newEntity func() ustore.Entity,
-	apiHandler func(http.ResponseWriter, *http.Request, ustore.Entity, *ustore.User, []ustore.SIDType),
-) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ancestors, apiErr := listAncestors(r)
-		if apiErr != nil {
-			ApiResponseWrite(w, app.name, nil, []*ApiError{apiErr}, http.StatusBadRequest)
-			return
-		}
-		apiHandler(w, r, newEntity(), nil, ancestors)
+// authenticateUser - Checks the request Basic Auth credentials against the DB
+func authenticateUser(r *http.Request, checkEmail bool) (*ustore.User, bool) {
+	uname, pass, ok := r.BasicAuth()
+	if !ok || uname == "" {
+		return nil, false
+	}
+
+	// Check user in DB
+	usr := ustore.NewUser().(*ustore.User)
+	usr.Username = uname
+
+	if err := usr.GetByName(r.Context()); err != nil {
+		return nil, false
+	}
+
+	if checkEmail && !usr.EmailConfirmed {
+		return nil, false
 	}
+
+	if err := usr.Authenticate(pass); err != nil {
+		return nil, false
+	}
+
+	return usr, true
 }
 
-func responseNotAuthenticated(w http.ResponseWriter, origin string) {
-	ApiResponseWrite(w, origin, nil, []*ApiError{ApiErrNotAuthenticated}, http.StatusUnauthorized)
+func responseNotAuthenticated(w http.ResponseWriter, r *http.Request, origin string) {
+	ApiResponseWrite(w, r, origin, nil, []*ApiError{ApiErrNotAuthenticated()}, http.StatusUnauthorized)
+}
+
+// checkDevice - Records the request of the user client, see
+// deviceTracker.seen. Writes a 401 response if the client is revoked or
+// missing. Returns false if the request should not be processed any further
+func (app *App) checkDevice(w http.ResponseWriter, r *http.Request, userID ustore.SIDType, enrolling bool) bool {
+	err := app.devices.seen(r, userID, enrolling)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errDeviceRevoked):
+		e := newApiError(ErrCodeDeviceRevoked, r.Header.Get(ClientIDHeaderKey))
+		ApiResponseWrite(w, r, app.name, nil, []*ApiError{e}, http.StatusUnauthorized)
+	case errors.Is(err, errClientIDRequired):
+		e := newApiError(ErrCodeClientIDRequired, ClientIDHeaderKey)
+		ApiResponseWrite(w, r, app.name, nil, []*ApiError{e}, http.StatusUnauthorized)
+	default:
+		ApiResponseStoreError(w, r, app.name, err)
+	}
+
+	return false
 }
@@ -0,0 +1,462 @@
+package uviews
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/usfsci/ustore"
+)
+
+// Flash formats of the auth views, localized by the printer
+const (
+	flashInvalidLogin      = "Invalid username or password"
+	flashTooManyAttempts   = "Too many attempts, please try again later"
+	flashPasswordsMismatch = "Passwords do not match"
+	flashTermsNotAccepted  = "You must accept the terms to sign up"
+	flashSignupFailed      = "Could not sign up: %s"
+	flashSignedUp          = "Welcome! Please check your email to confirm your address"
+	flashSignedOut         = "You have been signed out"
+)
+
+// AuthViews - The login, logout and sign-up views of an App. Templates
+// are executed with a *LoginForm or *SignupForm, built-in ones are used if
+// none are given
+type AuthViews struct {
+	// Defaults to /login, /logout and /signup
+	LoginPath  string
+	LogoutPath string
+	SignupPath string
+	// Email flows, see TokenLink. Default to /forgot-password,
+	// /reset-password, /confirm-email and /confirm-email/resend
+	ForgotPath  string
+	ResetPath   string
+	ConfirmPath string
+	ResendPath  string
+	// Where users land after login or sign-up without a return path, and
+	// after logout. Defaults to /
+	HomePath string
+
+	// Template files, the first one is executed
+	LoginTemplates  []string
+	SignupTemplates []string
+	ForgotTemplates []string
+	ResetTemplates  []string
+
+	// Limit - Called before every login, sign-up and email attempt, returning
+	// false refuses it. Hook for rate limiting, nil to allow every attempt
+	Limit func(r *http.Request, username string) bool
+	// Attempted - Called after every login attempt with its outcome,
+	// e.g. to count failures. Can be nil
+	Attempted func(r *http.Request, username string, ok bool)
+}
+
+// LoginForm - Fields of the login view
+type LoginForm struct {
+	DefaultForm
+	Username string `schema:"username,required"`
+	// Never kept in the session
+	Password string `schema:"password,required" json:"-"`
+	Remember bool   `schema:"remember"`
+	// Path to return to after login, see ReturnToValue
+	ReturnTo string `schema:"rp"`
+	// Set on the GET when the signed in user has not confirmed the email,
+	// the view then asks to confirm it and offers ResendPath
+	Unconfirmed bool   `schema:"-" json:"-"`
+	ResendPath  string `schema:"-" json:"-"`
+	LogoutPath  string `schema:"-" json:"-"`
+}
+
+// SignupForm - Fields of the sign-up view
+type SignupForm struct {
+	DefaultForm
+	Username string `schema:"username,required"`
+	// Never kept in the session
+	Password        string `schema:"password,required" json:"-"`
+	PasswordConfirm string `schema:"password_confirm,required" json:"-"`
+	AcceptedTerms   bool   `schema:"accepted_terms"`
+	AcceptedNews    bool   `schema:"accepted_news"`
+	CountryCode     string `schema:"country_code"`
+	ReturnTo        string `schema:"rp"`
+}
+
+// dummyPasswordHash - Checked against the password of unknown usernames,
+// so that they take as long to refuse as wrong passwords
+var dummyPasswordHash = []byte("$2a$10$grmNOWNgZnRSvIV5YnT2VOWEJ5.klziJ0lxDdEr8km8KQtQ46Aayu")
+
+// MountAuthViews - Routes the login, logout, sign-up and email flow views.
+// Logout and resend are POST only so that they are covered by CSRF
+// protection. EnableCSRF should be called first, mounting the views
+// without it is logged
+func (app *App) MountAuthViews(av *AuthViews) {
+	if !app.csrfEnabled {
+		log.Printf("uviews: auth views of %s mounted without CSRF protection, see EnableCSRF\n", app.name)
+	}
+
+	if av.LoginPath == "" {
+		av.LoginPath = "/login"
+	}
+	if av.LogoutPath == "" {
+		av.LogoutPath = "/logout"
+	}
+	if av.SignupPath == "" {
+		av.SignupPath = "/signup"
+	}
+	if av.ForgotPath == "" {
+		av.ForgotPath = "/forgot-password"
+	}
+	if av.ResetPath == "" {
+		av.ResetPath = "/reset-password"
+	}
+	if av.ConfirmPath == "" {
+		av.ConfirmPath = "/confirm-email"
+	}
+	if av.ResendPath == "" {
+		av.ResendPath = "/confirm-email/resend"
+	}
+	if av.HomePath == "" {
+		av.HomePath = "/"
+	}
+
+	newLogin := func() View { return &LoginView{views: av} }
+	newLogout := func() View { return &LogoutView{views: av} }
+	newSignup := func() View { return &SignupView{views: av} }
+
+	app.Router.HandleFunc(av.LoginPath, app.BypassAuthentication(newLogin, app.ViewGetHandler)).Methods(http.MethodGet)
+	app.Router.HandleFunc(av.LoginPath, app.BypassAuthentication(newLogin, app.ViewPostHandler)).Methods(http.MethodPost)
+	app.Router.HandleFunc(av.LogoutPath, app.BypassAuthentication(newLogout, app.ViewPostHandler)).Methods(http.MethodPost)
+	app.Router.HandleFunc(av.SignupPath, app.BypassAuthentication(newSignup, app.ViewGetHandler)).Methods(http.MethodGet)
+	app.Router.HandleFunc(av.SignupPath, app.BypassAuthentication(newSignup, app.ViewPostHandler)).Methods(http.MethodPost)
+
+	app.mountAccountViews(av)
+}
+
+// allowed - Asks the rate limiting hook
+func (av *AuthViews) allowed(r *http.Request, username string) bool {
+	return av.Limit == nil || av.Limit(r, username)
+}
+
+// landing - Where to go once signed in
+func (av *AuthViews) landing(r *http.Request, returnTo string) string {
+	if p, ok := ReturnPath(r, returnTo); ok {
+		return p
+	}
+
+	return av.HomePath
+}
+
+// render - Renders f with the template files, the built-in template if none
+func (av *AuthViews) render(w http.ResponseWriter, r *http.Request, files []string, builtin string, view View, f Form) {
+	if len(files) > 0 {
+		RenderForm(w, r, files, view, f)
+		return
+	}
+
+	renderForm(w, r, "auth", func(t *template.Template) (*template.Template, error) {
+		return t.Parse(builtin)
+	}, view, f)
+}
+
+// back - Redirects to the view GET keeping the return path
+func back(w http.ResponseWriter, r *http.Request, returnTo string) {
+	to := r.URL.Path
+	if returnTo != "" {
+		to = withQuery(to, url.Values{returnToKey: {returnTo}})
+	}
+
+	http.Redirect(w, r, to, http.StatusSeeOther)
+}
+
+// signIn - Moves the session to the user, with a new session ID
+func signIn(w http.ResponseWriter, r *http.Request, session *ustore.Session, userID ustore.SIDType) error {
+	session.UserID = userID
+
+	return SaveSession(w, r, session)
+}
+
+// LoginView - Signs users in with their username and password
+type LoginView struct {
+	DefaultView
+	views *AuthViews
+}
+
+// CanRead - Anyone can sign in
+func (v *LoginView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+// CanWrite - Anyone can sign in
+func (v *LoginView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (v *LoginView) Get(w http.ResponseWriter, r *http.Request) {
+	// Signed in users go on once confirmed. The views that need a confirmed
+	// email send the others here, they are asked to confirm it instead
+	if v.User != nil && v.User.EmailConfirmed {
+		http.Redirect(w, r, v.views.landing(r, r.URL.Query().Get(returnToKey)), http.StatusSeeOther)
+		return
+	}
+
+	f := &LoginForm{}
+	if v.User != nil {
+		f.Username = v.User.Username
+		f.Unconfirmed = true
+		f.ResendPath = v.views.ResendPath
+		f.LogoutPath = v.views.LogoutPath
+	}
+	if err := RestoreFormFromSession(w, r, v.Session, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rp := r.URL.Query().Get(returnToKey); rp != "" {
+		f.ReturnTo = rp
+	}
+
+	v.views.render(w, r, v.views.LoginTemplates, loginTemplate, v, f)
+}
+
+func (v *LoginView) Post(w http.ResponseWriter, r *http.Request) {
+	f := &LoginForm{}
+	if err := DecodeForm(w, r, v.Session, f, func(Form) bool { return true }); err != nil {
+		return
+	}
+
+	// fail - Back to the form with the username and a flash
+	fail := func(format string) {
+		if err := AddFlash(w, r, v.Session, FlashError, format); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		if err := StoreFormInSession(w, r, v.Session, f); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		back(w, r, f.ReturnTo)
+	}
+
+	if !v.views.allowed(r, f.Username) {
+		fail(flashTooManyAttempts)
+		return
+	}
+
+	u := ustore.NewUser().(*ustore.User)
+	u.Username = f.Username
+	var ok bool
+	if err := u.GetByName(r.Context()); err != nil {
+		// Unknown usernames take as long as wrong passwords
+		dummy := &ustore.User{Password: dummyPasswordHash}
+		dummy.Authenticate(f.Password)
+	} else {
+		ok = u.Authenticate(f.Password) == nil
+	}
+	if v.views.Attempted != nil {
+		v.views.Attempted(r, f.Username, ok)
+	}
+	if !ok {
+		fail(flashInvalidLogin)
+		return
+	}
+
+	if err := signIn(w, r, v.Session, u.ID); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+	if f.Remember {
+		if err := Remember(w, r, v.Session); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, v.views.landing(r, f.ReturnTo), http.StatusSeeOther)
+}
+
+// LogoutView - Signs users out, ending their session and remembered login
+type LogoutView struct {
+	DefaultView
+	views *AuthViews
+}
+
+// CanRead - Logout has no page, GET goes home
+func (v *LogoutView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+// CanWrite - Anyone can sign out
+func (v *LogoutView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (v *LogoutView) Get(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, v.views.HomePath, http.StatusSeeOther)
+}
+
+func (v *LogoutView) Post(w http.ResponseWriter, r *http.Request) {
+	if err := Forget(w, r); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+	if err := DestroySession(w, r, v.Session); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	// A new anonymous session carries the flash
+	s, err := InitSession(w, r, nil)
+	if err != nil {
+		return
+	}
+	if err := AddFlash(w, r, s, FlashInfo, flashSignedOut); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, v.views.HomePath, http.StatusSeeOther)
+}
+
+// SignupView - Registers users, who must accept the terms, and signs them in
+type SignupView struct {
+	DefaultView
+	views *AuthViews
+}
+
+// CanRead - Anyone can sign up
+func (v *SignupView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+// CanWrite - Anyone can sign up
+func (v *SignupView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (v *SignupView) Get(w http.ResponseWriter, r *http.Request) {
+	f := &SignupForm{}
+	if err := RestoreFormFromSession(w, r, v.Session, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rp := r.URL.Query().Get(returnToKey); rp != "" {
+		f.ReturnTo = rp
+	}
+
+	v.views.render(w, r, v.views.SignupTemplates, signupTemplate, v, f)
+}
+
+func (v *SignupView) Post(w http.ResponseWriter, r *http.Request) {
+	f := &SignupForm{}
+	if err := DecodeForm(w, r, v.Session, f, func(Form) bool { return true }); err != nil {
+		return
+	}
+
+	// fail - Back to the form with the entered data and a flash
+	fail := func(format string, args ...interface{}) {
+		if err := AddFlash(w, r, v.Session, FlashError, format, args...); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		if err := StoreFormInSession(w, r, v.Session, f); err != nil {
+			HandleStoreError(w, err)
+			return
+		}
+		back(w, r, f.ReturnTo)
+	}
+
+	switch {
+	case !v.views.allowed(r, f.Username):
+		fail(flashTooManyAttempts)
+		return
+	case f.Password != f.PasswordConfirm:
+		f.SetMissing("password_confirm")
+		fail(flashPasswordsMismatch)
+		return
+	case !f.AcceptedTerms:
+		f.SetMissing("accepted_terms")
+		fail(flashTermsNotAccepted)
+		return
+	}
+
+	news := f.AcceptedNews
+	u := &ustore.User{
+		Username:      f.Username,
+		Password:      []byte(f.Password),
+		AcceptedTerms: f.AcceptedTerms,
+		AcceptedNews:  &news,
+		CountryCode:   f.CountryCode,
+	}
+	if err := u.Add(r.Context(), getLanguage(r)); err != nil {
+		m := storeErrorMapping(err)
+		if m.Status >= http.StatusInternalServerError {
+			HandleStoreError(w, err)
+			return
+		}
+		fail(flashSignupFailed, m.apiError(err).Desc)
+		return
+	}
+
+	if err := signIn(w, r, v.Session, u.ID); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+	if err := AddFlash(w, r, v.Session, FlashSuccess, flashSignedUp); err != nil {
+		HandleStoreError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, v.views.landing(r, f.ReturnTo), http.StatusSeeOther)
+}
+
+// Built-in templates, executed when the App gives none
+const (
+	loginTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{pPrintf "Sign in"}}</title></head>
+<body>
+{{range flashes}}<p class="flash {{.Level}}">{{.Text}}</p>
+{{end}}{{if .Unconfirmed}}<p>{{pPrintf "Please confirm your email address %s to go on" .Username}}</p>
+<form method="post" action="{{.ResendPath}}">
+{{.CsrfField}}
+<button type="submit" name="action" value="resend">{{pPrintf "Resend confirmation email"}}</button>
+</form>
+<form method="post" action="{{.LogoutPath}}">
+{{.CsrfField}}
+<button type="submit" name="action" value="logout">{{pPrintf "Sign out"}}</button>
+</form>
+{{else}}<form method="post">
+{{.CsrfField}}
+<input type="hidden" name="rp" value="{{.ReturnTo}}">
+<label>{{pPrintf "Username"}} <input name="username" value="{{.Username}}" required></label>
+<label>{{pPrintf "Password"}} <input type="password" name="password" required></label>
+<label><input type="checkbox" name="remember" value="true"{{if .Remember}} checked{{end}}> {{pPrintf "Remember me"}}</label>
+<button type="submit" name="action" value="login">{{pPrintf "Sign in"}}</button>
+</form>
+{{end}}</body></html>
+`
+
+	signupTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{pPrintf "Sign up"}}</title></head>
+<body>
+{{range flashes}}<p class="flash {{.Level}}">{{.Text}}</p>
+{{end}}<form method="post">
+{{.CsrfField}}
+<input type="hidden" name="rp" value="{{.ReturnTo}}">
+<label>{{pPrintf "Username"}} <input name="username" value="{{.Username}}" required></label>
+<label>{{pPrintf "Password"}} <input type="password" name="password" required></label>
+<label>{{pPrintf "Confirm password"}} <input type="password" name="password_confirm" required></label>
+<label>{{pPrintf "Country"}} <input name="country_code" value="{{.CountryCode}}"></label>
+<label><input type="checkbox" name="accepted_terms" value="true"{{if .AcceptedTerms}} checked{{end}}> {{pPrintf "I accept the terms"}}</label>
+<label><input type="checkbox" name="accepted_news" value="true"{{if .AcceptedNews}} checked{{end}}> {{pPrintf "Send me news"}}</label>
+<button type="submit" name="action" value="signup">{{pPrintf "Sign up"}}</button>
+</form>
+</body></html>
+`
+)
+
+// Interface checks
+var (
+	_ View = &LoginView{}
+	_ View = &LogoutView{}
+	_ View = &SignupView{}
+)
@@ -0,0 +1,186 @@
+package uviews
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+// browser - Sends requests to an App keeping its cookies
+type browser struct {
+	h       http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func newBrowser(h http.Handler) *browser {
+	return &browser{h: h, cookies: map[string]*http.Cookie{}}
+}
+
+func (b *browser) do(method string, target string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set(contentTypeKey, "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+
+	rec := httptest.NewRecorder()
+	b.h.ServeHTTP(rec, r)
+
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+			continue
+		}
+		b.cookies[c.Name] = c
+	}
+
+	return rec
+}
+
+func TestAuthViewsRejections(t *testing.T) {
+	napp := NewApp("auth_app", []byte("1234"), "11743", "", "", "")
+	napp.SetSessionStore(NewMemorySessionStore())
+	limited := false
+	napp.MountAuthViews(&AuthViews{
+		HomePath: "/home",
+		Limit:    func(r *http.Request, username string) bool { return !limited },
+		Attempted: func(r *http.Request, username string, ok bool) {
+			t.Error("expected no login attempt")
+		},
+	})
+	b := newBrowser(napp.Router)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), appContextKey, napp))
+	rp := ReturnToValue(req, "/account")
+	if rec := b.do(http.MethodGet, "/login?rp="+rp, nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="`+rp+`"`) {
+		t.Errorf("expected the login form with the return path, got %d %s\n", rec.Code, rec.Body)
+		return
+	}
+
+	cases := []struct {
+		path  string
+		form  url.Values
+		flash string
+	}{
+		{"/signup", url.Values{"username": {"a@b.c"}, "password": {"x1"}, "password_confirm": {"x2"}, "accepted_terms": {"true"}}, flashPasswordsMismatch},
+		{"/signup", url.Values{"username": {"a@b.c"}, "password": {"x1"}, "password_confirm": {"x1"}}, flashTermsNotAccepted},
+		{"/login", url.Values{"username": {"a@b.c"}, "password": {"x1"}, "rp": {rp}}, flashTooManyAttempts},
+	}
+	for _, c := range cases {
+		limited = c.path == "/login"
+		c.form.Set("action", "go")
+		rec := b.do(http.MethodPost, c.path, c.form)
+		if rec.Code != http.StatusSeeOther || !strings.HasPrefix(rec.Header().Get("Location"), c.path) {
+			t.Errorf("%s: expected a redirect back, got %d %s\n", c.flash, rec.Code, rec.Header().Get("Location"))
+			return
+		}
+
+		rec = b.do(http.MethodGet, rec.Header().Get("Location"), nil)
+		body := rec.Body.String()
+		if !strings.Contains(body, c.flash) || !strings.Contains(body, `value="a@b.c"`) || strings.Contains(body, "x1") {
+			t.Errorf("%s: expected the flash and the username only, got %s\n", c.flash, body)
+			return
+		}
+	}
+
+	// Logout ends the session
+	sid := b.cookies["_auth_appsessionid"].Value
+	rec := b.do(http.MethodPost, "/logout", url.Values{})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/home" || b.cookies["_auth_appsessionid"].Value == sid {
+		t.Errorf("expected a new session and a redirect home, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+	if rec := b.do(http.MethodGet, "/login", nil); !strings.Contains(rec.Body.String(), flashSignedOut) {
+		t.Errorf("expected the signed out flash, got %s\n", rec.Body)
+		return
+	}
+
+	// Only signed local paths are returned to
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte("/account"))
+	for _, v := range []string{unsigned, unsigned + "." + strings.Split(rp, ".")[1] + "x", ReturnToValue(req, "//evil.com"), ReturnToValue(req, "/\\evil.com"), ReturnToValue(req, "https://evil.com")} {
+		if p, ok := ReturnPath(req, v); ok {
+			t.Errorf("expected %s rejected, got %s\n", v, p)
+			return
+		}
+	}
+
+	fmt.Printf("TestAuthViewsRejections: OK\n")
+}
+
+func TestAuthViewsSignupLogin(t *testing.T) {
+	napp := NewApp("auth_app", []byte("1234"), "11743", "", "", "")
+	store := NewMemorySessionStore()
+	napp.SetSessionStore(store)
+	napp.EnableRememberMe(nil, 0)
+	napp.MountAuthViews(&AuthViews{})
+	b := newBrowser(napp.Router)
+
+	form := url.Values{
+		"username":         {"authviews@example.com"},
+		"password":         {"Pass123+Q"},
+		"password_confirm": {"Pass123+Q"},
+		"accepted_terms":   {"true"},
+		"action":           {"signup"},
+	}
+	if rec := b.do(http.MethodPost, "/signup", form); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Errorf("expected the user signed up, got %d %s\n", rec.Code, rec.Body)
+		return
+	}
+
+	// The signed in session has the new user
+	var id ustore.SIDType
+	for _, s := range store.sessions {
+		if len(s.UserID) > 0 {
+			id = s.UserID
+		}
+	}
+	if len(id) == 0 {
+		t.Error("expected a signed in session")
+		return
+	}
+	defer (&ustore.User{}).Erase(context.Background(), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), id)
+
+	// Unconfirmed users are asked to confirm instead of sent on
+	if rec := b.do(http.MethodGet, "/login", nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `action="/confirm-email/resend"`) {
+		t.Errorf("expected the confirm email state, got %d %s\n", rec.Code, rec.Body)
+		return
+	}
+
+	b.do(http.MethodPost, "/logout", url.Values{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), appContextKey, napp))
+	rp := ReturnToValue(req, "/account")
+	form = url.Values{
+		"username": {"authviews@example.com"},
+		"password": {"Pass123+Q"},
+		"remember": {"true"},
+		"rp":       {rp},
+		"action":   {"login"},
+	}
+	rec := b.do(http.MethodPost, "/login", form)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account" {
+		t.Errorf("expected the login to return to /account, got %d %s\n", rec.Code, rec.Header().Get("Location"))
+		return
+	}
+	if _, ok := b.cookies["_auth_appsessionidremember"]; !ok {
+		t.Error("expected a remember cookie")
+		return
+	}
+
+	fmt.Printf("TestAuthViewsSignupLogin: OK\n")
+}
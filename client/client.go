@@ -0,0 +1,342 @@
+// Package client is a Go client of the uviews JSON APIs. It wraps requests
+// in the Message envelope, decodes the Response envelope and turns the
+// ApiErrors of failed requests into *Error values
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usfsci/ustore"
+	"github.com/usfsci/uviews"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	defaultBackoff = 500 * time.Millisecond
+)
+
+// Client - A uviews API client, safe for concurrent use
+type Client struct {
+	baseURL string
+	http    *http.Client
+	// Basic Auth credentials, used if username is set
+	username string
+	password string
+	// Id of the ustore.Client sending the requests, if set
+	clientID string
+	// Attempts after the first one
+	retries int
+	// Wait before the first retry, doubled on every retry
+	backoff time.Duration
+}
+
+// Option - Configures a Client
+type Option func(*Client)
+
+// WithBasicAuth - Authenticates every request with Basic Auth
+func WithBasicAuth(username string, password string) Option {
+	return func(c *Client) {
+		c.username, c.password = username, password
+	}
+}
+
+// WithClientID - Identifies every request with the id of the registered
+// client, see uviews.ClientIDHeaderKey
+func WithClientID(id string) Option {
+	return func(c *Client) {
+		c.clientID = id
+	}
+}
+
+// WithHTTPClient - Sends the requests with h
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) {
+		c.http = h
+	}
+}
+
+// WithRetries - Retries failed requests up to retries times: network
+// errors, 429 and 5xx gateway errors. POST and PATCH requests carry an
+// Idempotency-Key, the same on every attempt: the App must enable
+// idempotency (see uviews.App.EnableIdempotency) for their retries to be
+// safe, a request whose response was lost may have been served
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries, c.backoff = retries, backoff
+	}
+}
+
+// New - Returns a client of the API at baseURL, e.g. https://api.example.com
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    &http.Client{Timeout: defaultTimeout},
+		backoff: defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Error - A request the API answered with an error
+type Error struct {
+	StatusCode int
+	Origin     string
+	Errors     []*uviews.ApiError
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("uviews: status %d", e.StatusCode)
+	}
+
+	first := e.Errors[0]
+	msg := fmt.Sprintf("uviews: status %d: %s", e.StatusCode, first.Code)
+	if first.Desc != "" {
+		msg += ": " + first.Desc
+	}
+	if first.Field != "" {
+		msg += " (" + first.Field + ")"
+	}
+
+	return msg
+}
+
+// Code - The code of the first error, one of the uviews ErrCode constants
+func (e *Error) Code() string {
+	if len(e.Errors) == 0 {
+		return ""
+	}
+
+	return e.Errors[0].Code
+}
+
+// HasCode - Reports whether err is an API error with code
+func HasCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code() == code
+}
+
+// Ref - What Add and Update return
+type Ref struct {
+	ID               string    `json:"id"`
+	ModificationTime time.Time `json:"modification_time"`
+}
+
+// SID - The id as a ustore id
+func (ref *Ref) SID() (ustore.SIDType, error) {
+	return ustore.SIDFromString(ref.ID)
+}
+
+// Path - Fills the numbered vars of a path template, e.g. the
+// CollectionPath or ItemPath of a uviews.Resource, with the ancestor ids
+func Path(tpl string, ancestors ...ustore.SIDType) (string, error) {
+	p := tpl
+	for i, id := range ancestors {
+		v := "{" + strconv.Itoa(i) + "}"
+		if !strings.Contains(p, v) {
+			return "", fmt.Errorf("path %s has no var %s", tpl, v)
+		}
+		p = strings.Replace(p, v, url.PathEscape(id.String()), 1)
+	}
+
+	if strings.ContainsAny(p, "{}") {
+		return "", fmt.Errorf("path %s needs more than %d ancestors", tpl, len(ancestors))
+	}
+
+	return p, nil
+}
+
+// Add - Posts ent to the collection, e.g. "/users/{0}/clients"
+func (c *Client) Add(ctx context.Context, collection string, ent ustore.Entity, ancestors ...ustore.SIDType) (*Ref, error) {
+	ref := &Ref{}
+	return ref, c.entityDo(ctx, http.MethodPost, collection, ancestors, ent, ref)
+}
+
+// Get - Reads the item into ent, e.g. "/users/{0}/clients/{1}"
+func (c *Client) Get(ctx context.Context, item string, ent ustore.Entity, ancestors ...ustore.SIDType) error {
+	return c.entityDo(ctx, http.MethodGet, item, ancestors, nil, ent)
+}
+
+// List - Reads the collection into list, a pointer to a slice of entities
+func (c *Client) List(ctx context.Context, collection string, list interface{}, ancestors ...ustore.SIDType) error {
+	return c.entityDo(ctx, http.MethodGet, collection, ancestors, nil, list)
+}
+
+// Update - Puts ent on the item. ent must carry the modification time
+func (c *Client) Update(ctx context.Context, item string, ent ustore.Entity, ancestors ...ustore.SIDType) (*Ref, error) {
+	ref := &Ref{}
+	return ref, c.entityDo(ctx, http.MethodPut, item, ancestors, ent, ref)
+}
+
+// Patch - Changes only the fields of data on the item, e.g. a map of the
+// JSON member names to their new values
+func (c *Client) Patch(ctx context.Context, item string, data interface{}, ancestors ...ustore.SIDType) (*Ref, error) {
+	ref := &Ref{}
+	return ref, c.entityDo(ctx, http.MethodPatch, item, ancestors, data, ref)
+}
+
+// Delete - Deletes the item
+func (c *Client) Delete(ctx context.Context, item string, ancestors ...ustore.SIDType) error {
+	return c.entityDo(ctx, http.MethodDelete, item, ancestors, nil, nil)
+}
+
+func (c *Client) entityDo(ctx context.Context, method string, tpl string, ancestors []ustore.SIDType, data interface{}, out interface{}) error {
+	p, err := Path(tpl, ancestors...)
+	if err != nil {
+		return err
+	}
+
+	return c.Do(ctx, method, p, data, out)
+}
+
+// Do - Sends data, if not nil, in a Message to path and decodes the
+// Response data into out, if not nil. Returns an *Error if the API
+// answered with an error
+func (c *Client) Do(ctx context.Context, method string, path string, data interface{}, out interface{}) error {
+	var body []byte
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if body, err = json.Marshal(&uviews.Message{Timestamp: time.Now().UnixNano(), Data: raw}); err != nil {
+			return err
+		}
+	}
+
+	var key string
+	if method == http.MethodPost || method == http.MethodPatch {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		key = hex.EncodeToString(b)
+	}
+
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, body, key)
+		last := attempt >= c.retries
+		switch {
+		case err != nil && last:
+			return err
+		case err == nil && (last || !retryable(resp.StatusCode)):
+			return decodeResponse(resp, out)
+		case err == nil:
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body []byte, key string) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, rd)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", uviews.MediaTypeJSON)
+	if body != nil {
+		req.Header.Set("Content-Type", uviews.MediaTypeJSON)
+	}
+	if key != "" {
+		req.Header.Set(uviews.IdempotencyKeyHeader, key)
+	}
+
+	if c.clientID != "" {
+		req.Header.Set(uviews.ClientIDHeaderKey, c.clientID)
+	}
+
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	return c.http.Do(req)
+}
+
+// retryable - Statuses worth another attempt
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// decodeResponse - Decodes the Response envelope, or the problem details
+// if the App serves them
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), uviews.MediaTypeProblemJSON) {
+		p := &uviews.ProblemDetails{}
+		if err := json.Unmarshal(b, p); err != nil {
+			return err
+		}
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Errors:     []*uviews.ApiError{{Code: p.Code, Desc: p.Title, Debug: p.Detail}},
+		}
+	}
+
+	env := struct {
+		Origin string             `json:"origin"`
+		Data   json.RawMessage    `json:"data"`
+		Error  []*uviews.ApiError `json:"error"`
+	}{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &env); err != nil {
+			if resp.StatusCode >= http.StatusBadRequest {
+				// Plain text errors, e.g. from http.Error
+				return &Error{
+					StatusCode: resp.StatusCode,
+					Errors:     []*uviews.ApiError{{Desc: strings.TrimSpace(string(b))}},
+				}
+			}
+			return err
+		}
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest || len(env.Error) > 0 {
+		return &Error{StatusCode: resp.StatusCode, Origin: env.Origin, Errors: env.Error}
+	}
+
+	if out == nil || len(env.Data) == 0 || string(env.Data) == "null" {
+		return nil
+	}
+
+	return json.Unmarshal(env.Data, out)
+}
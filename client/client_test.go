@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+	"github.com/usfsci/uviews"
+)
+
+func TestPath(t *testing.T) {
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	p, err := Path("/users/{0}/clients", b.ID)
+	if err != nil || p != "/users/"+b.ID.String()+"/clients" {
+		t.Errorf("unexpected path %s %v\n", p, err)
+		return
+	}
+
+	if _, err := Path("/users/{0}/clients/{1}", b.ID); err == nil {
+		t.Error("expected an error on a missing ancestor")
+		return
+	}
+	if _, err := Path("/users", b.ID); err == nil {
+		t.Error("expected an error on an extra ancestor")
+		return
+	}
+
+	fmt.Printf("TestPath: OK\n")
+}
+
+func TestClientDo(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	keys := map[string]bool{}
+
+	mux := http.NewServeMux()
+	// Every method fails once, to exercise retries
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[r.Method]++
+		if k := r.Header.Get(uviews.IdempotencyKeyHeader); k != "" {
+			keys[k] = true
+		}
+		if attempts[r.Method] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if u, _, ok := r.BasicAuth(); !ok || u != "u" {
+			uviews.ApiResponseWrite(w, r, "add", nil, []*uviews.ApiError{uviews.ApiErrNotAuthenticated()}, http.StatusUnauthorized)
+			return
+		}
+
+		data := map[string]interface{}{"id": "abc", "modification_time": time.Now().Format(time.RFC3339)}
+		uviews.ApiResponseWrite(w, r, "add", data, nil, http.StatusOK)
+	})
+	mux.HandleFunc("/users/missing", func(w http.ResponseWriter, r *http.Request) {
+		uviews.ApiResponseStoreError(w, r, "get", ustore.ErrNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, WithBasicAuth("u", "p"), WithRetries(2, time.Millisecond))
+
+	// Adds are retried with the same idempotency key
+	ref, err := c.Add(context.Background(), "/users", &ustore.User{Username: "u"})
+	if err != nil || ref.ID != "abc" || ref.ModificationTime.IsZero() {
+		t.Errorf("unexpected add %+v %v\n", ref, err)
+		return
+	}
+	if attempts[http.MethodPost] != 2 || len(keys) != 1 {
+		t.Errorf("expected 2 adds with one key, got %d %v\n", attempts[http.MethodPost], keys)
+		return
+	}
+
+	if _, err := c.Patch(context.Background(), "/users", map[string]interface{}{"username": "v"}); err != nil || attempts[http.MethodPatch] != 2 || len(keys) != 2 {
+		t.Errorf("unexpected patch %d %v %v\n", attempts[http.MethodPatch], keys, err)
+		return
+	}
+
+	// Reads too
+	if err := c.Do(context.Background(), http.MethodGet, "/users", nil, nil); err != nil || attempts[http.MethodGet] != 2 {
+		t.Errorf("expected 2 attempts, got %d %v\n", attempts[http.MethodGet], err)
+		return
+	}
+	var apiErr *Error
+	err = c.Get(context.Background(), "/users/missing", &ustore.User{})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || !HasCode(err, uviews.ErrCodeNotFound) {
+		t.Errorf("expected not found, got %v\n", err)
+		return
+	}
+
+	anon := New(srv.URL)
+	if _, err := anon.Add(context.Background(), "/users", &ustore.User{}); !HasCode(err, uviews.ErrCodeUnauthenticated) {
+		t.Errorf("expected unauthenticated, got %v\n", err)
+		return
+	}
+
+	fmt.Printf("TestClientDo: OK\n")
+}
@@ -0,0 +1,96 @@
+// journal-replay re-issues the requests of a uviews journal against a
+// running server and prints the responses that differ, one JSON per line.
+//
+//	journal-replay -journal requests.jsonl -target http://localhost:8080 -user u -password p
+//
+// The journal redacts credentials, -user and -password set the Basic Auth
+// of every replayed request and -secret name=value the redacted body and
+// query values, e.g. -secret password=... Message timestamps are set to the
+// replay time unless -keep-timestamps. Exits with status 1 if any response
+// differs
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/usfsci/uviews"
+)
+
+func main() {
+	journal := flag.String("journal", "", "journal file, JSON lines")
+	target := flag.String("target", "http://localhost:8080", "base URL of the server")
+	user := flag.String("user", "", "Basic Auth username")
+	password := flag.String("password", "", "Basic Auth password")
+	ignore := flag.String("ignore", "timestamp", "comma separated JSON members ignored in the comparison")
+	keepTimestamps := flag.Bool("keep-timestamps", false, "send the Message timestamps as journaled")
+	secrets := secretFlags{}
+	flag.Var(secrets, "secret", "name=value of a redacted value, repeatable")
+	flag.Parse()
+
+	if *journal == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	u, err := url.Parse(*target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Open(*journal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	opts := &uviews.ReplayOptions{
+		Ignore:         strings.Split(*ignore, ","),
+		Secrets:        secrets,
+		KeepTimestamps: *keepTimestamps,
+		Prepare: func(r *http.Request) {
+			r.Host = u.Host
+			if *user != "" {
+				r.SetBasicAuth(*user, *password)
+			}
+		},
+	}
+
+	diffs, err := uviews.Replay(f, httputil.NewSingleHostReverseProxy(u), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, d := range diffs {
+		enc.Encode(d)
+	}
+
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
+
+// secretFlags - Redacted values by name
+type secretFlags map[string]string
+
+func (sf secretFlags) String() string {
+	return ""
+}
+
+func (sf secretFlags) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+	sf[kv[0]] = kv[1]
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package uviews
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	acceptHeaderKey = "Accept"
+
+	MediaTypeJSON    = "application/json"
+	MediaTypeMsgPack = "application/msgpack"
+	MediaTypeCBOR    = "application/cbor"
+)
+
+// Codec - Encodes and decodes API bodies for one media type
+type Codec interface {
+	// MediaType - The media type handled, e.g. "application/json"
+	MediaType() string
+	// Marshal - Encodes v
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal - Decodes data into v
+	Unmarshal(data []byte, v interface{}) error
+	// UnmarshalMessage - Decodes a Message envelope. The envelope data
+	// is returned raw, in the codec format, to be decoded with Unmarshal
+	UnmarshalMessage(data []byte) (timestamp int64, raw []byte, err error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{
+	m: map[string]Codec{
+		MediaTypeJSON:    jsonCodec{},
+		MediaTypeMsgPack: msgpackCodec{},
+		MediaTypeCBOR:    newCBORCodec(),
+	},
+}
+
+// RegisterCodec - Registers a Codec under its media type, replacing
+// any codec previously registered for it.
+// JSON, MessagePack and CBOR are registered by default
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	codecs.m[strings.ToLower(c.MediaType())] = c
+}
+
+// CodecFor - Returns the codec registered for a media type, if any
+func CodecFor(mediaType string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	c, ok := codecs.m[strings.ToLower(mediaType)]
+	return c, ok
+}
+
+// requestCodec - Selects the codec for the request body from its Content-Type.
+// Requests without Content-Type are assumed to be JSON
+func requestCodec(r *http.Request) (Codec, bool) {
+	ct := r.Header.Get(contentTypeKey)
+	if ct == "" {
+		return jsonCodec{}, true
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, false
+	}
+
+	return CodecFor(mt)
+}
+
+// responseCodec - Selects the codec for the response from the Accept header.
+// Requests without Accept get JSON
+func responseCodec(r *http.Request) (Codec, bool) {
+	accept := r.Header.Get(acceptHeaderKey)
+	if accept == "" {
+		return jsonCodec{}, true
+	}
+
+	for _, mt := range parseAccept(accept) {
+		switch {
+		case mt == "*/*" || mt == "application/*":
+			// Wildcards are served with the default JSON codec
+			return jsonCodec{}, true
+		case mt == MediaTypeProblemJSON:
+			// Problem details are JSON, see ApiResponseWrite
+			return jsonCodec{}, true
+		default:
+			if c, ok := CodecFor(mt); ok {
+				return c, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// parseAccept - Returns the acceptable media types sorted by preference.
+// Types with q=0 are dropped
+func parseAccept(accept string) []string {
+	type weighted struct {
+		mt string
+		q  float64
+	}
+
+	list := make([]weighted, 0)
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		list = append(list, weighted{mt: mt, q: q})
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].q > list[j].q })
+
+	types := make([]string, len(list))
+	for i, w := range list {
+		types[i] = w.mt
+	}
+
+	return types
+}
+
+// negotiateCodecs - Writes a 415 or 406 response if the request body or
+// the expected response cannot be handled.
+// Returns false if the request should not be processed any further
+func negotiateCodecs(w http.ResponseWriter, r *http.Request, origin string) bool {
+	if _, ok := requestCodec(r); !ok {
+		e := newApiError(ErrCodeUnsupportedMediaType, r.Header.Get(contentTypeKey))
+		ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	if _, ok := responseCodec(r); !ok {
+		e := newApiError(ErrCodeNotAcceptable, r.Header.Get(acceptHeaderKey))
+		ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusNotAcceptable)
+		return false
+	}
+
+	return true
+}
+
+// jsonCodec - encoding/json
+type jsonCodec struct{}
+
+func (jsonCodec) MediaType() string { return MediaTypeJSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) UnmarshalMessage(data []byte) (int64, []byte, error) {
+	msg := &Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return 0, nil, err
+	}
+
+	return msg.Timestamp, msg.Data, nil
+}
+
+// msgpackCodec - MessagePack. Field names are taken from the json tags
+// so that entities look the same on every encoding
+type msgpackCodec struct{}
+
+func (msgpackCodec) MediaType() string { return MediaTypeMsgPack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+func (c msgpackCodec) UnmarshalMessage(data []byte) (int64, []byte, error) {
+	msg := &struct {
+		Timestamp int64              `json:"timestamp"`
+		Data      msgpack.RawMessage `json:"data,omitempty"`
+	}{}
+	if err := c.Unmarshal(data, msg); err != nil {
+		return 0, nil, err
+	}
+
+	return msg.Timestamp, msg.Data, nil
+}
+
+// cborCodec - CBOR (RFC 8949). The cbor package falls back to the json
+// tags when there is no cbor tag
+type cborCodec struct {
+	em cbor.EncMode
+}
+
+func newCBORCodec() cborCodec {
+	// Times as RFC3339 strings, like the JSON encoding
+	em, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	return cborCodec{em: em}
+}
+
+func (cborCodec) MediaType() string { return MediaTypeCBOR }
+
+func (c cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return c.em.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+func (c cborCodec) UnmarshalMessage(data []byte) (int64, []byte, error) {
+	msg := &struct {
+		Timestamp int64           `json:"timestamp"`
+		Data      cbor.RawMessage `json:"data,omitempty"`
+	}{}
+	if err := c.Unmarshal(data, msg); err != nil {
+		return 0, nil, err
+	}
+
+	return msg.Timestamp, msg.Data, nil
+}
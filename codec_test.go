@@ -0,0 +1,120 @@
+package uviews
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestCodecMessageRoundTrip(t *testing.T) {
+	for _, mt := range []string{MediaTypeJSON, MediaTypeMsgPack, MediaTypeCBOR} {
+		c, ok := CodecFor(mt)
+		if !ok {
+			t.Errorf("no codec registered for %s\n", mt)
+			return
+		}
+
+		c1 := &ustore.Client{
+			Name: "Test Client",
+			Os:   "ios",
+		}
+
+		b, err := c.Marshal(NewMessageSim(c1))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		ts, raw, err := c.UnmarshalMessage(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if ts == 0 {
+			t.Errorf("%s: expected a timestamp, got 0\n", mt)
+			return
+		}
+
+		c2 := &ustore.Client{}
+		if err := c.Unmarshal(raw, c2); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if c2.Name != c1.Name || c2.Os != c1.Os {
+			t.Errorf("%s: expected %+v, got %+v\n", mt, c1, c2)
+			return
+		}
+
+		fmt.Printf("%s: %d bytes\n", mt, len(b))
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	app.Router.HandleFunc("/users", app.ApiBypassAuthentication(ustore.NewUser, ApiAdd)).Methods(http.MethodPost)
+
+	// Unsupported request body
+	req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewBufferString("timestamp=1"))
+	req.Header.Set(contentTypeKey, "application/x-www-form-urlencoded")
+
+	if code := executeReq(req).Result().StatusCode; code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status code %d, got %d\n", http.StatusUnsupportedMediaType, code)
+		return
+	}
+
+	// Unsupported response
+	req, _ = http.NewRequest(http.MethodPost, "/users", bytes.NewBufferString("{}"))
+	req.Header.Set(contentTypeKey, MediaTypeJSON)
+	req.Header.Set(acceptHeaderKey, "text/html, application/xml;q=0.9")
+
+	if code := executeReq(req).Result().StatusCode; code != http.StatusNotAcceptable {
+		t.Errorf("expected status code %d, got %d\n", http.StatusNotAcceptable, code)
+		return
+	}
+
+	// A CBOR client gets a CBOR response. The message is too old so
+	// it never reaches the store
+	c, _ := CodecFor(MediaTypeCBOR)
+	b, _ := c.Marshal(map[string]interface{}{
+		"timestamp": time.Now().Add(-time.Hour).UnixNano(),
+		"data":      &ustore.User{Username: "osm1608@gmail.com"},
+	})
+
+	req, _ = http.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(b))
+	req.Header.Set(contentTypeKey, MediaTypeCBOR)
+	req.Header.Set(acceptHeaderKey, MediaTypeCBOR)
+
+	response := executeReq(req)
+	if code := response.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d\n", http.StatusBadRequest, code)
+		return
+	}
+
+	if ct := response.Header().Get(contentTypeKey); ct != MediaTypeCBOR {
+		t.Errorf("expected %s, got %s\n", MediaTypeCBOR, ct)
+		return
+	}
+
+	var r Response
+	if err := c.Unmarshal(response.Body.Bytes(), &r); err != nil {
+		t.Error(err)
+		return
+	}
+
+	fmt.Printf("%+v\n", r)
+
+	// Clients asking for problem details get JSON
+	req, _ = http.NewRequest(http.MethodPost, "/users", bytes.NewBufferString("{}"))
+	req.Header.Set(contentTypeKey, MediaTypeJSON)
+	req.Header.Set(acceptHeaderKey, MediaTypeProblemJSON)
+
+	if code := executeReq(req).Result().StatusCode; code == http.StatusNotAcceptable {
+		t.Errorf("expected %s to be acceptable\n", MediaTypeProblemJSON)
+		return
+	}
+}
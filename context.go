@@ -0,0 +1,48 @@
+package uviews
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	appContextKey contextKey = iota
+	pathParamsContextKey
+	resourceContextKey
+)
+
+// resourceFromContext - Returns the Resource of the API route serving the
+// request, nil if the route was not mounted with App.Resource
+func resourceFromContext(ctx context.Context) *Resource {
+	res, _ := ctx.Value(resourceContextKey).(*Resource)
+	return res
+}
+
+// PathParams - Path vars of an API route that are not ancestors
+type PathParams map[string]string
+
+// Params - Returns the path params of an API request, an empty map if none
+func Params(r *http.Request) PathParams {
+	if params, ok := r.Context().Value(pathParamsContextKey).(PathParams); ok {
+		return params
+	}
+
+	return PathParams{}
+}
+
+// contextMiddleware - Makes the App available to handlers and
+// package functions through the request context
+func (app *App) contextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), appContextKey, app)))
+	})
+}
+
+// appFromContext - Returns the App serving the request, nil if the request
+// did not go through an App router
+func appFromContext(ctx context.Context) *App {
+	app, _ := ctx.Value(appContextKey).(*App)
+	return app
+}
@@ -0,0 +1,322 @@
+package uviews
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+// ClientIDHeaderKey - Header with the id of the ustore.Client making the
+// request. It must be one of the user clients. Requests without it are
+// only accepted if the App does not require it, see RequireClientID
+const ClientIDHeaderKey = "X-Client-ID"
+
+// A client found in the store is not looked up again for this long. Other
+// instances of the App may accept a revoked client until then
+const deviceLookupTTL = time.Minute
+
+var (
+	// errDeviceRevoked - The request client is not one of the user clients,
+	// revoked clients are deleted
+	errDeviceRevoked = errors.New("device revoked")
+	// errClientIDRequired - The request has no client id
+	errClientIDRequired = errors.New("client id required")
+)
+
+// Device - A client with its activity. The activity is kept in the memory
+// of the App instance serving the request: it restarts with the server and
+// is not shared between instances
+type Device struct {
+	*ustore.Client
+	// Last authenticated request, nil if none since the server started
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	LastIP   string     `json:"last_ip,omitempty"`
+}
+
+// deviceActivity - Last authenticated request of a client
+type deviceActivity struct {
+	seen time.Time
+	ip   string
+	// Last time the client was found in the store
+	checked time.Time
+}
+
+// deviceTracker - Activity of the clients, by user and client id. Kept in
+// memory: activity restarts with the server. Revocations live in the store,
+// revoked clients are deleted
+type deviceTracker struct {
+	mu       sync.RWMutex
+	activity map[string]map[string]*deviceActivity
+	// Requests must carry a client id
+	required bool
+	// lookup - Returns ustore.ErrNotFound if the user has no such client
+	lookup func(ctx context.Context, userID ustore.SIDType, clientID ustore.SIDType) error
+}
+
+func newDeviceTracker() *deviceTracker {
+	return &deviceTracker{
+		activity: map[string]map[string]*deviceActivity{},
+		lookup:   lookupClient,
+	}
+}
+
+// lookupClient - Reads the client of the user from the store
+func lookupClient(ctx context.Context, userID ustore.SIDType, clientID ustore.SIDType) error {
+	c := ustore.NewClient().(*ustore.Client)
+	return c.Get(ctx, &ustore.Filter{}, userID, clientID)
+}
+
+// RequireClientID - Authenticated API requests must carry the client id
+// header, except those adding a client with ApiAdd. Otherwise requests
+// without it are accepted and not tracked, and revoking a client does not
+// stop it from sending them
+func (app *App) RequireClientID() {
+	app.devices.required = true
+}
+
+// seen - Records an authenticated request of the user, once its client is
+// found in the store, at most once every deviceLookupTTL. Returns errDeviceRevoked if it is not one of the user
+// clients, errClientIDRequired if the request has none and one is required
+// unless enrolling, and the store error if the lookup failed
+func (dt *deviceTracker) seen(r *http.Request, userID ustore.SIDType, enrolling bool) error {
+	cid := r.Header.Get(ClientIDHeaderKey)
+	if cid == "" {
+		if dt.required && !enrolling {
+			return errClientIDRequired
+		}
+		return nil
+	}
+
+	clientID, err := ustore.SIDFromString(cid)
+	if err != nil {
+		return errDeviceRevoked
+	}
+	uid := userID.String()
+	now := time.Now().In(time.UTC)
+
+	dt.mu.RLock()
+	checked := time.Time{}
+	if a, ok := dt.activity[uid][clientID.String()]; ok {
+		checked = a.checked
+	}
+	dt.mu.RUnlock()
+
+	cached := now.Sub(checked) < deviceLookupTTL
+	if !cached {
+		if err := dt.lookup(r.Context(), userID, clientID); err != nil {
+			if errors.Is(err, ustore.ErrNotFound) {
+				return errDeviceRevoked
+			}
+			return err
+		}
+		checked = now
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if _, ok := dt.activity[uid][clientID.String()]; cached && !ok {
+		// Revoked since it was read
+		return errDeviceRevoked
+	}
+	if dt.activity[uid] == nil {
+		dt.activity[uid] = map[string]*deviceActivity{}
+	}
+	dt.activity[uid][clientID.String()] = &deviceActivity{seen: now, ip: ip, checked: checked}
+
+	return nil
+}
+
+// device - The client with its activity
+func (dt *deviceTracker) device(userID ustore.SIDType, c *ustore.Client) *Device {
+	dt.mu.RLock()
+	defer dt.mu.RUnlock()
+
+	d := &Device{Client: c}
+	if a, ok := dt.activity[userID.String()][c.ID.String()]; ok {
+		seen := a.seen
+		d.LastSeen = &seen
+		d.LastIP = a.ip
+	}
+
+	return d
+}
+
+// drop - Forgets the activity of a deleted client
+func (dt *deviceTracker) drop(userID ustore.SIDType, clientID ustore.SIDType) {
+	uid := userID.String()
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	delete(dt.activity[uid], clientID.String())
+	if len(dt.activity[uid]) == 0 {
+		delete(dt.activity, uid)
+	}
+}
+
+// ApiDeviceList - Lists the clients of the user with their last activity,
+// as seen by the App instance serving the request since it started, see
+// Device. Mount it on /users/{0}/clients with ustore.NewClient
+func ApiDeviceList(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "devices"
+
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 0)) {
+		return
+	}
+
+	ents := make([]ustore.Entity, 0)
+	if err := ent.List(r.Context(), &ustore.Filter{}, &ents, ancestors...); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	dt := deviceTrackerFromRequest(r)
+	devices := make([]*Device, 0, len(ents))
+	for _, e := range ents {
+		e.Zero()
+		devices = append(devices, dt.device(ancestors[0], e.(*ustore.Client)))
+	}
+
+	ApiResponseWrite(w, r, origin, devices, nil, http.StatusOK)
+}
+
+// ApiDeviceRename - Changes the name of a client, the only field taken from
+// the message. Mount it on /users/{0}/clients/{1}/name with ustore.NewClient
+func ApiDeviceRename(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "device-rename"
+
+	if !apiValidate(w, r, origin,
+		checkAncestors(ent, ancestors, 1),
+		checkMessage(r, ent, origin),
+		checkClientName(ent.(*ustore.Client)),
+	) {
+		return
+	}
+
+	c := ustore.NewClient().(*ustore.Client)
+	if err := c.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	c.Name = ent.(*ustore.Client).Name
+	if err := c.Update(r.Context(), ancestors...); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"id":                c.GetID(),
+		"modification_time": c.GetModificationTime().Format(time.RFC3339),
+	}
+	ApiResponseWrite(w, r, origin, data, nil, http.StatusOK)
+
+	publishEvent(r, EventUpdate, c, ancestors)
+}
+
+// ApiDeviceRevoke - Signs a client out: deletes it, which drops its
+// notification token, closes its WebSocket connections and refuses its
+// requests. Mount it on /users/{0}/clients/{1}/revoke with ustore.NewClient
+func ApiDeviceRevoke(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "device-revoke"
+
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
+		return
+	}
+
+	c := ustore.NewClient().(*ustore.Client)
+	if err := c.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	if err := revokeDevice(r, ancestors[0], c); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	ApiResponseWrite(w, r, origin, nil, nil, http.StatusOK)
+}
+
+// ApiDeviceRevokeOthers - Signs out every client of the user but the one
+// in the path, usually the one making the request.
+// Mount it on /users/{0}/clients/{1}/revoke-others with ustore.NewClient
+func ApiDeviceRevokeOthers(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "device-revoke-others"
+
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
+		return
+	}
+
+	ents := make([]ustore.Entity, 0)
+	if err := ent.List(r.Context(), &ustore.Filter{}, &ents, ancestors[0]); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	n := 0
+	for _, e := range ents {
+		c := e.(*ustore.Client)
+		if c.ID.String() == ancestors[1].String() {
+			continue
+		}
+
+		if err := revokeDevice(r, ancestors[0], c); err != nil {
+			ApiResponseStoreError(w, r, origin, err)
+			return
+		}
+		n++
+	}
+
+	ApiResponseWrite(w, r, origin, map[string]interface{}{"revoked": n}, nil, http.StatusOK)
+}
+
+// revokeDevice - Deletes the client, which refuses its requests from now
+// on, and cuts it off
+func revokeDevice(r *http.Request, userID ustore.SIDType, c *ustore.Client) error {
+	if err := c.Delete(r.Context(), time.Now().In(time.UTC), userID, c.ID); err != nil {
+		return err
+	}
+
+	if app := appFromContext(r.Context()); app != nil {
+		app.devices.drop(userID, c.ID)
+		app.ws.closeClient(userID.String(), c.ID.String())
+	}
+
+	publishEvent(r, EventDelete, c, []ustore.SIDType{userID, c.ID})
+
+	return nil
+}
+
+// deviceTrackerFromRequest - The tracker of the App serving the request,
+// an empty one if there is none
+func deviceTrackerFromRequest(r *http.Request) *deviceTracker {
+	if app := appFromContext(r.Context()); app != nil {
+		return app.devices
+	}
+
+	return newDeviceTracker()
+}
+
+// checkClientName - Clients cannot be renamed to an empty name
+func checkClientName(c *ustore.Client) apiCheck {
+	return func() *ApiError {
+		if c.Name == "" {
+			e := ApiErrBadRequest("empty client name")
+			e.Field = "name"
+			return e
+		}
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+package uviews
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestDeviceTracker(t *testing.T) {
+	dt := newDeviceTracker()
+
+	bases := make([]*ustore.Base, 3)
+	for i := range bases {
+		b, err := ustore.NewBase()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		bases[i] = b
+	}
+	uid := bases[0].ID
+	c1 := &ustore.Client{Base: *bases[1], Name: "phone"}
+	c2 := &ustore.Client{Base: *bases[2], Name: "tablet"}
+
+	newReq := func(c *ustore.Client) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.RemoteAddr = "10.0.0.1:4321"
+		if c != nil {
+			r.Header.Set(ClientIDHeaderKey, c.ID.String())
+		}
+		return r
+	}
+
+	// The clients in the store
+	stored := map[string]bool{c1.ID.String(): true, c2.ID.String(): true}
+	lookups := 0
+	dt.lookup = func(ctx context.Context, userID ustore.SIDType, clientID ustore.SIDType) error {
+		lookups++
+		if userID.String() != uid.String() || !stored[clientID.String()] {
+			return ustore.ErrNotFound
+		}
+		return nil
+	}
+
+	// Requests without client id are accepted, not tracked
+	if dt.seen(newReq(nil), uid, false) != nil || dt.seen(newReq(c1), uid, false) != nil {
+		t.Error("expected the requests to be accepted")
+		return
+	}
+
+	if d := dt.device(uid, c1); d.LastSeen == nil || d.LastIP != "10.0.0.1" {
+		t.Errorf("expected c1 activity, got %+v\n", d)
+		return
+	}
+	if d := dt.device(uid, c2); d.LastSeen != nil {
+		t.Errorf("expected no c2 activity, got %+v\n", d)
+		return
+	}
+
+	// A client just found is not looked up again
+	if dt.seen(newReq(c1), uid, false) != nil || lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d\n", lookups)
+		return
+	}
+
+	// Revoked clients are deleted from the store
+	delete(stored, c1.ID.String())
+	dt.drop(uid, c1.ID)
+	if err := dt.seen(newReq(c1), uid, false); err != errDeviceRevoked {
+		t.Errorf("expected the revoked client to be refused, got %v\n", err)
+		return
+	}
+	if d := dt.device(uid, c1); d.LastSeen != nil {
+		t.Errorf("expected the revoked client activity to be dropped, got %+v\n", d)
+		return
+	}
+	if dt.seen(newReq(c2), uid, false) != nil {
+		t.Error("expected c2 to be accepted")
+		return
+	}
+
+	// Clients of other users, and unknown ones, are refused and not tracked
+	r := newReq(nil)
+	r.Header.Set(ClientIDHeaderKey, "not-an-id")
+	if dt.seen(newReq(c2), bases[1].ID, false) != errDeviceRevoked || dt.seen(r, uid, false) != errDeviceRevoked {
+		t.Error("expected the unknown clients to be refused")
+		return
+	}
+	if len(dt.activity) != 1 {
+		t.Errorf("expected the activity of 1 user, got %d\n", len(dt.activity))
+		return
+	}
+
+	// Once required, only clients being added can do without an id
+	dt.required = true
+	if dt.seen(newReq(nil), uid, false) != errClientIDRequired || dt.seen(newReq(nil), uid, true) != nil {
+		t.Error("expected the client id to be required unless enrolling")
+		return
+	}
+
+	if !(&apiRoute{newEntity: ustore.NewClient, handler: ApiAdd, op: OpAdd}).enrollsClient() ||
+		(&apiRoute{newEntity: ustore.NewClient, handler: ApiAdd}).enrollsClient() ||
+		(&apiRoute{newEntity: ustore.NewClient, handler: ApiGet, op: OpGet}).enrollsClient() ||
+		(&apiRoute{newEntity: ustore.NewUser, handler: ApiAdd, op: OpAdd}).enrollsClient() {
+		t.Error("expected only client adds to enroll")
+		return
+	}
+
+	// Revoking a client closes its WebSocket connections only
+	h := newWSHub()
+	u := &ustore.User{Base: *bases[0]}
+	ws1 := &wsConn{user: u, client: c1, send: make(chan []byte, 1)}
+	ws2 := &wsConn{user: u, client: c2, send: make(chan []byte, 1)}
+	h.register(ws1)
+	h.register(ws2)
+	h.closeClient(uid.String(), c1.ID.String())
+	if _, ok := <-ws1.send; ok {
+		t.Error("expected the c1 connection to be closed")
+		return
+	}
+	if n := h.send(uid.String(), "", []byte("x")); n != 1 {
+		t.Errorf("expected 1 connection left, got %d\n", n)
+		return
+	}
+
+	fmt.Printf("TestDeviceTracker: OK\n")
+}
@@ -1,13 +1,178 @@
 package uviews
 
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	MediaTypeProblemJSON = "application/problem+json"
+
+	// Default prefix of the problem "type" member; the error code is appended
+	defaultProblemTypeBase = "urn:uviews:problem:"
+)
+
+// Stable machine-readable error codes. Clients should match on these,
+// never on the description
+const (
+	ErrCodeBadRequest           = "bad_request"
+	ErrCodeMalformedMessage     = "malformed_message"
+	ErrCodeAncestorsMismatch    = "ancestors_mismatch"
+	ErrCodeZeroModificationTime = "zero_modification_time"
+	ErrCodeEmptyToken           = "empty_token"
+	ErrCodeInvalidToken         = "invalid_token"
+	ErrCodeEmailNotConfirmed    = "email_not_confirmed"
+	ErrCodeBadPath              = "bad_path"
+	ErrCodeBadID                = "bad_id"
+	ErrCodeUnauthenticated      = "unauthenticated"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeDeviceRevoked        = "device_revoked"
+	ErrCodeClientIDRequired     = "client_id_required"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeConstraint           = "constraint_violation"
+	ErrCodeDuplicatedEntry      = "duplicated_entry"
+	ErrCodeTermsNotAccepted     = "terms_not_accepted"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeNotAcceptable        = "not_acceptable"
+	ErrCodeIdempotencyKeyReused = "idempotency_key_reused"
+	ErrCodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	ErrCodeInternal             = "internal_error"
+	ErrCodeUnknown              = "unknown_error"
+)
+
+// errorCatalog - Default description of every error code
+var errorCatalog = map[string]string{
+	ErrCodeBadRequest:           "bad request",
+	ErrCodeMalformedMessage:     "unable to decode request",
+	ErrCodeAncestorsMismatch:    "wrong number of ancestors",
+	ErrCodeZeroModificationTime: "zero modification time",
+	ErrCodeEmptyToken:           "token cannot be empty",
+	ErrCodeInvalidToken:         "invalid token",
+	ErrCodeEmailNotConfirmed:    "user email has not been validated yet",
+	ErrCodeBadPath:              "unable to decode path",
+	ErrCodeBadID:                "id not properly formatted",
+	ErrCodeUnauthenticated:      "unauthenticated",
+	ErrCodeForbidden:            "user has no authority to perform request",
+	ErrCodeDeviceRevoked:        "device has been signed out",
+	ErrCodeClientIDRequired:     "client id header required",
+	ErrCodeNotFound:             "the requested resource was not found",
+	ErrCodeConstraint:           "key missing or unexisting",
+	ErrCodeDuplicatedEntry:      "duplicated entry",
+	ErrCodeTermsNotAccepted:     "terms not accepted",
+	ErrCodeUnsupportedMediaType: "unsupported media type",
+	ErrCodeNotAcceptable:        "not acceptable",
+	ErrCodeIdempotencyKeyReused: "idempotency key used with another request",
+	ErrCodeIdempotencyKeyInUse:  "a request with the idempotency key is being served",
+	ErrCodeInternal:             "internal server error",
+	ErrCodeUnknown:              "unknown error",
+}
+
 type ApiError struct {
-	//Code  int    `json:"code,omitempty"`
+	// Stable error code, one of the ErrCode constants
+	Code  string `json:"code,omitempty"`
 	Desc  string `json:"description,omitempty"`
 	Debug string `json:"debug,omitempty"`
+	// Message field that failed validation, if any
+	Field string `json:"field,omitempty"`
+}
+
+// ApiErrBadRequest - Returns a new generic bad request error.
+// Predefined errors are built per request so that no request can
+// change the error another one is writing
+func ApiErrBadRequest(debug string) *ApiError {
+	return newApiError(ErrCodeBadRequest, debug)
+}
+
+// ApiErrNotAuthenticated - Returns a new unauthenticated error
+func ApiErrNotAuthenticated() *ApiError {
+	return newApiError(ErrCodeUnauthenticated, "no debug information")
+}
+
+// newApiError - Builds an ApiError with the catalog description of code
+func newApiError(code string, debug string) *ApiError {
+	return &ApiError{
+		Code:  code,
+		Desc:  errorCatalog[code],
+		Debug: debug,
+	}
 }
 
-var ApiErrBadRequest = &ApiError{
-	Desc: "bad request",
+// decodeApiError - Builds the ApiError for a message that could not be decoded,
+// pointing to the offending field when the decoder reports it
+func decodeApiError(err error) *ApiError {
+	e := newApiError(ErrCodeMalformedMessage, err.Error())
+
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		e.Field = te.Field
+	}
+
+	return e
+}
+
+// ProblemDetails - RFC 7807 error response
+type ProblemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Extension members
+	Code          string          `json:"code,omitempty"`
+	InvalidParams []*InvalidParam `json:"invalid-params,omitempty"`
+}
+
+// InvalidParam - Field-level validation error
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// newProblemDetails - Builds the problem from the errors of a response.
+// The first error describes the problem, errors bound to a field are
+// listed as invalid params
+func newProblemDetails(r *http.Request, typeBase string, errs []*ApiError, statusCode int) *ProblemDetails {
+	p := &ProblemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(statusCode),
+		Status:   statusCode,
+		Instance: r.URL.Path,
+	}
+
+	if len(errs) > 0 {
+		e := errs[0]
+		if e.Code != "" {
+			p.Type = typeBase + e.Code
+			p.Code = e.Code
+			if title, ok := errorCatalog[e.Code]; ok {
+				p.Title = title
+			}
+		}
+		// Detail explains this occurrence, the title already has the
+		// catalog description
+		switch {
+		case e.Debug != "":
+			p.Detail = e.Debug
+		case e.Desc != p.Title:
+			p.Detail = e.Desc
+		}
+	}
+
+	for _, e := range errs {
+		if e.Field == "" {
+			continue
+		}
+
+		p.InvalidParams = append(p.InvalidParams, &InvalidParam{
+			Name:   e.Field,
+			Code:   e.Code,
+			Reason: e.Desc,
+		})
+	}
+
+	return p
 }
 
 /*var ApiErrZeroModTime = &ApiError{
@@ -0,0 +1,70 @@
+package uviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestProblemDetails(t *testing.T) {
+	papp := NewApp("problem_app", []byte("1234"), "11736", "", "", "")
+	papp.EnableProblemDetails("")
+
+	// Clients take 1 or 2 ancestors, a non numeric var is not an ancestor
+	papp.Router.HandleFunc("/things/{name}", papp.ApiBypassAuthentication(ustore.NewClient, ApiGet)).Methods(http.MethodGet)
+
+	req, _ := http.NewRequest(http.MethodGet, "/things/abc", nil)
+	response := httptest.NewRecorder()
+	papp.Router.ServeHTTP(response, req)
+
+	if code := response.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("expected status code %d, got %d\n", http.StatusBadRequest, code)
+		return
+	}
+
+	if ct := response.Header().Get(contentTypeKey); ct != MediaTypeProblemJSON {
+		t.Errorf("expected %s, got %s\n", MediaTypeProblemJSON, ct)
+		return
+	}
+
+	var p ProblemDetails
+	if err := json.NewDecoder(response.Body).Decode(&p); err != nil {
+		t.Error(err)
+		return
+	}
+
+	fmt.Printf("%+v\n", p)
+
+	if p.Code != ErrCodeAncestorsMismatch || p.Type != defaultProblemTypeBase+ErrCodeAncestorsMismatch {
+		t.Errorf("expected code %s, got %s (%s)\n", ErrCodeAncestorsMismatch, p.Code, p.Type)
+		return
+	}
+
+	if p.Status != http.StatusBadRequest || p.Instance != "/things/abc" {
+		t.Errorf("expected status %d on /things/abc, got %d on %s\n", http.StatusBadRequest, p.Status, p.Instance)
+		return
+	}
+
+	if p.Detail == "" || p.Detail == p.Title {
+		t.Errorf("expected a detail of the occurrence, got %q\n", p.Detail)
+		return
+	}
+}
+
+func TestDecodeApiErrorField(t *testing.T) {
+	err := json.Unmarshal([]byte(`{"name": 12}`), &ustore.Client{})
+	if err == nil {
+		t.Error("expected a type error")
+		return
+	}
+
+	e := decodeApiError(err)
+	if e.Code != ErrCodeMalformedMessage || e.Field != "name" {
+		t.Errorf("expected %s on field name, got %s on field %s\n", ErrCodeMalformedMessage, e.Code, e.Field)
+		return
+	}
+}
@@ -0,0 +1,166 @@
+package uviews
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+// EventType - What happened to an entity
+type EventType string
+
+const (
+	EventAdd    EventType = "add"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+	// A user confirmed its email, published on the user
+	EventEmailConfirmed EventType = "email_confirmed"
+)
+
+const (
+	// Events kept for Last-Event-ID resume
+	defaultEventLogSize = 1024
+	// Events queued per subscriber before it is dropped as too slow
+	eventSubscriberBuffer = 64
+)
+
+// Event - A change on an entity, as produced by the API handlers
+type Event struct {
+	// Position in the event log, starting at 1
+	ID   uint64    `json:"id"`
+	Type EventType `json:"type"`
+	// Lowercase entity type name, e.g. "user"
+	Kind string `json:"kind"`
+	// Ancestors of the entity, i.e. its collection
+	Ancestors        []ustore.SIDType `json:"ancestors"`
+	EntityID         ustore.SIDType   `json:"entity_id"`
+	ModificationTime time.Time        `json:"modification_time"`
+	// Zeroed entity, nil on delete
+	Entity ustore.Entity `json:"entity,omitempty"`
+	// Type of the entity, to match the events of a resource
+	entityType reflect.Type
+}
+
+// eventHub - Fans out events to subscribers and keeps the last ones so
+// that subscribers can resume after a disconnection
+type eventHub struct {
+	mu   sync.Mutex
+	size int
+	// Last events, in order
+	log []*Event
+	// ID of the last event published
+	lastID uint64
+	subs   map[*eventSubscription]bool
+}
+
+// eventSubscription - Events published after the subscription, closed when
+// the subscriber falls behind or unsubscribes
+type eventSubscription struct {
+	C chan *Event
+}
+
+func newEventHub(size int) *eventHub {
+	return &eventHub{
+		size: size,
+		subs: map[*eventSubscription]bool{},
+	}
+}
+
+// publish - Assigns the event its ID, logs it and sends it to the
+// subscribers. Subscribers with a full queue are dropped, never waited for
+func (h *eventHub) publish(e *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	e.ID = h.lastID
+
+	h.log = append(h.log, e)
+	if len(h.log) > h.size {
+		h.log = h.log[len(h.log)-h.size:]
+	}
+
+	for sub := range h.subs {
+		select {
+		case sub.C <- e:
+		default:
+			delete(h.subs, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// subscribe - Subscribes to the events published after lastID. Returns the
+// logged events the subscriber missed, and false if some of them are no
+// longer in the log, in which case the subscriber must reload its state.
+// A lastID of 0 subscribes to new events only
+func (h *eventHub) subscribe(lastID uint64) (*eventSubscription, []*Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &eventSubscription{C: make(chan *Event, eventSubscriberBuffer)}
+	h.subs[sub] = true
+
+	if lastID == 0 || lastID == h.lastID {
+		return sub, nil, true
+	}
+
+	// IDs restart with the process, an ID from the future is as stale as
+	// one that left the log
+	if lastID > h.lastID || len(h.log) == 0 || lastID < h.log[0].ID-1 {
+		return sub, nil, false
+	}
+
+	missed := h.log[lastID-h.log[0].ID+1:]
+	return sub, append([]*Event{}, missed...), true
+}
+
+// unsubscribe - Stops the delivery of events to sub
+func (h *eventHub) unsubscribe(sub *eventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.C)
+	}
+}
+
+// publishEvent - Publishes the change on ent through the App serving the
+// request. ancestors are the request ancestors: the collection ancestors
+// for adds, plus the entity id for updates and deletes.
+// Must be called once the response is written, as it zeroes ent
+func publishEvent(r *http.Request, t EventType, ent ustore.Entity, ancestors []ustore.SIDType) {
+	app := appFromContext(r.Context())
+	if app == nil {
+		return
+	}
+
+	n := ent.AncestorsRootLen()
+	if len(ancestors) < n {
+		return
+	}
+
+	e := &Event{
+		Type:             t,
+		Kind:             strings.ToLower(indirectType(reflect.TypeOf(ent)).Name()),
+		Ancestors:        append([]ustore.SIDType{}, ancestors[:n]...),
+		EntityID:         ent.GetID(),
+		ModificationTime: ent.GetModificationTime(),
+		entityType:       reflect.TypeOf(ent),
+	}
+	// Item ops carry the id in the path, whatever the store set in ent
+	if len(ancestors) > n {
+		e.EntityID = ancestors[n]
+	}
+	if t != EventDelete {
+		ent.Zero()
+		e.Entity = ent
+	}
+
+	app.events.publish(e)
+}
@@ -0,0 +1,125 @@
+package uviews
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestEventHub(t *testing.T) {
+	h := newEventHub(3)
+	for i := 0; i < 5; i++ {
+		h.publish(&Event{Type: EventAdd})
+	}
+
+	// 1 and 2 left the log, 5 is the last one
+	cases := []struct {
+		lastID   uint64
+		missed   int
+		complete bool
+	}{
+		{0, 0, true},
+		{5, 0, true},
+		{4, 1, true},
+		{2, 3, true},
+		{1, 0, false},
+		{9, 0, false},
+	}
+
+	for _, tc := range cases {
+		sub, missed, complete := h.subscribe(tc.lastID)
+		h.unsubscribe(sub)
+		if len(missed) != tc.missed || complete != tc.complete {
+			t.Errorf("last id %d: expected %d missed %v, got %d %v\n", tc.lastID, tc.missed, tc.complete, len(missed), complete)
+			return
+		}
+		if len(missed) > 0 && missed[0].ID != tc.lastID+1 {
+			t.Errorf("last id %d: resumed at %d\n", tc.lastID, missed[0].ID)
+			return
+		}
+	}
+
+	// Slow subscribers are dropped instead of blocking the publisher
+	sub, _, _ := h.subscribe(0)
+	for i := 0; i < eventSubscriberBuffer+1; i++ {
+		h.publish(&Event{Type: EventUpdate})
+	}
+	n := 0
+	for range sub.C {
+		n++
+	}
+	if n != eventSubscriberBuffer {
+		t.Errorf("expected %d events before the drop, got %d\n", eventSubscriberBuffer, n)
+		return
+	}
+
+	fmt.Printf("TestEventHub: OK\n")
+}
+
+func TestEventStream(t *testing.T) {
+	eapp := NewApp("events_app", []byte("1234"), "11740", "", "", "")
+	users := eapp.Resource(ustore.NewUser, nil, &ResourceOptions{Public: []ResourceOp{OpEvents}})
+
+	srv := httptest.NewServer(eapp.Router)
+	defer srv.Close()
+
+	userType := reflect.TypeOf(ustore.NewUser())
+	eapp.events.publish(&Event{Type: EventAdd, entityType: userType})
+
+	// Clients must accept an event stream
+	r := httptest.NewRequest(http.MethodGet, users.EventsPath(), nil)
+	r.Header.Set(acceptHeaderKey, MediaTypeJSON)
+	rec := httptest.NewRecorder()
+	eapp.Router.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("expected status code %d, got %d\n", http.StatusNotAcceptable, rec.Code)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+users.EventsPath(), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	req.Header.Set(lastEventIDHeaderKey, "0")
+	req.Header.Set(acceptHeaderKey, MediaTypeEventStream)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get(contentTypeKey); resp.StatusCode != http.StatusOK || ct != MediaTypeEventStream {
+		t.Errorf("unexpected response %d %s\n", resp.StatusCode, ct)
+		return
+	}
+
+	// The stream subscribed before sending its headers, so it gets what is
+	// published now: a client entity, which the users stream must skip, and
+	// a user update
+	eapp.events.publish(&Event{Type: EventAdd, entityType: reflect.TypeOf(ustore.NewClient())})
+	eapp.events.publish(&Event{Type: EventUpdate, entityType: userType})
+
+	sc := bufio.NewScanner(resp.Body)
+	var got []string
+	for sc.Scan() && len(got) < 2 {
+		if line := sc.Text(); strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "event: ") {
+			got = append(got, line)
+		}
+	}
+
+	if strings.Join(got, "|") != "id: 3|event: update" {
+		t.Errorf("unexpected stream %v\n", got)
+		return
+	}
+
+	fmt.Printf("TestEventStream: OK\n")
+}
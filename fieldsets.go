@@ -0,0 +1,142 @@
+package uviews
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/usfsci/ustore"
+)
+
+// Query params of ApiGet and ApiList
+const (
+	// Comma separated message fields to return, all if absent
+	fieldsQueryKey = "fields"
+	// Comma separated child resources to embed in every entity
+	includeQueryKey = "include"
+)
+
+// representation - How the entities of a response are rendered, as asked
+// with ?fields= and ?include=
+type representation struct {
+	// Selected fields, all if empty
+	fields map[string]bool
+	// Embedded child resources
+	include []*Resource
+}
+
+// parseRepresentation - Reads the representation from the request query.
+// Returns nil if the entities are to be written as they are.
+// Includes must name children of the Resource serving the request
+func parseRepresentation(r *http.Request) (*representation, *ApiError) {
+	q := r.URL.Query()
+	fields := splitQueryList(q.Get(fieldsQueryKey))
+	include := splitQueryList(q.Get(includeQueryKey))
+	if len(fields) == 0 && len(include) == 0 {
+		return nil, nil
+	}
+
+	rep := &representation{}
+
+	if len(fields) > 0 {
+		rep.fields = map[string]bool{}
+		for _, f := range fields {
+			rep.fields[f] = true
+		}
+	}
+
+	res := resourceFromContext(r.Context())
+	for _, name := range include {
+		var child *Resource
+		ok := false
+		if res != nil {
+			child, ok = res.Child(name)
+		}
+		if !ok {
+			e := ApiErrBadRequest(fmt.Sprintf("unknown resource %s", name))
+			e.Field = includeQueryKey
+			return nil, e
+		}
+		rep.include = append(rep.include, child)
+	}
+
+	return rep, nil
+}
+
+// render - Returns ent, already zeroed, projected to the selected fields and
+// with the child collections embedded under the child resource names.
+// ancestors are the ancestors of ent plus its own id.
+// The user must be authorized to list every embedded collection
+func (rep *representation) render(r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) (interface{}, int, *ApiError) {
+	// Round trip through the response codec so the field names and
+	// values are the ones the client would get for the whole entity
+	c, ok := responseCodec(r)
+	if !ok {
+		c = jsonCodec{}
+	}
+
+	b, err := c.Marshal(ent)
+	if err != nil {
+		return nil, http.StatusInternalServerError, newApiError(ErrCodeInternal, err.Error())
+	}
+
+	m := map[string]interface{}{}
+	if err := c.Unmarshal(b, &m); err != nil {
+		return nil, http.StatusInternalServerError, newApiError(ErrCodeInternal, err.Error())
+	}
+
+	if rep.fields != nil {
+		for k := range m {
+			if !rep.fields[k] {
+				delete(m, k)
+			}
+		}
+	}
+
+	for _, child := range rep.include {
+		ents, code, apiErr := listChild(r, child, u, ancestors)
+		if apiErr != nil {
+			return nil, code, apiErr
+		}
+		m[child.name] = ents
+	}
+
+	return m, http.StatusOK, nil
+}
+
+// listChild - Lists the child collection under ancestors, once the user is
+// authorized on it. Routes that bypass authentication cannot embed
+func listChild(r *http.Request, child *Resource, u *ustore.User, ancestors []ustore.SIDType) ([]ustore.Entity, int, *ApiError) {
+	if u == nil {
+		return nil, http.StatusForbidden, newApiError(ErrCodeForbidden, "include requires authentication")
+	}
+
+	ent := child.newEntity()
+	if code, apiErr := isAuthorized(r, ent, u, ancestors...); apiErr != nil {
+		return nil, code, apiErr
+	}
+
+	ents := make([]ustore.Entity, 0)
+	if err := ent.List(r.Context(), &ustore.Filter{}, &ents, ancestors...); err != nil {
+		code, apiErr := ApiErrFromStoreErr(err)
+		return nil, code, apiErr
+	}
+
+	for _, e := range ents {
+		e.Zero()
+	}
+
+	return ents, http.StatusOK, nil
+}
+
+// splitQueryList - Splits a comma separated query value, dropping blanks
+func splitQueryList(v string) []string {
+	var l []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+
+	return l
+}
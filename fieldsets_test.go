@@ -0,0 +1,103 @@
+package uviews
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestRepresentation(t *testing.T) {
+	rapp := NewApp("fieldsets_app", []byte("1234"), "11739", "", "", "")
+
+	users := rapp.Resource(ustore.NewUser, nil, nil)
+	rapp.Resource(ustore.NewClient, users, nil)
+
+	newReq := func(query string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/users/1?"+query, nil)
+		return r.WithContext(context.WithValue(r.Context(), resourceContextKey, users))
+	}
+
+	// No query, entities are written as they are
+	if rep, apiErr := parseRepresentation(newReq("")); rep != nil || apiErr != nil {
+		t.Errorf("expected no representation, got %v, %v\n", rep, apiErr)
+		return
+	}
+
+	// Unknown child resources are rejected
+	_, apiErr := parseRepresentation(newReq("include=clients,tokens"))
+	if apiErr == nil || apiErr.Code != ErrCodeBadRequest || apiErr.Field != includeQueryKey {
+		t.Errorf("expected bad request on include, got %v\n", apiErr)
+		return
+	}
+
+	rep, apiErr := parseRepresentation(newReq("include=clients"))
+	if apiErr != nil || len(rep.include) != 1 || rep.include[0].Name() != "clients" {
+		t.Errorf("unexpected include %v, %v\n", rep, apiErr)
+		return
+	}
+
+	// Project a client down to two of its fields, whatever their names
+	cl := &ustore.Client{
+		Name:              "Test Client",
+		NotificationToken: "abcdefg",
+		Os:                "ios",
+		Sdk:               "10",
+	}
+	b, err := json.Marshal(cl)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	full := map[string]interface{}{}
+	if err := json.Unmarshal(b, &full); err != nil {
+		t.Error(err)
+		return
+	}
+	keys := make([]string, 0, len(full))
+	for k := range full {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) < 3 {
+		t.Errorf("expected a client to have more than 2 fields, got %v\n", keys)
+		return
+	}
+	selected := keys[:2]
+
+	rep, apiErr = parseRepresentation(newReq("fields=" + strings.Join(selected, ",%20") + ",,"))
+	if apiErr != nil {
+		t.Error(apiErr)
+		return
+	}
+
+	data, _, apiErr := rep.render(newReq(""), cl, nil, nil)
+	if apiErr != nil {
+		t.Error(apiErr)
+		return
+	}
+
+	m := data.(map[string]interface{})
+	if len(m) != len(selected) {
+		t.Errorf("expected fields %v, got %v\n", selected, m)
+		return
+	}
+	for _, k := range selected {
+		if _, ok := m[k]; !ok {
+			t.Errorf("missing field %s in %v\n", k, m)
+			return
+		}
+	}
+
+	// Embedding requires an authenticated user
+	rep, _ = parseRepresentation(newReq("include=clients"))
+	if _, code, apiErr := rep.render(newReq(""), &ustore.User{}, nil, nil); apiErr == nil || code != http.StatusForbidden {
+		t.Errorf("expected forbidden include, got %d %v\n", code, apiErr)
+		return
+	}
+}
@@ -0,0 +1,81 @@
+package uviews
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/usfsci/ustore"
+	"golang.org/x/text/message"
+)
+
+// Bag flash key of the messages waiting to be shown
+const sessionFlashesKey = "uviews.flashes"
+
+// Flash levels
+const (
+	FlashSuccess = "success"
+	FlashInfo    = "info"
+	FlashWarning = "warning"
+	FlashError   = "error"
+)
+
+// Flash - A message shown once, on the next rendered form
+type Flash struct {
+	Level string `json:"level"`
+	// Printer format, localized when the flash is shown
+	Format string        `json:"format"`
+	Args   []interface{} `json:"args,omitempty"`
+	// Localized message, set when the flash is shown
+	Text string `json:"-"`
+}
+
+// AddFlash - Keeps a message for the next rendered form, usually before
+// redirecting. format and args are localized with the printer of the
+// request that shows it. Must be called before the response is written
+func AddFlash(w http.ResponseWriter, r *http.Request, session *ustore.Session, level string, format string, args ...interface{}) error {
+	bag := SessionData(w, r, session)
+
+	flashes := make([]*Flash, 0)
+	if _, err := bag.Flash(sessionFlashesKey, &flashes); err != nil {
+		return err
+	}
+	flashes = append(flashes, &Flash{Level: level, Format: format, Args: args})
+
+	if err := bag.SetFlash(sessionFlashesKey, flashes); err != nil {
+		return err
+	}
+
+	return saveSessionData(w, r, bag)
+}
+
+// PopFlashes - The messages waiting to be shown, localized in lang. They
+// are dropped from the session. Must be called before the response is written
+func PopFlashes(w http.ResponseWriter, r *http.Request, session *ustore.Session, lang string) ([]*Flash, error) {
+	bag := SessionData(w, r, session)
+
+	flashes := make([]*Flash, 0)
+	ok, err := bag.Flash(sessionFlashesKey, &flashes)
+	if err != nil || !ok {
+		return flashes, err
+	}
+
+	p := message.NewPrinter(message.MatchLanguage(lang))
+	for _, f := range flashes {
+		for i, a := range f.Args {
+			f.Args[i] = flashArg(a)
+		}
+		f.Text = p.Sprintf(f.Format, f.Args...)
+	}
+
+	return flashes, saveSessionData(w, r, bag)
+}
+
+// flashArg - JSON numbers come back as float64, whole ones are restored as
+// int64 so that they can be printed with %d
+func flashArg(a interface{}) interface{} {
+	if f, ok := a.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+
+	return a
+}
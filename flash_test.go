@@ -0,0 +1,61 @@
+package uviews
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlashes(t *testing.T) {
+	napp := NewApp("flash_app", []byte("1234"), "11743", "", "", "")
+	napp.SetSessionStore(NewMemorySessionStore())
+
+	tpl := filepath.Join(t.TempDir(), "form.html")
+	if err := ioutil.WriteFile(tpl, []byte(`{{range flashes}}{{.Level}}:{{.Text}};{{end}}`), 0600); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var cookie *http.Cookie
+	serve := func(f func(w http.ResponseWriter, r *http.Request, v View)) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+
+		rec := httptest.NewRecorder()
+		napp.BypassAuthentication(func() View { return &testView{} }, f)(rec, r)
+		if c := rec.Result().Cookies(); len(c) > 0 {
+			cookie = c[0]
+		}
+
+		return rec.Body.String()
+	}
+
+	serve(func(w http.ResponseWriter, r *http.Request, v View) {
+		AddFlash(w, r, v.GetSession(), FlashSuccess, "Saved %d items", 3)
+		AddFlash(w, r, v.GetSession(), FlashError, "Invalid password")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	render := func(w http.ResponseWriter, r *http.Request, v View) {
+		RenderForm(w, r, []string{tpl}, v, &DefaultForm{})
+	}
+	if body := serve(render); body != "success:Saved 3 items;error:Invalid password;" {
+		t.Errorf("unexpected flashes %q\n", body)
+		return
+	}
+
+	// Flashes are shown once
+	if body := serve(render); body != "" {
+		t.Errorf("expected no flashes, got %q\n", body)
+		return
+	}
+
+	fmt.Printf("TestFlashes: OK\n")
+}
@@ -82,7 +82,7 @@ func DecodeForm(w http.ResponseWriter, r *http.Request, session *ustore.Session,
 				if efe, ok := v.(schema.EmptyFieldError); ok {
 					// Mark the missing key
 					form.SetMissing(efe.Key)
-					if err := StoreDataInSession(r.Context(), session, &form); err != nil {
+					if err := StoreFormInSession(w, r, session, &form); err != nil {
 						HandleStoreError(w, err)
 						return err
 					}
@@ -99,7 +99,7 @@ func DecodeForm(w http.ResponseWriter, r *http.Request, session *ustore.Session,
 
 	// Validate the form
 	if ok := validator(form); !ok {
-		if err := StoreDataInSession(r.Context(), session, &form); err != nil {
+		if err := StoreFormInSession(w, r, session, &form); err != nil {
 			HandleStoreError(w, err)
 			return err
 		}
@@ -110,9 +110,27 @@ func DecodeForm(w http.ResponseWriter, r *http.Request, session *ustore.Session,
 }
 
 func RenderForm(w http.ResponseWriter, r *http.Request, templateFiles []string, view View, f Form) {
+	renderForm(w, r, filepath.Base(templateFiles[0]), func(t *template.Template) (*template.Template, error) {
+		return t.ParseFiles(templateFiles...)
+	}, view, f)
+}
+
+// renderForm - Executes the template named name, as parsed by parse
+func renderForm(w http.ResponseWriter, r *http.Request, name string, parse func(t *template.Template) (*template.Template, error), view View, f Form) {
 	lang := getLanguage(r)
 
-	t, err := template.New(filepath.Base(templateFiles[0])).Funcs(templateFuncs(lang)).ParseFiles(templateFiles...)
+	// Flashes are shown once, by the "flashes" template func
+	funcs := templateFuncs(lang)
+	if s := view.GetSession(); s != nil {
+		flashes, err := PopFlashes(w, r, s, lang)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		funcs["flashes"] = func() []*Flash { return flashes }
+	}
+
+	t, err := parse(template.New(name).Funcs(funcs))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3,12 +3,15 @@ module github.com/usfsci/uviews
 go 1.15
 
 require (
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/gorilla/csrf v1.7.1
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/schema v1.2.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/usfsci/uauth v0.0.0-20211126101056-1674f72f9cf2
 	github.com/usfsci/ustore v0.0.0-20220324094919-426a8cf4c9a2
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	golang.org/x/crypto v0.0.0-20211209193657-4570a0811e8b // indirect
 	golang.org/x/text v0.3.7
 )
@@ -0,0 +1,184 @@
+package uviews
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+const (
+	// IdempotencyKeyHeader - Makes a POST or PATCH to the API safe to retry,
+	// see App.EnableIdempotency
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// Set on the responses answered again to a retry
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyTTL = 24 * time.Hour
+	idempotencyMaxKeyLen  = 255
+)
+
+// idempotentResponse - The response to the first request with a key
+type idempotentResponse struct {
+	// Hash of the method, path and body of the request
+	fingerprint [sha256.Size]byte
+	// The first request is still being served
+	pending bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotency - Responses by user and key
+type idempotency struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+	// Last time the expired responses were dropped
+	pruned time.Time
+}
+
+// EnableIdempotency - API POST and PATCH requests carrying an
+// Idempotency-Key are served once per user and key: a retry with the same
+// key gets the first response again for ttl, 24 hours if 0. A key reused
+// with another request is rejected with 422, and one still being served
+// with 409. Failed responses (5xx, 429) are not kept, their retries are
+// served. Responses are kept in the process memory, so retries must reach
+// the same instance
+func (app *App) EnableIdempotency(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	app.idempotency = &idempotency{ttl: ttl, responses: map[string]*idempotentResponse{}}
+}
+
+// serve - Serves the request with next unless it is a retry, which gets the
+// kept response
+func (id *idempotency) serve(w http.ResponseWriter, r *http.Request, origin string, userID ustore.SIDType, next http.HandlerFunc) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+		next(w, r)
+		return
+	}
+	if len(key) > idempotencyMaxKeyLen {
+		ApiResponseWrite(w, r, origin, nil, []*ApiError{ApiErrBadRequest("idempotency key too long")}, http.StatusBadRequest)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{decodeApiError(err)}, http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	fp := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+
+	// Anonymous keys share a scope, the fingerprint keeps them apart
+	k := key
+	if len(userID) > 0 {
+		k = userID.String() + " " + key
+	}
+
+	if kept, ok := id.reserve(k, fp); !ok {
+		switch {
+		case kept.fingerprint != fp:
+			e := newApiError(ErrCodeIdempotencyKeyReused, key)
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusUnprocessableEntity)
+		case kept.pending:
+			e := newApiError(ErrCodeIdempotencyKeyInUse, key)
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusConflict)
+		default:
+			for h, v := range kept.header {
+				w.Header()[h] = v
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(kept.status)
+			w.Write(kept.body)
+		}
+		return
+	}
+
+	iw := &idempotencyWriter{ResponseWriter: w, status: http.StatusOK}
+	next(iw, r)
+
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	resp, ok := id.responses[k]
+	if !ok || !resp.pending || resp.fingerprint != fp {
+		// Expired and claimed again while being served
+		return
+	}
+	if iw.status >= http.StatusInternalServerError || iw.status == http.StatusTooManyRequests {
+		delete(id.responses, k)
+		return
+	}
+
+	resp.pending = false
+	resp.status = iw.status
+	resp.header = iw.header
+	if resp.header == nil {
+		resp.header = w.Header().Clone()
+	}
+	resp.body = iw.body.Bytes()
+}
+
+// reserve - Claims the key for the request, returns the kept response and
+// false if the key is taken. Expired responses are dropped on the way, at
+// most once a minute
+func (id *idempotency) reserve(k string, fp [sha256.Size]byte) (idempotentResponse, bool) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(id.pruned) > time.Minute {
+		id.pruned = now
+		for key, resp := range id.responses {
+			if now.After(resp.expires) {
+				delete(id.responses, key)
+			}
+		}
+	}
+
+	if resp, ok := id.responses[k]; ok && now.Before(resp.expires) {
+		return *resp, false
+	}
+	id.responses[k] = &idempotentResponse{fingerprint: fp, pending: true, expires: now.Add(id.ttl)}
+
+	return idempotentResponse{}, true
+}
+
+// idempotencyWriter - Keeps the response to answer the retries
+type idempotencyWriter struct {
+	http.ResponseWriter
+	status int
+	// The header as sent
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (iw *idempotencyWriter) WriteHeader(status int) {
+	if iw.header == nil {
+		iw.status = status
+		iw.header = iw.ResponseWriter.Header().Clone()
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *idempotencyWriter) Write(b []byte) (int, error) {
+	if iw.header == nil {
+		iw.header = iw.ResponseWriter.Header().Clone()
+	}
+	iw.body.Write(b)
+
+	return iw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,60 @@
+package uviews
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestIdempotency(t *testing.T) {
+	iapp := NewApp("idempotency_app", []byte("1234"), "11744", "", "", "")
+	iapp.EnableIdempotency(0)
+
+	served := 0
+	iapp.ApiRoute("/users/{0}/clients", ApiRoute{
+		NewEntity: ustore.NewClient,
+		Method:    http.MethodPost,
+		Public:    true,
+		Handler: func(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+			served++
+			ApiResponseWrite(w, r, "add", map[string]int{"served": served}, nil, http.StatusOK)
+		},
+	})
+
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/users/0123456789abcdef/clients", strings.NewReader(body))
+		req.Header.Set(contentTypeKey, MediaTypeJSON)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		response := httptest.NewRecorder()
+		iapp.Router.ServeHTTP(response, req)
+		return response
+	}
+
+	first := post("k1", `{"name":"a"}`)
+	retry := post("k1", `{"name":"a"}`)
+	if served != 1 || retry.Body.String() != first.Body.String() || retry.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("expected the retry to get the first response, served %d: %s\n", served, retry.Body)
+		return
+	}
+
+	if code := post("k1", `{"name":"b"}`).Result().StatusCode; code != http.StatusUnprocessableEntity || served != 1 {
+		t.Errorf("expected status code %d on a reused key, got %d\n", http.StatusUnprocessableEntity, code)
+		return
+	}
+
+	post("k2", `{"name":"a"}`)
+	post("", `{"name":"a"}`)
+	post("", `{"name":"a"}`)
+	if served != 4 {
+		t.Errorf("expected new keys and keyless requests to be served, served %d\n", served)
+		return
+	}
+
+	fmt.Printf("TestIdempotency: OK\n")
+}
@@ -0,0 +1,512 @@
+package uviews
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Bodies are journaled up to this size
+	journalMaxBody = 64 * 1024
+	redacted       = "[REDACTED]"
+)
+
+// journalSecretHeaders - Headers never journaled as they are
+var journalSecretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Csrf-Token":        true,
+	"Proxy-Authorization": true,
+}
+
+// journalSecretFields - JSON body members redacted at any depth
+var journalSecretFields = map[string]bool{
+	"password":           true,
+	"password_confirm":   true,
+	"token":              true,
+	"secret":             true,
+	"notification_token": true,
+}
+
+// journalSecretParams - Query parameters and form fields redacted, e.g. the
+// emailed token of the account views links
+var journalSecretParams = map[string]bool{
+	"password":           true,
+	"password_confirm":   true,
+	"token":              true,
+	"secret":             true,
+	linkTokenKey:         true,
+	"gorilla.csrf.token": true,
+}
+
+// JournalEntry - A request and its response, as written to the journal
+type JournalEntry struct {
+	Time      time.Time   `json:"time"`
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Header    http.Header `json:"header,omitempty"`
+	Body      string      `json:"body,omitempty"`
+	Status    int         `json:"status"`
+	RespBody  string      `json:"resp_body,omitempty"`
+	RespType  string      `json:"resp_type,omitempty"`
+	LatencyMs float64     `json:"latency_ms"`
+	// Bodies larger than journalMaxBody are cut
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// EnableJournal - Writes every routed request and its response to w as a
+// JSON line. Secret headers, JSON members, form fields and query parameters
+// are redacted, streams and WebSocket upgrades are not journaled
+func (app *App) EnableJournal(w io.Writer) {
+	j := &journal{w: w}
+	app.Router.Use(j.middleware)
+}
+
+type journal struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (j *journal) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || strings.Contains(r.Header.Get(acceptHeaderKey), MediaTypeEventStream) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e := &JournalEntry{
+			Time:   time.Now().In(time.UTC),
+			Method: r.Method,
+			Path:   sanitizeURI(r.URL),
+			Header: sanitizeHeader(r.Header),
+		}
+
+		// The start of the body is read, the handler reads it again
+		// followed by the rest
+		if r.Body != nil {
+			head, err := ioutil.ReadAll(io.LimitReader(r.Body, journalMaxBody+1))
+			if err != nil {
+				r.Body.Close()
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+			e.Body = sanitizeBody(head, r.Header.Get(contentTypeKey), &e.Truncated)
+		}
+
+		jw := &journalWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(jw, r)
+
+		e.LatencyMs = float64(time.Since(e.Time).Microseconds()) / 1000
+		e.Status = jw.status
+		e.RespType = w.Header().Get(contentTypeKey)
+		if jw.cut {
+			e.Truncated = true
+		}
+		e.RespBody = sanitizeBody(jw.body.Bytes(), e.RespType, &jw.cut)
+
+		j.write(e)
+	})
+}
+
+func (j *journal) write(e *JournalEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.w.Write(append(b, '\n'))
+}
+
+// journalWriter - Keeps the status and the start of the body
+type journalWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// The body did not fit
+	cut bool
+}
+
+func (jw *journalWriter) WriteHeader(status int) {
+	jw.status = status
+	jw.ResponseWriter.WriteHeader(status)
+}
+
+func (jw *journalWriter) Write(b []byte) (int, error) {
+	if room := journalMaxBody - jw.body.Len(); room > 0 {
+		if len(b) > room {
+			jw.body.Write(b[:room])
+			jw.cut = true
+		} else {
+			jw.body.Write(b)
+		}
+	} else if len(b) > 0 {
+		jw.cut = true
+	}
+
+	return jw.ResponseWriter.Write(b)
+}
+
+func (jw *journalWriter) Flush() {
+	if f, ok := jw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sanitizeHeader - A copy of h without secrets
+func sanitizeHeader(h http.Header) http.Header {
+	c := http.Header{}
+	for k, v := range h {
+		if journalSecretHeaders[http.CanonicalHeaderKey(k)] {
+			c[k] = []string{redacted}
+			continue
+		}
+		c[k] = v
+	}
+
+	return c
+}
+
+// sanitizeURI - The request URI with the secret query parameters redacted
+func sanitizeURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+
+	c := *u
+	if q, ok := redactValues(u.Query()); ok {
+		c.RawQuery = q.Encode()
+	}
+
+	return c.RequestURI()
+}
+
+// sanitizeBody - The body as text, with the secret members of JSON bodies
+// and the secret fields of forms redacted. Binary bodies, and cut bodies
+// that cannot be parsed, are journaled as their size only
+func sanitizeBody(b []byte, contentType string, truncated *bool) string {
+	if len(b) > journalMaxBody {
+		b = b[:journalMaxBody]
+		*truncated = true
+	}
+	if len(b) == 0 {
+		return ""
+	}
+
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch mt {
+	case "application/x-www-form-urlencoded":
+		q, err := url.ParseQuery(string(b))
+		if err != nil {
+			return fmt.Sprintf("[%d bytes]", len(b))
+		}
+		if q, ok := redactValues(q); ok {
+			return q.Encode()
+		}
+		return string(b)
+	case "multipart/form-data":
+		return fmt.Sprintf("[%d bytes]", len(b))
+	}
+
+	if v, err := decodeJSON(b); err == nil {
+		redact(v)
+		if rb, err := json.Marshal(v); err == nil {
+			return string(rb)
+		}
+	}
+
+	if *truncated || !utf8.Valid(b) {
+		return fmt.Sprintf("[%d bytes]", len(b))
+	}
+
+	return string(b)
+}
+
+// redactValues - A copy of q with the secret values redacted, false if it
+// has none
+func redactValues(q url.Values) (url.Values, bool) {
+	found := false
+	c := url.Values{}
+	for k, v := range q {
+		if journalSecretParams[strings.ToLower(k)] {
+			c[k] = []string{redacted}
+			found = true
+			continue
+		}
+		c[k] = v
+	}
+
+	return c, found
+}
+
+// redact - Replaces the secret members of a decoded JSON value
+func redact(v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, mv := range t {
+			if journalSecretFields[strings.ToLower(k)] {
+				t[k] = redacted
+				continue
+			}
+			redact(mv)
+		}
+	case []interface{}:
+		for _, e := range t {
+			redact(e)
+		}
+	}
+}
+
+// ReplayOptions - How a journal is replayed
+type ReplayOptions struct {
+	// Called on every request before it is served, e.g. to set the
+	// credentials the journal redacted
+	Prepare func(r *http.Request)
+	// Values of the redacted JSON members, form fields and query
+	// parameters, by name, e.g. {"password": "..."}. Redacted values
+	// without one are sent redacted
+	Secrets map[string]string
+	// Send the Message timestamps as journaled. By default they are set
+	// to the replay time, as old messages are refused
+	KeepTimestamps bool
+	// JSON response members ignored in the comparison, at any depth.
+	// Defaults to the Response timestamp
+	Ignore []string
+}
+
+// ReplayDiff - A replayed request whose response differs from the journal
+type ReplayDiff struct {
+	// Journal line, starting at 1
+	Line       int    `json:"line"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	WantStatus int    `json:"want_status"`
+	GotStatus  int    `json:"got_status"`
+	WantBody   string `json:"want_body,omitempty"`
+	GotBody    string `json:"got_body,omitempty"`
+}
+
+// Replay - Serves every journal request with h and returns the responses
+// that differ from the journaled ones. Bodies are compared once sanitized,
+// JSON bodies ignoring member order and the opts.Ignore members
+func Replay(journal io.Reader, h http.Handler, opts *ReplayOptions) ([]*ReplayDiff, error) {
+	if opts == nil {
+		opts = &ReplayOptions{}
+	}
+	ignore := map[string]bool{"timestamp": true}
+	if opts.Ignore != nil {
+		ignore = map[string]bool{}
+		for _, k := range opts.Ignore {
+			ignore[k] = true
+		}
+	}
+
+	diffs := make([]*ReplayDiff, 0)
+
+	sc := bufio.NewScanner(journal)
+	sc.Buffer(make([]byte, 0, 64*1024), 4*journalMaxBody)
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+
+		e := &JournalEntry{}
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil {
+			return diffs, fmt.Errorf("journal line %d: %v", line, err)
+		}
+
+		r := httptest.NewRequest(e.Method, replayURI(e.Path, opts.Secrets), nil)
+		for k, v := range e.Header {
+			if len(v) == 1 && v[0] == redacted {
+				continue
+			}
+			r.Header[k] = v
+		}
+		body := replayBody(e.Body, r.Header.Get(contentTypeKey), opts)
+		r.Body = ioutil.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+		if r.Header.Get("Content-Length") != "" {
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if opts.Prepare != nil {
+			opts.Prepare(r)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		var truncated bool
+		got := sanitizeBody(rec.Body.Bytes(), rec.Header().Get(contentTypeKey), &truncated)
+		if rec.Code == e.Status && (e.Truncated || sameBody(e.RespBody, got, ignore)) {
+			continue
+		}
+
+		diffs = append(diffs, &ReplayDiff{
+			Line:       line,
+			Method:     e.Method,
+			Path:       e.Path,
+			WantStatus: e.Status,
+			GotStatus:  rec.Code,
+			WantBody:   e.RespBody,
+			GotBody:    got,
+		})
+	}
+
+	return diffs, sc.Err()
+}
+
+// replayURI - The journaled URI with the redacted query parameters set
+func replayURI(uri string, secrets map[string]string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.RawQuery == "" {
+		return uri
+	}
+
+	q := u.Query()
+	if !restoreValues(q, secrets) {
+		return uri
+	}
+	u.RawQuery = q.Encode()
+
+	return u.RequestURI()
+}
+
+// replayBody - The journaled body with the redacted values set and, unless
+// kept, the Message timestamp set to now
+func replayBody(body string, contentType string, opts *ReplayOptions) string {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt == "application/x-www-form-urlencoded" {
+		q, err := url.ParseQuery(body)
+		if err != nil || !restoreValues(q, opts.Secrets) {
+			return body
+		}
+		return q.Encode()
+	}
+
+	v, err := decodeJSON([]byte(body))
+	if err != nil {
+		return body
+	}
+	restore(v, opts.Secrets)
+	if m, ok := v.(map[string]interface{}); ok && !opts.KeepTimestamps {
+		if _, ok := m["timestamp"]; ok {
+			m["timestamp"] = time.Now().UnixNano()
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+
+	return string(b)
+}
+
+// restoreValues - Sets the redacted values of q that have a secret,
+// returns false if none was set
+func restoreValues(q url.Values, secrets map[string]string) bool {
+	found := false
+	for k, v := range q {
+		for i := range v {
+			if s, ok := secrets[k]; ok && v[i] == redacted {
+				v[i] = s
+				found = true
+			}
+		}
+	}
+
+	return found
+}
+
+// restore - Sets the redacted members of a decoded JSON value that have
+// a secret
+func restore(v interface{}, secrets map[string]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, mv := range t {
+			if s, ok := secrets[k]; ok && mv == redacted {
+				t[k] = s
+				continue
+			}
+			restore(mv, secrets)
+		}
+	case []interface{}:
+		for _, e := range t {
+			restore(e, secrets)
+		}
+	}
+}
+
+// sameBody - Compares JSON bodies as values without the ignored members,
+// others as text
+func sameBody(want string, got string, ignore map[string]bool) bool {
+	wv, werr := decodeJSON([]byte(want))
+	gv, gerr := decodeJSON([]byte(got))
+	if werr != nil || gerr != nil {
+		return want == got
+	}
+
+	drop(wv, ignore)
+	drop(gv, ignore)
+	wb, _ := json.Marshal(wv)
+	gb, _ := json.Marshal(gv)
+
+	return bytes.Equal(wb, gb)
+}
+
+// drop - Removes the ignored members of a decoded JSON value
+func drop(v interface{}, ignore map[string]bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, mv := range t {
+			if ignore[k] {
+				delete(t, k)
+				continue
+			}
+			drop(mv, ignore)
+		}
+	case []interface{}:
+		for _, e := range t {
+			drop(e, ignore)
+		}
+	}
+}
+
+// decodeJSON - Decodes a single JSON value, numbers kept as written so that
+// nanosecond timestamps survive the round trip
+func decodeJSON(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+
+	return v, nil
+}
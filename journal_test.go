@@ -0,0 +1,201 @@
+package uviews
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestJournalReplay(t *testing.T) {
+	japp := NewApp("journal_app", []byte("1234"), "11744", "", "", "")
+
+	// Echoes the request message in the Response data
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		msg := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			ApiResponseWrite(w, r, "echo", nil, []*ApiError{decodeApiError(err)}, http.StatusBadRequest)
+			return
+		}
+		ApiResponseWrite(w, r, "echo", msg["data"], nil, http.StatusOK)
+	}
+	japp.Router.HandleFunc("/echo", echo).Methods(http.MethodPost)
+
+	var buf bytes.Buffer
+	japp.EnableJournal(&buf)
+
+	body := `{"timestamp":1648115000123456789,"data":{"username":"u","password":"Pass123+Q"}}`
+	r := httptest.NewRequest(http.MethodPost, "/echo?x=1", strings.NewReader(body))
+	r.SetBasicAuth("u", "Pass123+Q")
+	w := httptest.NewRecorder()
+	japp.Router.ServeHTTP(w, r)
+
+	// The handler got the body, the journal only its sanitized copy
+	if !strings.Contains(w.Body.String(), "Pass123+Q") {
+		t.Errorf("expected the handler to read the body, got %s\n", w.Body.String())
+		return
+	}
+	journal := buf.String()
+	if strings.Contains(journal, "Pass123+Q") || strings.Count(journal, redacted) != 3 {
+		t.Errorf("expected the password and the credentials to be redacted, got %s\n", journal)
+		return
+	}
+	if !strings.Contains(journal, "1648115000123456789") || !strings.Contains(journal, `"path":"/echo?x=1"`) {
+		t.Errorf("unexpected journal %s\n", journal)
+		return
+	}
+
+	// Replaying against the same handler gives the same responses
+	diffs, err := Replay(strings.NewReader(journal), japp.Router, nil)
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("expected no diffs, got %v %v\n", diffs, err)
+		return
+	}
+
+	// A changed handler is reported
+	changed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ApiResponseWrite(w, r, "echo", "changed", nil, http.StatusOK)
+	})
+	diffs, err = Replay(strings.NewReader(journal), changed, nil)
+	if err != nil || len(diffs) != 1 || diffs[0].Line != 1 || diffs[0].GotStatus != http.StatusOK {
+		t.Errorf("expected 1 diff, got %v %v\n", diffs, err)
+		return
+	}
+
+	fmt.Printf("TestJournalReplay: OK\n")
+}
+
+// journalUser - A user added in memory
+type journalUser struct {
+	ustore.User
+	added *[]ustore.User
+}
+
+func (u *journalUser) Add(ctx context.Context, lang string, ancestors ...ustore.SIDType) error {
+	id, err := ustore.SIDFromString("0123456789abcdef")
+	if err != nil {
+		return err
+	}
+	u.ID = id
+	u.ModificationTime = time.Date(2022, 3, 24, 0, 0, 0, 0, time.UTC)
+	*u.added = append(*u.added, u.User)
+
+	return nil
+}
+
+func TestJournalReplayApiAdd(t *testing.T) {
+	japp := NewApp("journal_app", []byte("1234"), "11744", "", "", "")
+
+	added := make([]ustore.User, 0)
+	japp.Router.HandleFunc("/users", japp.ApiBypassAuthentication(func() ustore.Entity {
+		return &journalUser{added: &added}
+	}, ApiAdd)).Methods(http.MethodPost)
+
+	var buf bytes.Buffer
+	japp.EnableJournal(&buf)
+
+	b, _ := json.Marshal(NewMessageSim(map[string]interface{}{"username": "u", "password": "UGFzcw=="}))
+	r := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(b))
+	r.Header.Set(contentTypeKey, MediaTypeJSON)
+	w := httptest.NewRecorder()
+	japp.Router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || len(added) != 1 {
+		t.Errorf("expected the user added, got %d %s\n", w.Code, w.Body)
+		return
+	}
+
+	// Replayed an hour later the message is too old, it is sent again with
+	// a new timestamp and the redacted password
+	e := &JournalEntry{}
+	msg := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), e); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := json.Unmarshal([]byte(e.Body), &msg); err != nil {
+		t.Error(err)
+		return
+	}
+	msg["timestamp"] = time.Now().Add(-time.Hour).UnixNano()
+	b, _ = json.Marshal(msg)
+	e.Body = string(b)
+	journal, _ := json.Marshal(e)
+
+	diffs, err := Replay(bytes.NewReader(journal), japp.Router, &ReplayOptions{
+		Secrets: map[string]string{"password": "UGFzcw=="},
+	})
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("expected no diffs, got %v %v\n", diffs, err)
+		return
+	}
+	if len(added) != 2 || string(added[1].Password) != "Pass" {
+		t.Errorf("expected the user added again with its password, got %+v\n", added)
+		return
+	}
+
+	// The journaled timestamp is refused
+	diffs, err = Replay(bytes.NewReader(journal), japp.Router, &ReplayOptions{
+		Secrets:        map[string]string{"password": "UGFzcw=="},
+		KeepTimestamps: true,
+	})
+	if err != nil || len(diffs) != 1 || diffs[0].GotStatus != http.StatusBadRequest {
+		t.Errorf("expected the old message refused, got %v %v\n", diffs, err)
+		return
+	}
+
+	fmt.Printf("TestJournalReplayApiAdd: OK\n")
+}
+
+func TestJournalSanitize(t *testing.T) {
+	japp := NewApp("journal_app", []byte("1234"), "11744", "", "", "")
+
+	var read int
+	japp.Router.HandleFunc("/form", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		read = len(b)
+	})
+
+	var buf bytes.Buffer
+	japp.EnableJournal(&buf)
+
+	form := url.Values{"username": {"u"}, "password": {"Pass123+Q"}, "gorilla.csrf.Token": {"csrf1"}}
+	r := httptest.NewRequest(http.MethodPost, "/form?u=1&t=secret1", strings.NewReader(form.Encode()))
+	r.Header.Set(contentTypeKey, "application/x-www-form-urlencoded")
+	japp.Router.ServeHTTP(httptest.NewRecorder(), r)
+
+	journal := buf.String()
+	for _, secret := range []string{"Pass123+Q", "csrf1", "secret1"} {
+		if strings.Contains(journal, secret) {
+			t.Errorf("expected %s redacted, got %s\n", secret, journal)
+			return
+		}
+	}
+	if !strings.Contains(journal, "username=u") || !strings.Contains(journal, "u=1") {
+		t.Errorf("expected the other fields journaled, got %s\n", journal)
+		return
+	}
+
+	// Large bodies are journaled cut, the handler reads them whole
+	buf.Reset()
+	big := `{"password":"` + strings.Repeat("x", 2*journalMaxBody) + `"}`
+	japp.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(big)))
+
+	e := &JournalEntry{}
+	if err := json.Unmarshal(buf.Bytes(), e); err != nil || !e.Truncated || strings.Contains(e.Body, "xxx") {
+		t.Errorf("expected the body cut and hidden, got %+v %v\n", e, err)
+		return
+	}
+	if read != len(big) {
+		t.Errorf("expected the handler to read %d bytes, got %d\n", len(big), read)
+		return
+	}
+}
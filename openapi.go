@@ -0,0 +1,541 @@
+package uviews
+
+import (
+	"encoding"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+
+	// ReDoc release loaded by the docs page unless the App sets its own
+	defaultOpenAPIDocsScript = "https://cdn.jsdelivr.net/npm/redoc@2.1.5/bundles/redoc.standalone.js"
+)
+
+// openAPIDocsScript - Where the docs page loads ReDoc from
+type openAPIDocsScript struct {
+	src       string
+	integrity string
+}
+
+// OpenAPIDoc - OpenAPI 3 document describing the App API routes
+type OpenAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*JSONSchema       `json:"schemas,omitempty"`
+	SecuritySchemes map[string]*OpenAPISecScheme `json:"securitySchemes,omitempty"`
+}
+
+type OpenAPISecScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId,omitempty"`
+	Summary     string                      `json:"summary,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+type OpenAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required"`
+	Schema      *JSONSchema `json:"schema"`
+}
+
+type OpenAPIBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *JSONSchema `json:"schema"`
+}
+
+// JSONSchema - The subset of JSON Schema used by OpenAPI 3.0
+type JSONSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+}
+
+// ServeOpenAPI - Serves the OpenAPI document of the routes mounted with
+// ApiRoute and Resource on specPath. If docsPath is
+// not empty an HTML documentation page is served there too.
+// The document is generated on each request so it includes routes
+// registered after this call
+func (app *App) ServeOpenAPI(specPath string, docsPath string) {
+	app.Router.HandleFunc(specPath, func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(app.OpenAPI())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(contentTypeKey, MediaTypeJSON)
+		w.Write(b)
+	}).Methods(http.MethodGet)
+
+	if docsPath == "" {
+		return
+	}
+
+	app.Router.HandleFunc(docsPath, func(w http.ResponseWriter, r *http.Request) {
+		script := app.docsScript
+		if script.src == "" {
+			script.src = defaultOpenAPIDocsScript
+		}
+
+		if err := openAPIDocsTemplate.Execute(w, map[string]string{
+			"Title":     app.apiTitle(),
+			"SpecPath":  specPath,
+			"Script":    script.src,
+			"Integrity": script.integrity,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods(http.MethodGet)
+}
+
+// SetOpenAPIDocsScript - The docs page loads ReDoc from src, e.g. a copy
+// served by the App, checked against integrity if not empty
+// (e.g. "sha384-..."). A pinned jsDelivr release is loaded by default
+func (app *App) SetOpenAPIDocsScript(src string, integrity string) {
+	app.docsScript = openAPIDocsScript{src: src, integrity: integrity}
+}
+
+// OpenAPI - Builds the OpenAPI document from the registered API routes
+func (app *App) OpenAPI() *OpenAPIDoc {
+	doc := &OpenAPIDoc{
+		OpenAPI: openAPIVersion,
+		Info: OpenAPIInfo{
+			Title:   app.apiTitle(),
+			Version: apiVersion,
+		},
+		Paths: map[string]map[string]*OpenAPIOperation{},
+		Components: OpenAPIComponents{
+			Schemas: map[string]*JSONSchema{},
+			SecuritySchemes: map[string]*OpenAPISecScheme{
+				"basicAuth": {Type: "http", Scheme: "basic"},
+			},
+		},
+	}
+
+	sg := &schemaGenerator{schemas: doc.Components.Schemas}
+	sg.define(reflect.TypeOf(ApiError{}))
+
+	for _, ar := range app.registeredApiRoutes() {
+		path, params := openAPIPath(ar.path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*OpenAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(ar.method)] = sg.operation(ar, ar.method, path, params)
+	}
+
+	return doc
+}
+
+func (app *App) apiTitle() string {
+	return strings.TrimPrefix(app.name, "_")
+}
+
+var pathVarRegexp = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// openAPIPath - Converts a mux path template into an OpenAPI path,
+// dropping the var patterns, and returns the path params
+func openAPIPath(tpl string) (string, []string) {
+	params := make([]string, 0)
+	for _, m := range pathVarRegexp.FindAllStringSubmatch(tpl, -1) {
+		params = append(params, m[1])
+	}
+
+	return pathVarRegexp.ReplaceAllString(tpl, "{$1}"), params
+}
+
+// apiOps - What the generic operations take and return
+var apiOps = map[ResourceOp]struct {
+	summary string
+	// The request is a Message carrying the entity
+	takesEntity bool
+	// What the response data holds: "entity", "list", "id" or ""
+	returns string
+}{
+	OpAdd:           {"add", true, "id"},
+	OpUpdate:        {"update", true, "id"},
+	OpPatch:         {"patch", true, "id"},
+	OpDelete:        {"delete", false, "entity"},
+	OpGet:           {"get", false, "entity"},
+	OpList:          {"list", false, "list"},
+	OpValidateEmail: {"validate email", true, ""},
+	OpResetPassword: {"reset password", true, ""},
+}
+
+// schemaGenerator - Reflects Go types into JSON Schemas. Named structs are
+// defined once in schemas and referenced
+type schemaGenerator struct {
+	schemas map[string]*JSONSchema
+}
+
+func (sg *schemaGenerator) operation(ar *apiRoute, method string, path string, params []string) *OpenAPIOperation {
+	ent := ar.newEntity()
+	et := reflect.TypeOf(ent)
+	entName := indirectType(et).Name()
+	entSchema := sg.schema(et)
+
+	op := &OpenAPIOperation{
+		OperationID: strings.ToLower(method) + openAPIOperationName(path),
+		Tags:        []string{entName},
+		Responses:   map[string]*OpenAPIResponse{},
+	}
+
+	for _, p := range params {
+		desc := "path parameter " + p
+		if ar.isAncestorVar(p) {
+			desc = "id of the ancestor " + p
+		}
+
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{
+			Name:        p,
+			In:          "path",
+			Description: desc,
+			Required:    true,
+			Schema:      &JSONSchema{Type: "string"},
+		})
+	}
+
+	if ar.authenticate {
+		op.Security = []map[string][]string{{"basicAuth": {}}}
+		op.Responses["401"] = sg.errorResponse("not authenticated")
+		op.Responses["403"] = sg.errorResponse("not authorized")
+	}
+
+	spec, ok := apiOps[ar.op]
+	if !ok {
+		// App handlers: the request is a Message and the response has
+		// unknown data
+		op.Summary = strings.ToLower(method) + " " + entName
+		if method != http.MethodGet && method != http.MethodDelete {
+			op.RequestBody = sg.body(sg.message(entSchema))
+		}
+		op.Responses["200"] = sg.response("ok", sg.envelope(&JSONSchema{}))
+		op.Responses["400"] = sg.errorResponse("bad request")
+
+		return op
+	}
+
+	op.Summary = spec.summary + " " + entName
+	if spec.takesEntity {
+		op.RequestBody = sg.body(sg.message(entSchema))
+	}
+
+	if ar.op == OpGet || ar.op == OpList {
+		op.Parameters = append(op.Parameters, representationParams(ar)...)
+	}
+
+	var data *JSONSchema
+	switch spec.returns {
+	case "entity":
+		data = entSchema
+	case "list":
+		data = &JSONSchema{Type: "array", Items: entSchema}
+	case "id":
+		data = &JSONSchema{
+			Type: "object",
+			Properties: map[string]*JSONSchema{
+				"id":                {Type: "string"},
+				"modification_time": {Type: "string", Format: "date-time"},
+			},
+		}
+	}
+
+	op.Responses["200"] = sg.response("ok", sg.envelope(data))
+	op.Responses["400"] = sg.errorResponse("bad request")
+	if spec.returns != "list" {
+		op.Responses["404"] = sg.errorResponse("not found")
+	}
+
+	return op
+}
+
+// representationParams - The ?fields= and ?include= query params
+func representationParams(ar *apiRoute) []*OpenAPIParameter {
+	params := []*OpenAPIParameter{{
+		Name:        fieldsQueryKey,
+		In:          "query",
+		Description: "comma separated fields to return",
+		Schema:      &JSONSchema{Type: "string"},
+	}}
+
+	if ar.resource == nil || len(ar.resource.children) == 0 {
+		return params
+	}
+
+	names := make([]string, 0, len(ar.resource.children))
+	for name := range ar.resource.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return append(params, &OpenAPIParameter{
+		Name:        includeQueryKey,
+		In:          "query",
+		Description: "comma separated child resources to embed: " + strings.Join(names, ", "),
+		Schema:      &JSONSchema{Type: "string"},
+	})
+}
+
+// message - The Message envelope carrying data
+func (sg *schemaGenerator) message(data *JSONSchema) *JSONSchema {
+	return &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"timestamp": {Type: "integer", Format: "int64", Description: "UTC Unix time in nanoseconds"},
+			"data":      data,
+		},
+		Required: []string{"timestamp", "data"},
+	}
+}
+
+// envelope - The Response envelope carrying data, if any
+func (sg *schemaGenerator) envelope(data *JSONSchema) *JSONSchema {
+	s := &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"timestamp": {Type: "integer", Format: "int64"},
+			"version":   {Type: "string"},
+			"origin":    {Type: "string"},
+			"status":    {Type: "integer"},
+			"error":     {Type: "array", Items: &JSONSchema{Ref: "#/components/schemas/ApiError"}},
+		},
+	}
+	if data != nil {
+		s.Properties["data"] = data
+	}
+
+	return s
+}
+
+func (sg *schemaGenerator) body(s *JSONSchema) *OpenAPIBody {
+	return &OpenAPIBody{Required: true, Content: mediaTypes(s)}
+}
+
+func (sg *schemaGenerator) response(desc string, s *JSONSchema) *OpenAPIResponse {
+	return &OpenAPIResponse{Description: desc, Content: mediaTypes(s)}
+}
+
+func (sg *schemaGenerator) errorResponse(desc string) *OpenAPIResponse {
+	return sg.response(desc, sg.envelope(nil))
+}
+
+// mediaTypes - s under every registered codec media type
+func mediaTypes(s *JSONSchema) map[string]*OpenAPIMediaType {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	m := make(map[string]*OpenAPIMediaType, len(codecs.m))
+	for mt := range codecs.m {
+		m[mt] = &OpenAPIMediaType{Schema: s}
+	}
+
+	return m
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	sidType           = reflect.TypeOf(ustore.SIDType{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schema - The schema of t. Named structs are referenced
+func (sg *schemaGenerator) schema(t reflect.Type) *JSONSchema {
+	t = indirectType(t)
+
+	switch {
+	case t == timeType:
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case t == rawMessageType:
+		return &JSONSchema{}
+	case t == sidType:
+		return &JSONSchema{Type: "string", Description: "id"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType),
+		t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		// Custom encodings are assumed to be strings
+		return &JSONSchema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &JSONSchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &JSONSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &JSONSchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &JSONSchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json writes []byte as base64
+			return &JSONSchema{Type: "string", Format: "byte"}
+		}
+		return &JSONSchema{Type: "array", Items: sg.schema(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: sg.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sg.structSchema(t)
+		}
+		return &JSONSchema{Ref: "#/components/schemas/" + sg.define(t)}
+	}
+
+	// Interfaces and anything else can hold any value
+	return &JSONSchema{}
+}
+
+// define - Adds the schema of the named struct t to the components
+func (sg *schemaGenerator) define(t reflect.Type) string {
+	name := t.Name()
+	if _, ok := sg.schemas[name]; !ok {
+		// Placeholder for recursive types
+		sg.schemas[name] = &JSONSchema{}
+		*sg.schemas[name] = *sg.structSchema(t)
+	}
+
+	return name
+}
+
+// structSchema - Object schema following the encoding/json field rules
+func (sg *schemaGenerator) structSchema(t reflect.Type) *JSONSchema {
+	s := &JSONSchema{
+		Type:       "object",
+		Properties: map[string]*JSONSchema{},
+	}
+	sg.addFields(s, t)
+
+	sort.Strings(s.Required)
+
+	return s
+}
+
+func (sg *schemaGenerator) addFields(s *JSONSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i:]
+		}
+
+		// Untagged embedded structs are flattened
+		if f.Anonymous && name == "" && indirectType(f.Type).Kind() == reflect.Struct {
+			sg.addFields(s, indirectType(f.Type))
+			continue
+		}
+
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fs := sg.schema(f.Type)
+		if f.Type.Kind() == reflect.Ptr && fs.Ref == "" {
+			fs.Nullable = true
+		}
+		s.Properties[name] = fs
+
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t
+}
+
+// openAPIOperationName - "/users/{0}/clients/{1}" -> "UsersClientsItem"
+func openAPIOperationName(path string) string {
+	name := ""
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || strings.HasPrefix(p, "{") {
+			continue
+		}
+		name += strings.ToUpper(p[:1]) + p[1:]
+	}
+
+	if strings.HasSuffix(path, "}") {
+		name += "Item"
+	}
+
+	return name
+}
+
+// openAPIDocsTemplate - API docs page, rendered in the browser by ReDoc
+var openAPIDocsTemplate = template.Must(template.New("openapi-docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>{{.Title}} API</title>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<style>body { margin: 0; padding: 0; }</style>
+</head>
+<body>
+	<redoc spec-url="{{.SpecPath}}"></redoc>
+	<script src="{{.Script}}"{{if .Integrity}} integrity="{{.Integrity}}" crossorigin="anonymous"{{end}}></script>
+</body>
+</html>
+`))
@@ -0,0 +1,103 @@
+package uviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestOpenAPI(t *testing.T) {
+	oapp := NewApp("openapi_app", []byte("1234"), "11737", "", "", "")
+
+	oapp.ApiRoute("/users", ApiRoute{NewEntity: ustore.NewUser, Op: OpAdd, Public: true})
+	oapp.ApiRoute("/users/{0}", ApiRoute{NewEntity: ustore.NewUser, Op: OpGet})
+	oapp.ApiRoute("/users/{0}/clients", ApiRoute{NewEntity: ustore.NewClient, Op: OpList})
+	oapp.ApiRoute("/users/{0}/clients/{1:[0-9a-f]+}", ApiRoute{NewEntity: ustore.NewClient, Op: OpUpdate})
+	// Served but not documented
+	oapp.Router.HandleFunc("/users/{0}/tokens", oapp.ApiBypassAuthentication(ustore.NewRawToken, ApiList)).Methods(http.MethodGet)
+
+	// Not an API route, it must not be called nor documented
+	oapp.Router.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("view handler called by the OpenAPI generator")
+	})
+
+	oapp.ServeOpenAPI("/openapi.json", "/docs")
+
+	req, _ := http.NewRequest(http.MethodGet, "/openapi.json", nil)
+	response := httptest.NewRecorder()
+	oapp.Router.ServeHTTP(response, req)
+
+	if code := response.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d\n", http.StatusOK, code)
+		return
+	}
+
+	fmt.Printf("%s\n", response.Body.String())
+
+	var doc OpenAPIDoc
+	if err := json.NewDecoder(response.Body).Decode(&doc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := map[string]string{
+		"/users":                 "post",
+		"/users/{0}":             "get",
+		"/users/{0}/clients":     "get",
+		"/users/{0}/clients/{1}": "put",
+	}
+	for p, m := range expected {
+		if doc.Paths[p][m] == nil {
+			t.Errorf("expected %s %s to be documented\n", m, p)
+			return
+		}
+	}
+
+	if len(doc.Paths) != len(expected) {
+		t.Errorf("expected %d paths, got %d\n", len(expected), len(doc.Paths))
+		return
+	}
+
+	// Registration is public, reading a user is not
+	if doc.Paths["/users"]["post"].Security != nil {
+		t.Error("expected no security on user add")
+		return
+	}
+	if doc.Paths["/users/{0}"]["get"].Security == nil {
+		t.Error("expected basic auth on user get")
+		return
+	}
+
+	if len(doc.Paths["/users/{0}/clients/{1}"]["put"].Parameters) != 2 {
+		t.Error("expected 2 ancestor parameters on client update")
+		return
+	}
+
+	for _, name := range []string{"User", "Client", "ApiError"} {
+		if doc.Components.Schemas[name] == nil {
+			t.Errorf("expected a %s schema\n", name)
+			return
+		}
+	}
+
+	if doc.Components.Schemas["User"].Properties["username"] == nil {
+		t.Error("expected username in the User schema")
+		return
+	}
+
+	// The docs page checks the script the App sets
+	oapp.SetOpenAPIDocsScript("/static/redoc.js", "sha384-abc")
+	req, _ = http.NewRequest(http.MethodGet, "/docs", nil)
+	response = httptest.NewRecorder()
+	oapp.Router.ServeHTTP(response, req)
+
+	if body := response.Body.String(); !strings.Contains(body, `src="/static/redoc.js" integrity="sha384-abc" crossorigin="anonymous"`) {
+		t.Errorf("expected the script with its integrity, got %s\n", body)
+		return
+	}
+}
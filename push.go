@@ -0,0 +1,451 @@
+package uviews
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+// Client Os values with a default provider
+const (
+	OsIOS     = "ios"
+	OsAndroid = "android"
+)
+
+const (
+	defaultAPNsEndpoint = "https://api.push.apple.com"
+	defaultFCMEndpoint  = "https://fcm.googleapis.com"
+	// APNs rejects provider tokens older than an hour
+	apnsTokenLifetime = 50 * time.Minute
+	pushTimeout       = 10 * time.Second
+)
+
+// ErrInvalidToken - Returned by notifiers when the provider reports that the
+// token will never be valid again, e.g. the app was uninstalled
+var ErrInvalidToken = errors.New("invalid notification token")
+
+// Notification - A push notification, provider independent
+type Notification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// Badge count, left unchanged if nil
+	Badge *int   `json:"badge,omitempty"`
+	Sound string `json:"sound,omitempty"`
+	// Custom data delivered to the app
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// Notifier - Sends notifications to the devices of a provider
+type Notifier interface {
+	// Notify - Sends n to the device token. Returns an error wrapping
+	// ErrInvalidToken if the token must be discarded
+	Notify(ctx context.Context, token string, n *Notification) error
+}
+
+// SetNotifier - Sends the notifications of the clients with Os os through n.
+// os is compared case insensitively with ustore.Client.Os
+func (app *App) SetNotifier(os string, n Notifier) {
+	app.notifiersMu.Lock()
+	defer app.notifiersMu.Unlock()
+
+	app.notifiers[strings.ToLower(os)] = n
+}
+
+func (app *App) notifier(os string) (Notifier, bool) {
+	app.notifiersMu.RLock()
+	defer app.notifiersMu.RUnlock()
+
+	n, ok := app.notifiers[strings.ToLower(os)]
+	return n, ok
+}
+
+// NotifyReport - Outcome of a fan-out
+type NotifyReport struct {
+	// Clients notified
+	Sent int
+	// Clients without a token or a notifier for their Os
+	Skipped int
+	// Clients whose token was cleared because it is invalid. The clients
+	// are kept and get a token again on their next update
+	Cleared []ustore.SIDType
+	// Other failures, the clients are kept
+	Errors []error
+}
+
+// NotifyUser - Sends n to every client of the user. Tokens reported
+// invalid are cleared
+func (app *App) NotifyUser(ctx context.Context, userID ustore.SIDType, n *Notification) (*NotifyReport, error) {
+	ents := make([]ustore.Entity, 0)
+	if err := ustore.NewClient().List(ctx, &ustore.Filter{}, &ents, userID); err != nil {
+		return nil, err
+	}
+
+	clients := make([]*ustore.Client, 0, len(ents))
+	for _, e := range ents {
+		clients = append(clients, e.(*ustore.Client))
+	}
+
+	return app.notifyClients(ctx, clients, n, clearNotificationToken(ctx, userID)), nil
+}
+
+// NotifyClient - Sends n to a client of the user. Its token is cleared if
+// reported invalid
+func (app *App) NotifyClient(ctx context.Context, userID ustore.SIDType, clientID ustore.SIDType, n *Notification) (*NotifyReport, error) {
+	c := ustore.NewClient().(*ustore.Client)
+	if err := c.Get(ctx, &ustore.Filter{}, userID, clientID); err != nil {
+		return nil, err
+	}
+
+	return app.notifyClients(ctx, []*ustore.Client{c}, n, clearNotificationToken(ctx, userID)), nil
+}
+
+// clearNotificationToken - Drops the token of a client of the user. The
+// client itself is kept: deleting it would revoke the device
+func clearNotificationToken(ctx context.Context, userID ustore.SIDType) func(*ustore.Client) error {
+	return func(c *ustore.Client) error {
+		c.NotificationToken = ""
+		return c.Update(ctx, userID, c.ID)
+	}
+}
+
+// notifyClients - Sends n to the clients concurrently and clears the
+// invalid tokens
+func (app *App) notifyClients(ctx context.Context, clients []*ustore.Client, n *Notification, clearToken func(*ustore.Client) error) *NotifyReport {
+	rep := &NotifyReport{}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		ntf, ok := app.notifier(c.Os)
+		if c.NotificationToken == "" || !ok {
+			rep.Skipped++
+			continue
+		}
+
+		wg.Add(1)
+		go func(c *ustore.Client) {
+			defer wg.Done()
+
+			err := ntf.Notify(ctx, c.NotificationToken, n)
+			if errors.Is(err, ErrInvalidToken) {
+				err = clearToken(c)
+				if err == nil {
+					mu.Lock()
+					rep.Cleared = append(rep.Cleared, c.ID)
+					mu.Unlock()
+					return
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				rep.Errors = append(rep.Errors, err)
+				return
+			}
+			rep.Sent++
+		}(c)
+	}
+	wg.Wait()
+
+	return rep
+}
+
+// APNsNotifier - Apple Push Notification service provider API
+type APNsNotifier struct {
+	// Defaults to the production server
+	Endpoint string
+	// Bundle ID of the app
+	Topic string
+	// Provider authentication token, see APNsTokenSource
+	Token func(ctx context.Context) (string, error)
+	// Defaults to a client with a timeout. APNs requires HTTP/2, which the
+	// default transport negotiates over TLS
+	Client *http.Client
+}
+
+type apnsAlert struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type apnsAps struct {
+	Alert *apnsAlert `json:"alert,omitempty"`
+	Badge *int       `json:"badge,omitempty"`
+	Sound string     `json:"sound,omitempty"`
+}
+
+// apnsPayload - The aps dictionary plus the custom data at the top level
+func apnsPayload(n *Notification) ([]byte, error) {
+	p := map[string]interface{}{}
+	for k, v := range n.Data {
+		p[k] = v
+	}
+
+	aps := &apnsAps{Badge: n.Badge, Sound: n.Sound}
+	if n.Title != "" || n.Body != "" {
+		aps.Alert = &apnsAlert{Title: n.Title, Body: n.Body}
+	}
+	p["aps"] = aps
+
+	return json.Marshal(p)
+}
+
+func (a *APNsNotifier) Notify(ctx context.Context, token string, n *Notification) error {
+	body, err := apnsPayload(n)
+	if err != nil {
+		return err
+	}
+
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = defaultAPNsEndpoint
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentTypeKey, MediaTypeJSON)
+	req.Header.Set("apns-topic", a.Topic)
+	if n.Title == "" && n.Body == "" && n.Sound == "" && n.Badge == nil {
+		req.Header.Set("apns-push-type", "background")
+		req.Header.Set("apns-priority", "5")
+	} else {
+		req.Header.Set("apns-push-type", "alert")
+	}
+
+	if a.Token != nil {
+		tok, err := a.Token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "bearer "+tok)
+	}
+
+	resp, err := pushClient(a.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	apnsErr := struct {
+		Reason string `json:"reason"`
+	}{}
+	b, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(b, &apnsErr)
+
+	switch {
+	case resp.StatusCode == http.StatusGone,
+		apnsErr.Reason == "BadDeviceToken",
+		apnsErr.Reason == "Unregistered",
+		apnsErr.Reason == "DeviceTokenNotForTopic":
+		return fmt.Errorf("apns %d %s: %w", resp.StatusCode, apnsErr.Reason, ErrInvalidToken)
+	}
+
+	return fmt.Errorf("apns %d %s", resp.StatusCode, apnsErr.Reason)
+}
+
+// APNsTokenSource - Returns a Token func signing APNs provider tokens with
+// the .p8 key of keyID, renewed before APNs rejects them
+func APNsTokenSource(keyID string, teamID string, key *ecdsa.PrivateKey) func(ctx context.Context) (string, error) {
+	var mu sync.Mutex
+	var tok string
+	var issued time.Time
+
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if tok != "" && time.Since(issued) < apnsTokenLifetime {
+			return tok, nil
+		}
+
+		now := time.Now()
+		t, err := signES256JWT(
+			map[string]interface{}{"alg": "ES256", "kid": keyID},
+			map[string]interface{}{"iss": teamID, "iat": now.Unix()},
+			key,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		tok, issued = t, now
+		return tok, nil
+	}
+}
+
+// signES256JWT - Compact JWS of claims with the P-256 key
+func signES256JWT(header map[string]interface{}, claims map[string]interface{}, key *ecdsa.PrivateKey) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+
+	digest := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS signatures are r and s as fixed size big-endian integers
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+// FCMNotifier - Firebase Cloud Messaging HTTP v1 API
+type FCMNotifier struct {
+	// Defaults to the Google server
+	Endpoint  string
+	ProjectID string
+	// OAuth 2 access token of a service account with messaging rights
+	Token func(ctx context.Context) (string, error)
+	// Defaults to a client with a timeout
+	Client *http.Client
+}
+
+type fcmNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token"`
+	Notification *fcmNotification  `json:"notification,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+}
+
+func (f *FCMNotifier) Notify(ctx context.Context, token string, n *Notification) error {
+	msg := &fcmMessage{Token: token, Data: n.Data}
+	if n.Title != "" || n.Body != "" {
+		msg.Notification = &fcmNotification{Title: n.Title, Body: n.Body}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"message": msg})
+	if err != nil {
+		return err
+	}
+
+	endpoint := f.Endpoint
+	if endpoint == "" {
+		endpoint = defaultFCMEndpoint
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/v1/projects/"+f.ProjectID+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentTypeKey, MediaTypeJSON)
+
+	if f.Token != nil {
+		tok, err := f.Token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+
+	resp, err := pushClient(f.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	fcmErr := struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}{}
+	b, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(b, &fcmErr)
+
+	for _, d := range fcmErr.Error.Details {
+		// INVALID_ARGUMENT may also be a bad message, the token is kept
+		if d.ErrorCode == "UNREGISTERED" {
+			return fmt.Errorf("fcm %d %s: %w", resp.StatusCode, d.ErrorCode, ErrInvalidToken)
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("fcm %d %s: %w", resp.StatusCode, fcmErr.Error.Status, ErrInvalidToken)
+	}
+
+	return fmt.Errorf("fcm %d %s: %s", resp.StatusCode, fcmErr.Error.Status, fcmErr.Error.Message)
+}
+
+func pushClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+
+	return &http.Client{Timeout: pushTimeout}
+}
+
+// FakePush - A notification sent through a FakeNotifier
+type FakePush struct {
+	Token        string
+	Notification *Notification
+}
+
+// FakeNotifier - Records notifications instead of sending them, for tests.
+// Tokens in Invalid are reported invalid
+type FakeNotifier struct {
+	mu      sync.Mutex
+	Sent    []*FakePush
+	Invalid map[string]bool
+}
+
+func (f *FakeNotifier) Notify(ctx context.Context, token string, n *Notification) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Invalid[token] {
+		return fmt.Errorf("fake %s: %w", token, ErrInvalidToken)
+	}
+
+	f.Sent = append(f.Sent, &FakePush{Token: token, Notification: n})
+	return nil
+}
+
+// Pushes - The notifications sent so far
+func (f *FakeNotifier) Pushes() []*FakePush {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*FakePush{}, f.Sent...)
+}
@@ -0,0 +1,151 @@
+package uviews
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestAPNsNotifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/3/device/gone" {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+			return
+		}
+
+		if r.URL.Path != "/3/device/tok1" || r.Header.Get("apns-topic") != "com.example.app" ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "bearer ") || r.Header.Get("apns-push-type") != "alert" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadTopic"}`))
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &got)
+	}))
+	defer srv.Close()
+
+	a := &APNsNotifier{
+		Endpoint: srv.URL,
+		Topic:    "com.example.app",
+		Token:    APNsTokenSource("KEYID", "TEAMID", key),
+	}
+
+	badge := 3
+	n := &Notification{Title: "Hi", Body: "There", Badge: &badge, Data: map[string]string{"k": "v"}}
+	if err := a.Notify(context.Background(), "tok1", n); err != nil {
+		t.Error(err)
+		return
+	}
+
+	aps, _ := got["aps"].(map[string]interface{})
+	alert, _ := aps["alert"].(map[string]interface{})
+	if alert["title"] != "Hi" || aps["badge"] != float64(3) || got["k"] != "v" {
+		t.Errorf("unexpected payload %v\n", got)
+		return
+	}
+
+	if err := a.Notify(context.Background(), "gone", n); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected an invalid token, got %v\n", err)
+		return
+	}
+
+	fmt.Printf("TestAPNsNotifier: OK\n")
+}
+
+func TestFCMNotifier(t *testing.T) {
+	var got map[string]map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/proj/messages:send" || r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &got)
+		if got["message"]["token"] == "gone" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	f := &FCMNotifier{
+		Endpoint:  srv.URL,
+		ProjectID: "proj",
+		Token:     func(ctx context.Context) (string, error) { return "access", nil },
+	}
+
+	if err := f.Notify(context.Background(), "tok1", &Notification{Title: "Hi"}); err != nil {
+		t.Error(err)
+		return
+	}
+	if ntf, _ := got["message"]["notification"].(map[string]interface{}); ntf["title"] != "Hi" {
+		t.Errorf("unexpected message %v\n", got)
+		return
+	}
+
+	if err := f.Notify(context.Background(), "gone", &Notification{Title: "Hi"}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected an invalid token, got %v\n", err)
+		return
+	}
+
+	fmt.Printf("TestFCMNotifier: OK\n")
+}
+
+func TestNotifyClients(t *testing.T) {
+	napp := NewApp("push_app", []byte("1234"), "11743", "", "", "")
+	fake := &FakeNotifier{Invalid: map[string]bool{"stale": true}}
+	napp.SetNotifier(OsIOS, fake)
+
+	newClient := func(os string, token string) *ustore.Client {
+		b, _ := ustore.NewBase()
+		return &ustore.Client{Base: *b, Os: os, NotificationToken: token}
+	}
+	clients := []*ustore.Client{
+		newClient("iOS", "fresh"),
+		newClient(OsIOS, "stale"),
+		newClient(OsIOS, ""),
+		newClient(OsAndroid, "no-notifier"),
+	}
+
+	cleared := make([]string, 0)
+	rep := napp.notifyClients(context.Background(), clients, &Notification{Body: "b"}, func(c *ustore.Client) error {
+		cleared = append(cleared, c.NotificationToken)
+		return nil
+	})
+
+	if rep.Sent != 1 || rep.Skipped != 2 || len(rep.Cleared) != 1 || len(rep.Errors) != 0 {
+		t.Errorf("unexpected report %+v\n", rep)
+		return
+	}
+	if len(cleared) != 1 || cleared[0] != "stale" || rep.Cleared[0].String() != clients[1].ID.String() {
+		t.Errorf("expected the stale token to be cleared, got %v\n", cleared)
+		return
+	}
+	if p := fake.Pushes(); len(p) != 1 || p[0].Token != "fresh" {
+		t.Errorf("unexpected pushes %v\n", p)
+		return
+	}
+
+	fmt.Printf("TestNotifyClients: OK\n")
+}
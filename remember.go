@@ -0,0 +1,412 @@
+package uviews
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+const (
+	defaultRememberMaxAge = 30 * 24 * time.Hour
+	// A replaced validator is still accepted for this long, so that the
+	// parallel requests of a browser that just reopened do not look like
+	// a stolen token
+	rememberGrace = time.Minute
+)
+
+var (
+	// ErrRememberTokenExists - A token with the same selector exists
+	ErrRememberTokenExists = errors.New("remember token exists")
+	// ErrRememberTokenRotated - The token was rotated by another request
+	ErrRememberTokenRotated = errors.New("remember token rotated")
+)
+
+// RememberToken - A persistent login, stored server side. The cookie holds
+// the selector and the validator, only a hash of the validator is kept
+type RememberToken struct {
+	Selector      string
+	ValidatorHash []byte
+	UserID        ustore.SIDType
+	// The session signed in with the token, revoking it drops the token
+	SessionID ustore.SIDType
+	Expires   time.Time
+	// Hash replaced on the last use and when
+	PrevHash  []byte
+	RotatedAt time.Time
+}
+
+// RememberStore - Where the persistent logins live
+type RememberStore interface {
+	Add(ctx context.Context, t *RememberToken) error
+	// Get - The token of selector, nil if there is none
+	Get(ctx context.Context, selector string) (*RememberToken, error)
+	// Update - Replaces the token only if its stored ValidatorHash is still
+	// t.PrevHash, returns ErrRememberTokenRotated otherwise. The check and
+	// the write must be atomic, so that only one request rotates a validator
+	Update(ctx context.Context, t *RememberToken) error
+	// MoveSession - Links the token of selector to the session to, only if
+	// it is linked to from. Used when a session gets a new ID
+	MoveSession(ctx context.Context, selector string, from ustore.SIDType, to ustore.SIDType) error
+	Delete(ctx context.Context, selector string) error
+	// DeleteSession - Deletes the tokens linked to the session
+	DeleteSession(ctx context.Context, sessionID ustore.SIDType) error
+	// DeleteUser - Deletes every token of the user
+	DeleteUser(ctx context.Context, userID ustore.SIDType) error
+}
+
+// rememberMe - Persistent logins of an App
+type rememberMe struct {
+	store  RememberStore
+	maxAge time.Duration
+}
+
+// EnableRememberMe - Keeps the users signed in for maxAge, 30 days if 0,
+// after the browser closes if they asked to with Remember. Tokens are kept
+// in store, in memory if nil
+func (app *App) EnableRememberMe(store RememberStore, maxAge time.Duration) {
+	if store == nil {
+		store = NewMemoryRememberStore()
+	}
+	if maxAge <= 0 {
+		maxAge = defaultRememberMaxAge
+	}
+
+	app.remember = &rememberMe{store: store, maxAge: maxAge}
+}
+
+// rememberFromRequest - Persistent logins of the App serving the request,
+// nil if disabled
+func rememberFromRequest(r *http.Request) *rememberMe {
+	if app := appFromContext(r.Context()); app != nil {
+		return app.remember
+	}
+
+	return nil
+}
+
+// Remember - Keeps the user of the session signed in after the browser
+// closes, usually on login when asked to. The token is linked to the
+// session, revoking it drops the token. Does nothing if the App did not
+// enable it. Must be called before the response is written
+func Remember(w http.ResponseWriter, r *http.Request, session *ustore.Session) error {
+	rm := rememberFromRequest(r)
+	if rm == nil {
+		return nil
+	}
+
+	selector, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+	validator, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+
+	t := &RememberToken{
+		Selector:      selector,
+		ValidatorHash: hashValidator(validator),
+		UserID:        session.UserID,
+		SessionID:     session.ID,
+		Expires:       time.Now().In(time.UTC).Add(rm.maxAge),
+	}
+	if err := rm.store.Add(r.Context(), t); err != nil {
+		return err
+	}
+
+	setRememberCookie(w, r, selector+":"+validator, rm.maxAge)
+
+	return nil
+}
+
+// Forget - Drops the persistent login of the request, usually on logout.
+// Must be called before the response is written
+func Forget(w http.ResponseWriter, r *http.Request) error {
+	rm := rememberFromRequest(r)
+	if rm == nil {
+		return nil
+	}
+
+	if selector, _, ok := rememberCookie(r); ok {
+		if err := rm.store.Delete(r.Context(), selector); err != nil {
+			return err
+		}
+	}
+	clearRememberCookie(w, r)
+
+	return nil
+}
+
+// RememberedSession - Starts a session signed in with the user of the
+// remember cookie and links the token to it, nil if there is no cookie or
+// it is not valid. The validator is replaced on every use: a replaced
+// validator coming back means the cookie was stolen, and every persistent
+// login and session of the user is revoked.
+// Must be called before the response is written
+func RememberedSession(w http.ResponseWriter, r *http.Request) (*ustore.Session, error) {
+	rm := rememberFromRequest(r)
+	if rm == nil {
+		return nil, nil
+	}
+
+	selector, validator, ok := rememberCookie(r)
+	if !ok {
+		return nil, nil
+	}
+
+	ctx := r.Context()
+	t, err := rm.store.Get(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(time.UTC)
+	if t == nil || now.After(t.Expires) {
+		if t != nil {
+			if err := rm.store.Delete(ctx, selector); err != nil {
+				return nil, err
+			}
+		}
+		clearRememberCookie(w, r)
+		return nil, nil
+	}
+
+	h := hashValidator(validator)
+	if subtle.ConstantTimeCompare(h, t.ValidatorHash) != 1 {
+		if t.PrevHash != nil && subtle.ConstantTimeCompare(h, t.PrevHash) == 1 && now.Sub(t.RotatedAt) < rememberGrace {
+			// The parallel request that rotated it links its own session
+			return startSession(w, r, t.UserID)
+		}
+
+		// The sessions the thief signed in with it go too
+		log.Printf("remember token %s of user %s reused, revoking the user tokens and sessions\n", selector, t.UserID)
+		if err := rm.store.DeleteUser(ctx, t.UserID); err != nil {
+			return nil, err
+		}
+		if _, err := RevokeOtherSessions(r, t.UserID, nil); err != nil {
+			return nil, err
+		}
+		clearRememberCookie(w, r)
+		return nil, nil
+	}
+
+	s, err := startSession(w, r, t.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	t.PrevHash = t.ValidatorHash
+	t.RotatedAt = now
+	t.ValidatorHash = hashValidator(next)
+	t.Expires = now.Add(rm.maxAge)
+	t.SessionID = s.ID
+	if err := rm.store.Update(ctx, t); err != nil {
+		if errors.Is(err, ErrRememberTokenRotated) {
+			// A parallel request rotated it first and sets the new cookie
+			return s, nil
+		}
+		return nil, err
+	}
+
+	setRememberCookie(w, r, selector+":"+next, rm.maxAge)
+
+	return s, nil
+}
+
+// moveRemembered - Follows the session of the request to its new ID
+func moveRemembered(r *http.Request, from ustore.SIDType, to ustore.SIDType) error {
+	rm := rememberFromRequest(r)
+	if rm == nil {
+		return nil
+	}
+
+	selector, _, ok := rememberCookie(r)
+	if !ok {
+		return nil
+	}
+
+	return rm.store.MoveSession(r.Context(), selector, from, to)
+}
+
+// forgetSession - Drops the persistent logins of a session
+func forgetSession(r *http.Request, sessionID ustore.SIDType) error {
+	rm := rememberFromRequest(r)
+	if rm == nil {
+		return nil
+	}
+
+	return rm.store.DeleteSession(r.Context(), sessionID)
+}
+
+// RevokeRemembered - Drops every persistent login of the user, e.g. when
+// the password changes
+func (app *App) RevokeRemembered(ctx context.Context, userID ustore.SIDType) error {
+	if app.remember == nil {
+		return nil
+	}
+
+	return app.remember.store.DeleteUser(ctx, userID)
+}
+
+// revokeRemembered - Drops the persistent logins of the user in the App
+// serving the request
+func revokeRemembered(r *http.Request, userID ustore.SIDType) {
+	app := appFromContext(r.Context())
+	if app == nil {
+		return
+	}
+
+	if err := app.RevokeRemembered(r.Context(), userID); err != nil {
+		log.Printf("could not revoke the remember tokens of user %s: %v\n", userID, err)
+	}
+}
+
+func hashValidator(validator string) []byte {
+	h := sha256.Sum256([]byte(validator))
+	return h[:]
+}
+
+// rememberCookieName - The session cookie name with a remember suffix
+func rememberCookieName(r *http.Request) string {
+	return sessionConfig(r).CookieName + "remember"
+}
+
+func setRememberCookie(w http.ResponseWriter, r *http.Request, value string, maxAge time.Duration) {
+	c := newSessionCookie(r, value, int(maxAge/time.Second))
+	c.Name = rememberCookieName(r)
+	http.SetCookie(w, c)
+}
+
+func clearRememberCookie(w http.ResponseWriter, r *http.Request) {
+	c := newSessionCookie(r, "", -1)
+	c.Name = rememberCookieName(r)
+	http.SetCookie(w, c)
+}
+
+// rememberCookie - Selector and validator of the remember cookie
+func rememberCookie(r *http.Request) (string, string, bool) {
+	c, err := r.Cookie(rememberCookieName(r))
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(c.Value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// MemoryRememberStore - Persistent logins in the process memory, for tests
+// and single instance apps. They are lost on restart
+type MemoryRememberStore struct {
+	mu     sync.Mutex
+	tokens map[string]RememberToken
+}
+
+// NewMemoryRememberStore - Returns an empty in-memory store
+func NewMemoryRememberStore() *MemoryRememberStore {
+	return &MemoryRememberStore{tokens: map[string]RememberToken{}}
+}
+
+func (ms *MemoryRememberStore) Add(ctx context.Context, t *RememberToken) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.tokens[t.Selector]; ok {
+		return ErrRememberTokenExists
+	}
+	ms.tokens[t.Selector] = *t
+
+	return nil
+}
+
+func (ms *MemoryRememberStore) Get(ctx context.Context, selector string) (*RememberToken, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	t, ok := ms.tokens[selector]
+	if !ok {
+		return nil, nil
+	}
+
+	return &t, nil
+}
+
+func (ms *MemoryRememberStore) Update(ctx context.Context, t *RememberToken) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	cur, ok := ms.tokens[t.Selector]
+	if !ok {
+		return ustore.ErrNotFound
+	}
+	if subtle.ConstantTimeCompare(cur.ValidatorHash, t.PrevHash) != 1 {
+		return ErrRememberTokenRotated
+	}
+	ms.tokens[t.Selector] = *t
+
+	return nil
+}
+
+func (ms *MemoryRememberStore) MoveSession(ctx context.Context, selector string, from ustore.SIDType, to ustore.SIDType) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	t, ok := ms.tokens[selector]
+	if !ok || t.SessionID.String() != from.String() {
+		return nil
+	}
+	t.SessionID = to
+	ms.tokens[selector] = t
+
+	return nil
+}
+
+func (ms *MemoryRememberStore) DeleteSession(ctx context.Context, sessionID ustore.SIDType) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for k, t := range ms.tokens {
+		if len(t.SessionID) > 0 && t.SessionID.String() == sessionID.String() {
+			delete(ms.tokens, k)
+		}
+	}
+
+	return nil
+}
+
+func (ms *MemoryRememberStore) Delete(ctx context.Context, selector string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.tokens, selector)
+
+	return nil
+}
+
+func (ms *MemoryRememberStore) DeleteUser(ctx context.Context, userID ustore.SIDType) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for k, t := range ms.tokens {
+		if t.UserID.String() == userID.String() {
+			delete(ms.tokens, k)
+		}
+	}
+
+	return nil
+}
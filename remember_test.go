@@ -0,0 +1,141 @@
+package uviews
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestRememberMe(t *testing.T) {
+	napp := NewApp("remember_app", []byte("1234"), "11743", "", "", "")
+	sessions := NewMemorySessionStore()
+	napp.SetSessionStore(sessions)
+	store := NewMemoryRememberStore()
+	napp.EnableRememberMe(store, time.Hour)
+
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	uid := b.ID
+	sb, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	login := &ustore.Session{Base: *sb, UserID: uid}
+
+	newReq := func(c *http.Cookie) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c != nil {
+			r.AddCookie(c)
+		}
+		return r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+	}
+	rememberCookieOf := func(rec *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "_remember_appsessionidremember" {
+				return c
+			}
+		}
+		return nil
+	}
+	// visit - Opens a view with the remember cookie only, as a browser
+	// that was closed. Returns the signed in user and the new cookie
+	visit := func(c *http.Cookie) (ustore.SIDType, *http.Cookie) {
+		var userID ustore.SIDType
+		rec := httptest.NewRecorder()
+		napp.BypassAuthentication(func() View { return &testView{} }, func(w http.ResponseWriter, r *http.Request, v View) {
+			userID = v.GetSession().UserID
+		})(rec, newReq(c))
+		return userID, rememberCookieOf(rec)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := Remember(rec, newReq(nil), login); err != nil {
+		t.Error(err)
+		return
+	}
+	c1 := rememberCookieOf(rec)
+	if c1 == nil || c1.MaxAge != 3600 {
+		t.Errorf("expected a persistent cookie, got %v\n", c1)
+		return
+	}
+
+	// The remember cookie signs the user in and is rotated
+	userID, c2 := visit(c1)
+	if userID.String() != uid.String() || c2 == nil || c2.Value == c1.Value {
+		t.Errorf("expected the user signed in with a new cookie, got %v %v\n", userID, c2)
+		return
+	}
+
+	// The token follows the session it signed in
+	for _, tok := range store.tokens {
+		if len(tok.SessionID) == 0 || tok.SessionID.String() == login.ID.String() {
+			t.Errorf("expected the token linked to the new session, got %s\n", tok.SessionID)
+			return
+		}
+	}
+
+	// A parallel request with the replaced cookie is accepted for a while
+	if userID, _ := visit(c1); userID.String() != uid.String() {
+		t.Error("expected the replaced cookie to be accepted within the grace period")
+		return
+	}
+
+	// Only one of two parallel rotations of a validator wins
+	for _, tok := range store.tokens {
+		stale := tok
+		stale.PrevHash = hashValidator("replaced")
+		if err := store.Update(context.Background(), &stale); !errors.Is(err, ErrRememberTokenRotated) {
+			t.Errorf("expected the stale rotation refused, got %v\n", err)
+			return
+		}
+	}
+
+	// Later on it means the cookie was stolen, every login of the user goes
+	if l, _ := sessions.UserSessions(context.Background(), uid); len(l) == 0 {
+		t.Error("expected the remembered sessions")
+		return
+	}
+	for k, tok := range store.tokens {
+		tok.RotatedAt = tok.RotatedAt.Add(-2 * rememberGrace)
+		store.tokens[k] = tok
+	}
+	if userID, c := visit(c1); userID != nil || c == nil || c.MaxAge >= 0 {
+		t.Errorf("expected the stolen cookie to be refused and cleared, got %v %v\n", userID, c)
+		return
+	}
+	if userID, _ := visit(c2); userID != nil {
+		t.Error("expected every token of the user to be revoked")
+		return
+	}
+	if l, _ := sessions.UserSessions(context.Background(), uid); len(l) != 0 {
+		t.Errorf("expected the sessions signed in with the token revoked, got %d\n", len(l))
+		return
+	}
+
+	// Password changes revoke the tokens
+	rec = httptest.NewRecorder()
+	if err := Remember(rec, newReq(nil), login); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := napp.RevokeRemembered(context.Background(), uid); err != nil {
+		t.Error(err)
+		return
+	}
+	if userID, _ := visit(rememberCookieOf(rec)); userID != nil {
+		t.Error("expected the revoked token to be refused")
+		return
+	}
+
+	fmt.Printf("TestRememberMe: OK\n")
+}
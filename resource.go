@@ -0,0 +1,216 @@
+package uviews
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/usfsci/ustore"
+)
+
+// ResourceOp - A REST operation on a resource
+type ResourceOp string
+
+const (
+	// GET on the collection
+	OpList ResourceOp = "list"
+	// POST on the collection
+	OpAdd ResourceOp = "add"
+	// GET on an item
+	OpGet ResourceOp = "get"
+	// PUT on an item
+	OpUpdate ResourceOp = "update"
+	// PATCH on an item. Only the fields sent are changed
+	OpPatch ResourceOp = "patch"
+	// DELETE on an item
+	OpDelete ResourceOp = "delete"
+	// GET on the collection events, streamed as Server-Sent Events
+	OpEvents ResourceOp = "events"
+
+	// Account operations, mounted with App.ApiRoute only. POST of a RawToken
+	// confirming the user email, see ApiEmailValidate
+	OpValidateEmail ResourceOp = "validate-email"
+	// POST of a RawToken with the new password, see ApiPasswordReset
+	OpResetPassword ResourceOp = "reset-password"
+)
+
+// AllOps - Every operation, in registration order
+var AllOps = []ResourceOp{OpEvents, OpList, OpAdd, OpGet, OpUpdate, OpPatch, OpDelete}
+
+// resourceOps - Route of every operation
+var resourceOps = map[ResourceOp]struct {
+	item    bool
+	method  string
+	handler ApiHandler
+}{
+	OpList:   {false, http.MethodGet, ApiList},
+	OpAdd:    {false, http.MethodPost, ApiAdd},
+	OpGet:    {true, http.MethodGet, ApiGet},
+	OpUpdate: {true, http.MethodPut, ApiUpdate},
+	OpPatch:  {true, http.MethodPatch, ApiPatch},
+	OpDelete: {true, http.MethodDelete, ApiDelete},
+}
+
+// accountOps - Handlers of the operations Resource does not mount
+var accountOps = map[ResourceOp]struct {
+	method  string
+	handler ApiHandler
+}{
+	OpValidateEmail: {http.MethodPost, ApiEmailValidate},
+	OpResetPassword: {http.MethodPost, ApiPasswordReset},
+}
+
+// opRoute - Method and handler of a generic operation
+func opRoute(op ResourceOp) (string, ApiHandler, bool) {
+	if spec, ok := resourceOps[op]; ok {
+		return spec.method, spec.handler, true
+	}
+	if spec, ok := accountOps[op]; ok {
+		return spec.method, spec.handler, true
+	}
+
+	return "", nil, false
+}
+
+// ResourceOptions - How a resource is mounted. The zero value mounts every
+// operation, all of them authenticated and requiring a confirmed email
+type ResourceOptions struct {
+	// Collection path segment. Defaults to the lowercase entity type
+	// name plus "s", e.g. "users" for *ustore.User
+	Name string
+	// Operations to mount, all if empty
+	Ops []ResourceOp
+	// Operations that bypass authentication, e.g. OpAdd for sign up
+	Public []ResourceOp
+	// Accept users that did not confirm their email yet
+	SkipEmailCheck bool
+	// Events carry the zeroed entity, not only its id
+	StreamEntities bool
+}
+
+// Resource - A collection of ustore entities mounted on the App router
+type Resource struct {
+	app       *App
+	parent    *Resource
+	newEntity func() ustore.Entity
+	// Collection path segment
+	name string
+	// Number of ancestors in the collection path
+	depth int
+	// Mounted operations
+	ops []ResourceOp
+	// Child resources by name
+	children map[string]*Resource
+}
+
+// Resource - Mounts the collection and item routes of the entities built by
+// newEntity, under the item path of parent, or at the root if parent is nil.
+// Ancestor vars are numbered from the root: a "clients" resource under
+// "users" is mounted on /users/{0}/clients and /users/{0}/clients/{1}.
+// Panics if the nesting level does not match the entity ancestors
+func (app *App) Resource(newEntity func() ustore.Entity, parent *Resource, opts *ResourceOptions) *Resource {
+	if opts == nil {
+		opts = &ResourceOptions{}
+	}
+
+	res := &Resource{
+		app:       app,
+		parent:    parent,
+		newEntity: newEntity,
+		name:      opts.Name,
+		ops:       opts.Ops,
+		children:  map[string]*Resource{},
+	}
+
+	ent := newEntity()
+	if res.name == "" {
+		res.name = strings.ToLower(indirectType(reflect.TypeOf(ent)).Name()) + "s"
+	}
+	if len(res.ops) == 0 {
+		res.ops = AllOps
+	}
+	if parent != nil {
+		res.depth = parent.depth + 1
+		parent.children[res.name] = res
+	}
+
+	if n := ent.AncestorsRootLen(); n != res.depth {
+		panic(fmt.Sprintf("uviews: resource %s has %d ancestors, its entity expects %d", res.CollectionPath(), res.depth, n))
+	}
+
+	public := map[ResourceOp]bool{}
+	for _, op := range opts.Public {
+		public[op] = true
+	}
+
+	// Mounted before the item routes, "events" would match the item id
+	for _, op := range res.ops {
+		if op == OpEvents {
+			h := res.eventsHandler(!public[op], !opts.SkipEmailCheck, opts.StreamEntities)
+			app.Router.HandleFunc(res.EventsPath(), h).Methods(http.MethodGet)
+		}
+	}
+
+	for _, op := range res.ops {
+		if op == OpEvents {
+			continue
+		}
+
+		spec, ok := resourceOps[op]
+		if !ok {
+			panic(fmt.Sprintf("uviews: unknown operation %s on resource %s", op, res.CollectionPath()))
+		}
+
+		path := res.CollectionPath()
+		if spec.item {
+			path = res.ItemPath()
+		}
+
+		app.mountApiRoute(path, spec.method, &apiRoute{
+			newEntity:    newEntity,
+			handler:      spec.handler,
+			authenticate: !public[op],
+			checkEmail:   !public[op] && !opts.SkipEmailCheck,
+			resource:     res,
+			op:           op,
+		})
+	}
+
+	return res
+}
+
+// Name - The collection path segment
+func (res *Resource) Name() string {
+	return res.name
+}
+
+// Parent - The parent resource, nil for root resources
+func (res *Resource) Parent() *Resource {
+	return res.parent
+}
+
+// Child - The child resource mounted with name, if any
+func (res *Resource) Child(name string) (*Resource, bool) {
+	c, ok := res.children[name]
+	return c, ok
+}
+
+// CollectionPath - Path template of the collection, e.g. /users/{0}/clients
+func (res *Resource) CollectionPath() string {
+	if res.parent == nil {
+		return "/" + res.name
+	}
+
+	return res.parent.ItemPath() + "/" + res.name
+}
+
+// EventsPath - Path of the collection events, e.g. /users/{0}/clients/events
+func (res *Resource) EventsPath() string {
+	return res.CollectionPath() + "/events"
+}
+
+// ItemPath - Path template of an item, e.g. /users/{0}/clients/{1}
+func (res *Resource) ItemPath() string {
+	return fmt.Sprintf("%s/{%d}", res.CollectionPath(), res.depth)
+}
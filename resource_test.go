@@ -0,0 +1,154 @@
+package uviews
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/usfsci/ustore"
+)
+
+func TestResourceRoutes(t *testing.T) {
+	rapp := NewApp("resource_app", []byte("1234"), "11738", "", "", "")
+
+	users := rapp.Resource(ustore.NewUser, nil, &ResourceOptions{Public: []ResourceOp{OpAdd}})
+	clients := rapp.Resource(ustore.NewClient, users, &ResourceOptions{Ops: []ResourceOp{OpList, OpAdd, OpGet, OpDelete}})
+
+	if users.ItemPath() != "/users/{0}" || clients.ItemPath() != "/users/{0}/clients/{1}" {
+		t.Errorf("unexpected paths %s, %s\n", users.ItemPath(), clients.ItemPath())
+		return
+	}
+
+	if c, ok := users.Child("clients"); !ok || c != clients {
+		t.Error("expected clients to be a child of users")
+		return
+	}
+
+	// Collect the mounted routes
+	got := make([]string, 0)
+	rapp.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		got = append(got, strings.Join(methods, ",")+" "+tpl)
+		return nil
+	})
+	sort.Strings(got)
+
+	expected := []string{
+		"DELETE /users/{0}",
+		"DELETE /users/{0}/clients/{1}",
+		"GET /users",
+		"GET /users/events",
+		"GET /users/{0}",
+		"GET /users/{0}/clients",
+		"GET /users/{0}/clients/{1}",
+		"PATCH /users/{0}",
+		"POST /users",
+		"POST /users/{0}/clients",
+		"PUT /users/{0}",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected routes:\n%s\ngot:\n%s\n", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+		return
+	}
+
+	// Operations not mounted are rejected by the router
+	req, _ := http.NewRequest(http.MethodPut, "/users/0123456789abcdef/clients/0123456789abcdef", nil)
+	response := httptest.NewRecorder()
+	rapp.Router.ServeHTTP(response, req)
+
+	if code := response.Result().StatusCode; code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status code %d, got %d\n", http.StatusMethodNotAllowed, code)
+		return
+	}
+
+	// Only sign up bypasses authentication
+	doc := rapp.OpenAPI()
+	if doc.Paths["/users"]["post"].Security != nil || doc.Paths["/users"]["get"].Security == nil {
+		t.Error("expected a public add and an authenticated list on users")
+		return
+	}
+
+	fmt.Printf("RESOURCE ROUTES MOUNTED\n")
+}
+
+func TestResourceDepthMismatch(t *testing.T) {
+	rapp := NewApp("resource_app", []byte("1234"), "11738", "", "", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic mounting clients at the root")
+		}
+	}()
+
+	rapp.Resource(ustore.NewClient, nil, nil)
+}
+
+// patchClient - A client stored in memory
+type patchClient struct {
+	ustore.Client
+	stored *ustore.Client
+}
+
+func (c *patchClient) Get(ctx context.Context, f *ustore.Filter, ancestors ...ustore.SIDType) error {
+	c.Client = *c.stored
+	return nil
+}
+
+func (c *patchClient) Update(ctx context.Context, ancestors ...ustore.SIDType) error {
+	*c.stored = c.Client
+	return nil
+}
+
+// Zero - The token stands for the secrets hidden from the responses
+func (c *patchClient) Zero() {
+	c.NotificationToken = ""
+}
+
+func TestResourcePatch(t *testing.T) {
+	rapp := NewApp("resource_app", []byte("1234"), "11738", "", "", "")
+
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b.ModificationTime = time.Now().Add(-time.Minute).In(time.UTC)
+	stored := &ustore.Client{Base: *b, Name: "phone", NotificationToken: "tok", Os: "ios", Sdk: "12"}
+
+	rapp.Router.HandleFunc("/users/{0}/clients/{1}", rapp.ApiBypassAuthentication(func() ustore.Entity {
+		return &patchClient{stored: stored}
+	}, ApiPatch)).Methods(http.MethodPatch)
+
+	body, _ := json.Marshal(NewMessageSim(map[string]interface{}{"name": "tablet"}))
+	req, _ := http.NewRequest(http.MethodPatch, "/users/0123456789abcdef/clients/"+b.ID.String(), bytes.NewBuffer(body))
+	req.Header.Set(contentTypeKey, MediaTypeJSON)
+	response := httptest.NewRecorder()
+	rapp.Router.ServeHTTP(response, req)
+
+	if code := response.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d %s\n", http.StatusOK, code, response.Body)
+		return
+	}
+
+	// Fields not sent keep their stored value
+	if stored.Name != "tablet" || stored.NotificationToken != "tok" || stored.Os != "ios" || stored.Sdk != "12" {
+		t.Errorf("expected only the name changed, got %+v\n", stored)
+		return
+	}
+}
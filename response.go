@@ -2,11 +2,8 @@ package uviews
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
 	"time"
-
-	"github.com/usfsci/ustore"
 )
 
 type Response struct {
@@ -18,24 +15,36 @@ type Response struct {
 	Error     []*ApiError `json:"error,omitempty"`
 }
 
+// HandleStoreError - Writes the plain text error response for err
+// using the registered store error mappings
 func HandleStoreError(w http.ResponseWriter, err error) {
-	if errors.Is(err, ustore.ErrNotFound) {
-		// The requested entity was not found
-		http.Error(w, err.Error(), http.StatusNotFound)
-	} else if errors.Is(err, ustore.ErrConstraint) {
-		// A foreign key is required and was not provided or the one
-		// provided does not exist
-	} else if errors.Is(err, ustore.ErrInternal) {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	m := storeErrorMapping(err)
+
+	e := m.apiError(err)
+	msg := e.Desc
+	if e.Debug != "" {
+		msg += ": " + e.Debug
 	}
+
+	http.Error(w, msg, m.Status)
 }
 
-func ApiResponseWrite(w http.ResponseWriter, origin string, data interface{}, errors []*ApiError, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	//w.Header().Add("Time", time.Now().UTC().Format(time.RFC3339))
-	w.WriteHeader(statusCode)
+// ApiResponseWrite - Writes the Response envelope using the codec negotiated
+// from the request Accept header, JSON if none was acceptable
+func ApiResponseWrite(w http.ResponseWriter, r *http.Request, origin string, data interface{}, errors []*ApiError, statusCode int) {
+	c, ok := responseCodec(r)
+	if !ok {
+		c = jsonCodec{}
+	}
+
+	// Errors are written as problem details if the App asks for it
+	if app := appFromContext(r.Context()); app != nil && app.problemTypeBase != "" &&
+		len(errors) > 0 && statusCode >= http.StatusBadRequest && c.MediaType() == MediaTypeJSON {
+		writeProblem(w, newProblemDetails(r, app.problemTypeBase, errors, statusCode))
+		return
+	}
 
-	r := &Response{
+	resp := &Response{
 		Version:   apiVersion,
 		Timestamp: time.Now().In(time.UTC).Unix(),
 		Status:    statusCode,
@@ -44,48 +53,41 @@ func ApiResponseWrite(w http.ResponseWriter, origin string, data interface{}, er
 		Error:     errors,
 	}
 
-	if err := json.NewEncoder(w).Encode(r); err != nil {
+	// Encode before writing the header so that encoding errors can still be reported
+	b, err := c.Marshal(resp)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-}
 
-func ApiResponseStoreError(w http.ResponseWriter, origin string, err error) {
-	code, e := ApiErrFromStoreErr(err)
-	ApiResponseWrite(w, origin, nil, []*ApiError{e}, code)
+	w.Header().Set(contentTypeKey, c.MediaType())
+	//w.Header().Add("Time", time.Now().UTC().Format(time.RFC3339))
+	w.WriteHeader(statusCode)
+
+	w.Write(b)
 }
 
-func ApiErrFromStoreErr(err error) (int, *ApiError) {
-	var code int
-	e := &ApiError{}
-
-	if errors.Is(err, ustore.ErrNotFound) {
-		// The requested entity was not found
-		code = http.StatusNotAcceptable
-		e.Desc = "the requested resource was not found"
-	} else if errors.Is(err, ustore.ErrConstraint) {
-		// A foreign key is required and was not provided or the one
-		// provided does not exist
-		code = http.StatusBadRequest
-		e.Desc = "key missing or unexisting"
-	} else if errors.Is(err, ustore.ErrDuplicatedKey) {
-		code = http.StatusBadRequest
-		e.Desc = "duplicated entry"
-	} else if errors.Is(err, ustore.ErrInternal) {
-		code = http.StatusInternalServerError
-		e.Desc = "internal server error"
-	} else if errors.Is(err, ustore.ErrTermsNotAccepted) {
-		code = http.StatusBadRequest
-		e.Desc = "terms not accepted"
-	} else if errors.Is(err, ustore.ErrBadRequest) {
-		e = ApiErrBadRequest
-	} else {
-		code = http.StatusInternalServerError
-		e.Desc = "unknown error"
+func writeProblem(w http.ResponseWriter, p *ProblemDetails) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if debugMode {
-		e.Debug = err.Error()
-	}
+	w.Header().Set(contentTypeKey, MediaTypeProblemJSON)
+	w.WriteHeader(p.Status)
 
-	return code, e
+	w.Write(b)
+}
+
+func ApiResponseStoreError(w http.ResponseWriter, r *http.Request, origin string, err error) {
+	code, e := ApiErrFromStoreErr(err)
+	ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, code)
+}
+
+// ApiErrFromStoreErr - Returns the status code and ApiError for err
+// using the registered store error mappings
+func ApiErrFromStoreErr(err error) (int, *ApiError) {
+	m := storeErrorMapping(err)
+	return m.Status, m.apiError(err)
 }
@@ -0,0 +1,168 @@
+package uviews
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Query key of the path to return to once signed in
+const returnToKey = "rp"
+
+// SetReturnPaths - Only the local paths under these prefixes are returned
+// to after login. Every local path is if none are set
+func (app *App) SetReturnPaths(prefixes ...string) {
+	app.returnPaths = prefixes
+}
+
+// returnToMAC - Signs target with a key derived from the App CSRF key.
+// Nil if the App has no key, return paths travel unsigned then
+func returnToMAC(app *App, target string) []byte {
+	if len(app.csrfKey) == 0 {
+		return nil
+	}
+
+	k := hmac.New(sha256.New, app.csrfKey)
+	k.Write([]byte("uviews return-to"))
+
+	m := hmac.New(sha256.New, k.Sum(nil))
+	m.Write([]byte(target))
+
+	return m.Sum(nil)
+}
+
+// ReturnToValue - The rp value returning to target, signed by the App
+// serving the request. Apps without a CSRF key send target as it is.
+// Empty outside of an App or if target is not local
+func ReturnToValue(r *http.Request, target string) string {
+	app := appFromContext(r.Context())
+	if app == nil || !localPath(target) {
+		return ""
+	}
+
+	mac := returnToMAC(app, target)
+	if mac == nil {
+		return target
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(target)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac)
+}
+
+// ReturnPath - The target of an rp value, false unless it was signed by the
+// App serving the request and is an allowed local path. Apps without a CSRF
+// key take rp as the target, only the local path and allow-list checks
+// apply then, see SetReturnPaths
+func ReturnPath(r *http.Request, rp string) (string, bool) {
+	app := appFromContext(r.Context())
+	if app == nil || rp == "" {
+		return "", false
+	}
+
+	if len(app.csrfKey) == 0 {
+		if !localPath(rp) || !app.returnAllowed(rp) {
+			return "", false
+		}
+		return rp, true
+	}
+
+	parts := strings.Split(rp, ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+	target, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(mac, returnToMAC(app, string(target))) {
+		return "", false
+	}
+
+	if !localPath(string(target)) || !app.returnAllowed(string(target)) {
+		return "", false
+	}
+
+	return string(target), true
+}
+
+// localPath - target is an absolute path of this origin, with no scheme,
+// host or anything a browser could take for one
+func localPath(target string) bool {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.ContainsAny(target, "\\\r\n\t") {
+		return false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return false
+	}
+
+	return true
+}
+
+// returnAllowed - The path of target is under an allowed prefix
+func (app *App) returnAllowed(target string) bool {
+	if len(app.returnPaths) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	p := path.Clean(u.Path)
+
+	for _, prefix := range app.returnPaths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") || prefix == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withReturnTo - to with the rp query returning to the request URL. Only
+// GET and HEAD requests are returned to, the others cannot be replayed by
+// a redirect
+func withReturnTo(r *http.Request, to string) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return to
+	}
+
+	rp := ReturnToValue(r, r.URL.RequestURI())
+	if rp == "" {
+		return to
+	}
+
+	return withQuery(to, url.Values{returnToKey: {rp}})
+}
+
+// withQuery - to with q added to its query
+func withQuery(to string, q url.Values) string {
+	u, err := url.Parse(to)
+	if err != nil {
+		return to
+	}
+
+	uq := u.Query()
+	for k, v := range q {
+		uq[k] = v
+	}
+	u.RawQuery = uq.Encode()
+
+	return u.String()
+}
+
+// redirect - Redirects to to with a signed reference to the original URL
+func redirect(w http.ResponseWriter, r *http.Request, to string, statusCode int) {
+	http.Redirect(w, r, withReturnTo(r, to), statusCode)
+}
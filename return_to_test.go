@@ -0,0 +1,126 @@
+package uviews
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// closedView - A view nobody can read
+type closedView struct {
+	testView
+}
+
+func (v *closedView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return false, nil
+}
+
+func TestReturnTo(t *testing.T) {
+	napp := NewApp("rp_app", []byte("1234"), "11743", "", "", "/login")
+	other := NewApp("rp_other", []byte("5678"), "11743", "", "", "/login")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), appContextKey, napp))
+	otherReq := req.WithContext(context.WithValue(req.Context(), appContextKey, other))
+
+	rp := ReturnToValue(req, "/account?tab=2")
+	if p, ok := ReturnPath(req, rp); !ok || p != "/account?tab=2" {
+		t.Errorf("expected the signed path back, got %s %v\n", p, ok)
+		return
+	}
+	if _, ok := ReturnPath(otherReq, rp); ok {
+		t.Error("expected a value signed by another App rejected")
+		return
+	}
+	if ReturnToValue(req, "https://evil.com/") != "" {
+		t.Error("expected no value for a remote target")
+		return
+	}
+
+	// Allow-list
+	napp.SetReturnPaths("/account/", "/orders")
+	for target, ok := range map[string]bool{
+		"/account":          true,
+		"/account/settings": true,
+		"/orders?id=1":      true,
+		"/ordersx":          false,
+		"/account/../admin": false,
+		"/admin":            false,
+	} {
+		if _, got := ReturnPath(req, ReturnToValue(req, target)); got != ok {
+			t.Errorf("return path %s: expected %v\n", target, ok)
+			return
+		}
+	}
+	napp.SetReturnPaths()
+
+	// Unreadable views send to the login with a signed return to the request
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/private?a=1&b=x%20y", nil)
+	r = r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+	napp.ViewGetHandler(rec, r, &closedView{})
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("expected a redirect, got %d\n", rec.Code)
+		return
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || loc.Path != "/login" {
+		t.Errorf("expected a redirect to the login, got %s\n", rec.Header().Get("Location"))
+		return
+	}
+	if p, ok := ReturnPath(r, loc.Query().Get(returnToKey)); !ok || p != "/private?a=1&b=x%20y" {
+		t.Errorf("expected to return to the request URL, got %s %v\n", p, ok)
+		return
+	}
+
+	// Other methods are not returned to
+	rec = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/private", nil)
+	r = r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+	if to := withReturnTo(r, "/login"); to != "/login" {
+		t.Errorf("expected no return path for a POST, got %s\n", to)
+		return
+	}
+
+	// Apps without a key send the path as it is, and check it only
+	keyless := NewApp("rp_keyless", nil, "11743", "", "", "/login")
+	keylessReq := req.WithContext(context.WithValue(req.Context(), appContextKey, keyless))
+	if v := ReturnToValue(keylessReq, "/account"); v != "/account" {
+		t.Errorf("expected the plain path without a key, got %s\n", v)
+		return
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte("/account")) + "." + base64.RawURLEncoding.EncodeToString(hmac.New(sha256.New, nil).Sum(nil))
+	if _, ok := ReturnPath(keylessReq, forged); ok {
+		t.Error("expected a signed value rejected without a key")
+		return
+	}
+	keyless.SetReturnPaths("/account")
+	for target, ok := range map[string]bool{
+		"/account/settings":   true,
+		"/admin":              false,
+		"//evil.com/account":  false,
+		"https://evil.com/":   false,
+		"/account/../admin":   false,
+		"/\\evil.com/account": false,
+	} {
+		if _, got := ReturnPath(keylessReq, target); got != ok {
+			t.Errorf("keyless return path %s: expected %v\n", target, ok)
+			return
+		}
+	}
+
+	// The login path query is kept
+	if to := withQuery("/login?lang=es", url.Values{returnToKey: {rp}}); !strings.HasPrefix(to, "/login?") || !strings.Contains(to, "lang=es") || !strings.Contains(to, "rp="+rp) {
+		t.Errorf("expected both queries, got %s\n", to)
+		return
+	}
+
+	fmt.Printf("TestReturnTo: OK\n")
+}
@@ -2,159 +2,312 @@ package uviews
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/usfsci/uauth"
 	"github.com/usfsci/ustore"
 )
 
-// sessionIDCookieName - An App can have only one Session Cookie Name
-var sessionIDCookieName string
+// SessionConfig - The session cookie and timeouts of an App. Zero fields
+// take the App defaults, except Domain, Secure and MaxAge
+type SessionConfig struct {
+	// Must be all lowercase, starting with underscore and only alphanum
+	CookieName string
+	Domain     string
+	Path       string
+	SameSite   http.SameSite
+	Secure     bool
+	// Cookie Max-Age in seconds, 0 for a browser session cookie
+	MaxAge int
+	// Sessions expire Lifetime after they are created, or after Idle
+	// without requests, whatever comes first. See SetSessionTimeouts to
+	// disable them
+	Lifetime time.Duration
+	Idle     time.Duration
+}
+
+// Session lifetimes of the Apps that do not set them
+const (
+	defaultSessionLifetime = 24 * time.Hour
+	defaultSessionIdle     = 2 * time.Hour
+)
+
+// defaultSessionConfig - The session config of an App named appName
+func defaultSessionConfig(appName string) SessionConfig {
+	return SessionConfig{
+		CookieName: appName + "sessionid",
+		Path:       "/",
+		SameSite:   http.SameSiteLaxMode,
+		Secure:     true,
+		Lifetime:   defaultSessionLifetime,
+		Idle:       defaultSessionIdle,
+	}
+}
+
+// SetupSessions - Sets the session cookie name of the App. Returns an
+// error if the name is not valid
+//
+// Deprecated: use App.SetSessionConfig
+func (app *App) SetupSessions(sessionCookieName string) error {
+	if !validCookieName(sessionCookieName) {
+		return fmt.Errorf("uviews: invalid session cookie name %q", sessionCookieName)
+	}
+
+	app.sessionMu.Lock()
+	app.sessionConfig.CookieName = sessionCookieName
+	app.sessionMu.Unlock()
+
+	return nil
+}
+
+// SetSessionConfig - Replaces the session config of the App, zero fields
+// take the defaults. Should be called only once, on App startup.
+// Panics if the cookie name is not valid
+func (app *App) SetSessionConfig(c SessionConfig) {
+	d := defaultSessionConfig(app.name)
+	if c.CookieName == "" {
+		c.CookieName = d.CookieName
+	}
+	if !validCookieName(c.CookieName) {
+		panic(fmt.Sprintf("uviews: invalid session cookie name %q", c.CookieName))
+	}
+	if c.Path == "" {
+		c.Path = d.Path
+	}
+	if c.SameSite == 0 {
+		c.SameSite = d.SameSite
+	}
+	if c.Lifetime == 0 {
+		c.Lifetime = d.Lifetime
+	}
+	if c.Idle == 0 {
+		c.Idle = d.Idle
+	}
+
+	app.sessionMu.Lock()
+	app.sessionConfig = c
+	app.sessionMu.Unlock()
+}
 
-// SetupSessions - Sets the name of the session Cookie
-// Should be called only once, on App startup
-// Must be all lowercase, starting with underscore and
-// only alphanum
-func SetupSessions(sessionCookieName string) {
-	sessionIDCookieName = sessionCookieName
+// validCookieName - name is a non empty token, as cookie names must be
+func validCookieName(name string) bool {
+	return name != "" && strings.IndexFunc(name, func(c rune) bool {
+		return c <= ' ' || c >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, c)
+	}) < 0
 }
 
-// InitSession - Starts a DB session and sets a session id cookie
+// SetSessionTimeouts - Sessions expire lifetime after they are created, or
+// after idle without requests, whatever comes first. Zero disables a timeout
+func (app *App) SetSessionTimeouts(lifetime time.Duration, idle time.Duration) {
+	app.sessionMu.Lock()
+	app.sessionConfig.Lifetime = lifetime
+	app.sessionConfig.Idle = idle
+	app.sessionMu.Unlock()
+}
+
+// sessionConfig - A copy of the session config of the App serving the
+// request, the default one outside of an App
+func sessionConfig(r *http.Request) *SessionConfig {
+	if app := appFromContext(r.Context()); app != nil {
+		app.sessionMu.RLock()
+		c := app.sessionConfig
+		app.sessionMu.RUnlock()
+		return &c
+	}
+
+	c := defaultSessionConfig("_")
+	return &c
+}
+
+// InitSession - Starts a session with the App session store and sets the
+// session cookie
 func InitSession(w http.ResponseWriter, r *http.Request, userID ustore.SIDType) (*ustore.Session, error) {
-	// Build a DB session
-	s := &ustore.Session{}
-	if err := s.Add(r.Context(), userID, ""); err != nil {
+	s, err := startSession(w, r, userID)
+	if err != nil {
 		HandleStoreError(w, err)
 		return nil, err
 	}
 
-	// Set the cookie
-	tokenStr, err := uauth.EncodeToken(s.ID)
+	return s, nil
+}
+
+// startSession - InitSession leaving the store errors to the caller
+func startSession(w http.ResponseWriter, r *http.Request, userID ustore.SIDType) (*ustore.Session, error) {
+	s, err := sessionStore(r).Create(w, r, userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return nil, err
 	}
-
-	http.SetCookie(w,
-		&http.Cookie{
-			Name:     sessionIDCookieName,
-			Value:    tokenStr,
-			MaxAge:   0, // Session cookie
-			Secure:   true,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		})
+	sessionTrackerFromRequest(r).seen(r, s)
 
 	return s, nil
 }
 
-// LoadSession - Uses the sessionid cookie to get the Session from the store
+// expired - Reports whether s is past its lifetime or idle timeout
+func (c *SessionConfig) expired(s *ustore.Session, now time.Time) bool {
+	return (c.Lifetime > 0 && !s.CreationTime.IsZero() && now.Sub(s.CreationTime) > c.Lifetime) ||
+		(c.Idle > 0 && !s.ModificationTime.IsZero() && now.Sub(s.ModificationTime) > c.Idle)
+}
+
+// LoadSession - Uses the session cookie to get the Session from the store.
+// Returns a nil session but no error if there is no session cookie, or it
+// is not valid anymore, or the session expired. Invalid cookies are cleared
+// and expired sessions destroyed. Sessions past half their idle timeout are
+// saved to slide it
 func LoadSession(w http.ResponseWriter, r *http.Request) (*ustore.Session, error) {
-	// Get session id cookie
-	cookie, err := r.Cookie(sessionIDCookieName)
+	store := sessionStore(r)
+
+	s, err := store.Load(w, r)
+	if errors.Is(err, ErrInvalidSessionCookie) {
+		clearSessionCookie(w, r)
+		return nil, nil
+	}
 	if err != nil {
-		if errors.Is(err, http.ErrNoCookie) {
-			// No cookie, return a nil session but no error
-			return nil, nil
-		}
+		HandleStoreError(w, err)
 		return nil, err
 	}
-
-	var id ustore.SIDType
-	if err := uauth.DecodeToken(&id, cookie.Value); err != nil {
-		// Wrong or expired token, redirect to login
-		return nil, err
+	if s == nil {
+		return nil, nil
 	}
 
-	log.Printf("sessionid= %s\n", hex.EncodeToString(id))
+	now := time.Now()
+	c := sessionConfig(r)
+	if c.expired(s, now) {
+		sessionTrackerFromRequest(r).drop(s.ID)
+		if err := store.Destroy(w, r, s); err != nil {
+			HandleStoreError(w, err)
+			return nil, err
+		}
+		return nil, nil
+	}
 
-	// Get DB session
-	session := &ustore.Session{
-		Base: ustore.Base{
-			ID: id,
-		},
+	// Revoked sessions are refused even if the store still has them
+	if !sessionTrackerFromRequest(r).seen(r, s) {
+		if err := store.Destroy(w, r, s); err != nil {
+			HandleStoreError(w, err)
+			return nil, err
+		}
+		return nil, nil
 	}
-	if err := session.Get(r.Context(), nil); err != nil {
-		HandleStoreError(w, err)
-		return nil, err
+
+	if c.Idle > 0 && !s.ModificationTime.IsZero() && now.Sub(s.ModificationTime) > c.Idle/2 {
+		if err := store.Save(w, r, s); err != nil {
+			HandleStoreError(w, err)
+			return nil, err
+		}
 	}
 
-	return session, nil
+	return s, nil
 }
 
-func StoreDataInSession(ctx context.Context, session *ustore.Session, object interface{}) error {
-	// Save the view in the session for use in the GET
-	data, err := json.Marshal(object)
-	if err != nil {
-		return err
-	}
+// SaveSession - Persists the changes to the session. If its user changed
+// since it was loaded, e.g. on login, the session gets a new ID so that an
+// ID known before the change is worthless after it.
+// Must be called before the response is written
+func SaveSession(w http.ResponseWriter, r *http.Request, session *ustore.Session) error {
+	store := sessionStore(r)
 
-	session.Data = data
+	// The request cookie tells the user the session was loaded with
+	prev, err := store.Load(w, r)
+	if err == nil && prev != nil && prev.ID.String() == session.ID.String() &&
+		prev.UserID.String() != session.UserID.String() {
+		return RotateSession(w, r, session)
+	}
 
-	return session.Update(ctx)
+	return store.Save(w, r, session)
 }
 
-// restoreFormFromSession - Restores View fields from the session
-// If there is no data it does nothing
-// It clears the data stored in the session
-func RestoreDataFromSession(ctx context.Context, session *ustore.Session, object interface{}) error {
-	if session.Data == nil || len(session.Data) < 1 {
-		return nil
+// RotateSession - Moves the session, with its user and data, to a new ID
+// and destroys the old one. session is updated in place and its timeouts
+// start again. Must be called before the response is written
+func RotateSession(w http.ResponseWriter, r *http.Request, session *ustore.Session) error {
+	store := sessionStore(r)
+
+	// Destroy clears user and data of the session it gets
+	old := *session
+	if err := store.Destroy(w, r, &old); err != nil {
+		return err
+	}
+
+	// The cookie of the new session is set after the one clearing the old
+	s, err := store.Create(w, r, session.UserID)
+	if err != nil {
+		return err
+	}
+	s.Data = session.Data
+	if err := store.Save(w, r, s); err != nil {
+		return err
 	}
 
-	if err := json.Unmarshal(session.Data, object); err != nil {
+	if err := moveRemembered(r, old.ID, s.ID); err != nil {
 		return err
 	}
+	*session = *s
 
-	session.Data = []byte("")
-	return session.Update(ctx)
+	st := sessionTrackerFromRequest(r)
+	st.drop(old.ID)
+	st.seen(r, session)
+
+	return nil
 }
 
-// redirect - Redirects appending a reference to the original path to the redirected URL
-func redirect(w http.ResponseWriter, r *http.Request, path string, statusCode int) {
-	if r.URL.RawQuery == "" {
-		http.Redirect(w, r, path+pathToPars(r.URL.Path), statusCode)
-	} else {
-		http.Redirect(w, r, path+"?"+r.URL.RawQuery, statusCode)
-	}
+// DestroySession - Ends the session and clears its cookie, e.g. on logout.
+// Must be called before the response is written
+func DestroySession(w http.ResponseWriter, r *http.Request, session *ustore.Session) error {
+	sessionTrackerFromRequest(r).drop(session.ID)
+
+	return sessionStore(r).Destroy(w, r, session)
 }
 
-func redirectAppendQuery(w http.ResponseWriter, r *http.Request, path string, query string) {
-	pq := path
-	if len(query) > 0 {
-		pq += "?" + query
+// StoreFormInSession - Keeps object in the session until it is restored.
+// Must be called before the response is written
+func StoreFormInSession(w http.ResponseWriter, r *http.Request, session *ustore.Session, object interface{}) error {
+	// Save the view in the session for use in the GET
+	bag := SessionData(w, r, session)
+	if err := bag.SetFlash(sessionFormKey, object); err != nil {
+		return err
 	}
 
-	http.Redirect(w, r, pq, http.StatusSeeOther)
+	return saveSessionData(w, r, bag)
 }
 
-func pathToPars(path string) string {
-	// Path for redirections if needed
-	return "?rp=" + base64.RawURLEncoding.EncodeToString([]byte(path))
+// RestoreFormFromSession - Restores View fields from the session
+// If there is no data it does nothing
+// It clears the data stored in the session, other session values are kept
+func RestoreFormFromSession(w http.ResponseWriter, r *http.Request, session *ustore.Session, object interface{}) error {
+	bag := SessionData(w, r, session)
+	ok, err := bag.Flash(sessionFormKey, object)
+	if err != nil || !ok {
+		return err
+	}
+
+	return saveSessionData(w, r, bag)
 }
 
-func queryToPath(query string) (string, error) {
-	if len(query) <= 0 {
-		return "", nil
+// StoreDataInSession - Keeps object in the DB session until it is restored
+//
+// Deprecated: use StoreFormInSession, which works with every session store
+func StoreDataInSession(ctx context.Context, session *ustore.Session, object interface{}) error {
+	bag := newSessionBag(session)
+	if err := bag.SetFlash(sessionFormKey, object); err != nil {
+		return err
 	}
 
-	s := strings.Split(query, "=")
-	if len(s) != 2 || s[0] != "rp" {
-		return "", fmt.Errorf("invalid query")
-	}
+	return bag.update(ctx)
+}
 
-	// The base64 path is the last part of the array
-	b, err := base64.RawURLEncoding.DecodeString(s[1])
-	if err != nil {
-		return "", err
+// RestoreDataFromSession - Restores View fields from the DB session
+// If there is no data it does nothing
+//
+// Deprecated: use RestoreFormFromSession, which works with every session store
+func RestoreDataFromSession(ctx context.Context, session *ustore.Session, object interface{}) error {
+	bag := newSessionBag(session)
+	ok, err := bag.Flash(sessionFormKey, object)
+	if err != nil || !ok {
+		return err
 	}
 
-	return string(b), nil
+	return bag.update(ctx)
 }
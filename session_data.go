@@ -0,0 +1,233 @@
+package uviews
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/usfsci/ustore"
+)
+
+// Bag key of the form kept by StoreFormInSession
+const sessionFormKey = "uviews.form"
+
+// SessionBag - The session data as named values, kept as JSON. Values stay
+// until deleted, flash values are gone once read
+type SessionBag struct {
+	Values  map[string]json.RawMessage `json:"values,omitempty"`
+	Flashes map[string]json.RawMessage `json:"flashes,omitempty"`
+
+	session *ustore.Session
+	changed bool
+}
+
+// newSessionBag - Decodes the bag of the session. Data written before the
+// bag existed is dropped
+func newSessionBag(session *ustore.Session) *SessionBag {
+	b := &SessionBag{session: session}
+	if len(session.Data) > 0 {
+		if err := json.Unmarshal(session.Data, b); err != nil {
+			log.Printf("session %s: dropping undecodable data: %v\n", session.ID, err)
+		}
+	}
+	if b.Values == nil {
+		b.Values = map[string]json.RawMessage{}
+	}
+	if b.Flashes == nil {
+		b.Flashes = map[string]json.RawMessage{}
+	}
+
+	return b
+}
+
+// SessionData - The bag of the session. Write-back only happens for the
+// handlers wrapped by App.Authenticate or App.BypassAuthentication: there
+// the bag is shared by the whole request and written back, if it changed,
+// before the response header. Handlers mounted on the Router directly get
+// a new bag on every call, and must call Save or the changes are lost
+func SessionData(w http.ResponseWriter, r *http.Request, session *ustore.Session) *SessionBag {
+	sw, ok := w.(*sessionWriter)
+	if !ok {
+		return newSessionBag(session)
+	}
+
+	if sw.bag != nil && sw.bag.session != session {
+		// Another session, or another copy of the same one: the bag is
+		// saved first so that its changes are not lost, and a copy gets them
+		if err := sw.bag.Save(sw.ResponseWriter, r); err != nil {
+			log.Printf("session %s: could not save data: %v\n", sw.bag.session.ID, err)
+		}
+		if sw.bag.session.ID.String() == session.ID.String() {
+			session.Data = append([]byte(nil), sw.bag.session.Data...)
+		}
+		sw.bag = nil
+	}
+	if sw.bag == nil {
+		sw.bag = newSessionBag(session)
+	}
+
+	return sw.bag
+}
+
+// Get - Decodes the value of key into v. Returns false if there is none
+func (b *SessionBag) Get(key string, v interface{}) (bool, error) {
+	raw, ok := b.Values[key]
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(raw, v)
+}
+
+// Set - Keeps v under key until it is deleted
+func (b *SessionBag) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	b.Values[key] = raw
+	b.changed = true
+
+	return nil
+}
+
+// Delete - Drops the value of key
+func (b *SessionBag) Delete(key string) {
+	if _, ok := b.Values[key]; !ok {
+		return
+	}
+
+	delete(b.Values, key)
+	b.changed = true
+}
+
+// SetFlash - Keeps v under key until it is read with Flash
+func (b *SessionBag) SetFlash(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	b.Flashes[key] = raw
+	b.changed = true
+
+	return nil
+}
+
+// Flash - Decodes the flash value of key into v and drops it. Returns false
+// if there is none
+func (b *SessionBag) Flash(key string, v interface{}) (bool, error) {
+	raw, ok := b.Flashes[key]
+	if !ok {
+		return false, nil
+	}
+
+	delete(b.Flashes, key)
+	b.changed = true
+
+	return true, json.Unmarshal(raw, v)
+}
+
+// Changed - True if the bag changed since it was loaded or saved
+func (b *SessionBag) Changed() bool {
+	return b.changed
+}
+
+// Save - Writes the bag to its session if it changed.
+// Must be called before the response is written
+func (b *SessionBag) Save(w http.ResponseWriter, r *http.Request) error {
+	if !b.changed {
+		return nil
+	}
+
+	if err := b.encode(); err != nil {
+		return err
+	}
+	if err := SaveSession(w, r, b.session); err != nil {
+		return err
+	}
+	b.changed = false
+
+	return nil
+}
+
+// update - Writes the bag straight to its DB session
+func (b *SessionBag) update(ctx context.Context) error {
+	if err := b.encode(); err != nil {
+		return err
+	}
+	if err := b.session.Update(ctx); err != nil {
+		return err
+	}
+	b.changed = false
+
+	return nil
+}
+
+// encode - Sets the session data to the bag
+func (b *SessionBag) encode() error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	b.session.Data = data
+
+	return nil
+}
+
+// saveSessionData - Saves the bag now unless the App writes it back
+func saveSessionData(w http.ResponseWriter, r *http.Request, b *SessionBag) error {
+	if _, ok := w.(*sessionWriter); ok {
+		return nil
+	}
+
+	return b.Save(w, r)
+}
+
+// sessionWriter - Writes the session bag back before the response header
+type sessionWriter struct {
+	http.ResponseWriter
+	r   *http.Request
+	bag *SessionBag
+	// The bag was written back
+	done bool
+}
+
+func newSessionWriter(w http.ResponseWriter, r *http.Request) *sessionWriter {
+	return &sessionWriter{ResponseWriter: w, r: r}
+}
+
+// writeBack - Saves the bag once, cookie stores set the cookie with it
+func (sw *sessionWriter) writeBack() {
+	if sw.done {
+		return
+	}
+	sw.done = true
+
+	if sw.bag == nil {
+		return
+	}
+
+	if err := sw.bag.Save(sw.ResponseWriter, sw.r); err != nil {
+		log.Printf("session %s: could not save data: %v\n", sw.bag.session.ID, err)
+	}
+}
+
+func (sw *sessionWriter) WriteHeader(status int) {
+	sw.writeBack()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *sessionWriter) Write(b []byte) (int, error) {
+	sw.writeBack()
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *sessionWriter) Flush() {
+	sw.writeBack()
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
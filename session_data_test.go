@@ -0,0 +1,141 @@
+package uviews
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+// countingStore - Counts the saves of the wrapped store
+type countingStore struct {
+	SessionStore
+	saves int
+}
+
+func (cs *countingStore) Save(w http.ResponseWriter, r *http.Request, s *ustore.Session) error {
+	cs.saves++
+	return cs.SessionStore.Save(w, r, s)
+}
+
+// testView - A view readable and writable by anyone
+type testView struct {
+	DefaultView
+}
+
+func (v *testView) Get(w http.ResponseWriter, r *http.Request) {}
+
+func (v *testView) CanRead(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (v *testView) CanWrite(ctx context.Context, vars map[string]string) (bool, error) {
+	return true, nil
+}
+
+func TestSessionData(t *testing.T) {
+	napp := NewApp("bag_app", []byte("1234"), "11743", "", "", "")
+	store := &countingStore{SessionStore: NewMemorySessionStore()}
+	napp.SetSessionStore(store)
+
+	var cookie *http.Cookie
+	serve := func(f func(w http.ResponseWriter, r *http.Request, bag *SessionBag)) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+
+		h := napp.BypassAuthentication(func() View { return &testView{} }, func(w http.ResponseWriter, r *http.Request, v View) {
+			bag := SessionData(w, r, v.GetSession())
+			if bag != SessionData(w, r, v.GetSession()) {
+				t.Error("expected one bag per request")
+			}
+			f(w, r, bag)
+		})
+
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		if c := rec.Result().Cookies(); len(c) > 0 {
+			cookie = c[0]
+		}
+	}
+
+	// Values and flashes are written back once, before the response
+	serve(func(w http.ResponseWriter, r *http.Request, bag *SessionBag) {
+		bag.Set("theme", "dark")
+		bag.Set("count", 1)
+		bag.SetFlash("notice", "saved")
+		if err := StoreFormInSession(w, r, bag.session, map[string]string{"name": "a"}); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("ok"))
+		if store.saves != 1 {
+			t.Errorf("expected 1 save before the body, got %d\n", store.saves)
+		}
+	})
+
+	// Reading flashes and the form drops them only, others are kept
+	store.saves = 0
+	serve(func(w http.ResponseWriter, r *http.Request, bag *SessionBag) {
+		var notice string
+		if ok, err := bag.Flash("notice", &notice); !ok || err != nil || notice != "saved" {
+			t.Errorf("expected the flash, got %v %v %q\n", ok, err, notice)
+		}
+		form := map[string]string{}
+		if err := RestoreFormFromSession(w, r, bag.session, &form); err != nil || form["name"] != "a" {
+			t.Errorf("expected the form, got %v %v\n", form, err)
+		}
+		var count int
+		if ok, err := bag.Get("count", &count); !ok || err != nil || count != 1 {
+			t.Errorf("expected the count, got %v %v %d\n", ok, err, count)
+		}
+		bag.Delete("theme")
+	})
+	if store.saves != 1 {
+		t.Errorf("expected 1 save, got %d\n", store.saves)
+		return
+	}
+
+	// Requests that only read do not save
+	store.saves = 0
+	serve(func(w http.ResponseWriter, r *http.Request, bag *SessionBag) {
+		var notice, theme string
+		if ok, _ := bag.Flash("notice", &notice); ok {
+			t.Error("expected the flash to be gone")
+		}
+		if ok, _ := bag.Get("theme", &theme); ok {
+			t.Error("expected the theme to be deleted")
+		}
+		var count int
+		if ok, _ := bag.Get("count", &count); !ok || count != 1 {
+			t.Error("expected the count to be kept")
+		}
+	})
+	if store.saves != 0 {
+		t.Errorf("expected no saves, got %d\n", store.saves)
+		return
+	}
+
+	// A copy of the session gets the changes of the first bag, both are kept
+	serve(func(w http.ResponseWriter, r *http.Request, bag *SessionBag) {
+		bag.Set("theme", "light")
+		c := *bag.session
+		other := SessionData(w, r, &c)
+		other.Set("lang", "fr")
+	})
+	serve(func(w http.ResponseWriter, r *http.Request, bag *SessionBag) {
+		var theme, lang string
+		if ok, _ := bag.Get("theme", &theme); !ok || theme != "light" {
+			t.Errorf("expected the theme of the first bag, got %q\n", theme)
+		}
+		if ok, _ := bag.Get("lang", &lang); !ok || lang != "fr" {
+			t.Errorf("expected the lang of the second bag, got %q\n", lang)
+		}
+	})
+
+	fmt.Printf("TestSessionData: OK\n")
+}
@@ -0,0 +1,408 @@
+package uviews
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+// Path var with the session id of the session API routes
+const sessionParam = "session"
+
+// SessionInfo - A session of a user, as listed to them
+type SessionInfo struct {
+	ID           string    `json:"id"`
+	CreationTime time.Time `json:"creation_time"`
+	// Last request, nil if none since the server started
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+	UserAgent    string     `json:"user_agent,omitempty"`
+	IP           string     `json:"ip,omitempty"`
+	// The session making the request
+	Current bool `json:"current"`
+}
+
+// SessionLister - Implemented by the session stores that can list and end
+// the sessions of a user. Without it only the sessions seen since the
+// server started are listed, and revocations last until it restarts
+type SessionLister interface {
+	UserSessions(ctx context.Context, userID ustore.SIDType) ([]*ustore.Session, error)
+	RevokeSession(ctx context.Context, sessionID ustore.SIDType) error
+}
+
+// sessionActivity - Last request of a session
+type sessionActivity struct {
+	userID  string
+	created time.Time
+	seen    time.Time
+	ua      string
+	ip      string
+}
+
+// How long revocations are kept when sessions never expire
+const maxRevokedAge = 30 * 24 * time.Hour
+
+// sessionTracker - Activity of the signed in sessions and revocations, by
+// session id. Kept in memory: activity restarts with the server
+type sessionTracker struct {
+	mu       sync.RWMutex
+	activity map[string]*sessionActivity
+	// Revoked sessions and when they can be forgotten
+	revoked map[string]time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{
+		activity: map[string]*sessionActivity{},
+		revoked:  map[string]time.Time{},
+	}
+}
+
+// seen - Records a request of the session. Returns false if the session
+// was revoked
+func (st *sessionTracker) seen(r *http.Request, s *ustore.Session) bool {
+	id := s.ID.String()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if until, ok := st.revoked[id]; ok {
+		if time.Now().Before(until) {
+			return false
+		}
+		delete(st.revoked, id)
+	}
+	if len(s.UserID) == 0 {
+		return true
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	st.activity[id] = &sessionActivity{
+		userID:  s.UserID.String(),
+		created: s.CreationTime,
+		seen:    time.Now().In(time.UTC),
+		ua:      r.UserAgent(),
+		ip:      ip,
+	}
+
+	return true
+}
+
+// drop - Forgets the activity of an ended session
+func (st *sessionTracker) drop(sessionID ustore.SIDType) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.activity, sessionID.String())
+}
+
+// revoke - Refuses the session for ttl, after which it would have expired
+// anyway. Expired revocations are dropped
+func (st *sessionTracker) revoke(sessionID ustore.SIDType, ttl time.Duration) {
+	id := sessionID.String()
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for k, until := range st.revoked {
+		if !now.Before(until) {
+			delete(st.revoked, k)
+		}
+	}
+	st.revoked[id] = now.Add(ttl)
+	delete(st.activity, id)
+}
+
+// revokedTTL - Sessions expire after the shorter of their timeouts, which
+// both restart at the latest when the session is revoked
+func revokedTTL(c *SessionConfig) time.Duration {
+	ttl := time.Duration(0)
+	for _, d := range []time.Duration{c.Lifetime, c.Idle} {
+		if d > 0 && (ttl == 0 || d < ttl) {
+			ttl = d
+		}
+	}
+	if ttl == 0 {
+		return maxRevokedAge
+	}
+
+	return ttl
+}
+
+// list - The activity of the user sessions by id. Sessions idle for
+// longer than idle are dropped
+func (st *sessionTracker) list(userID ustore.SIDType, idle time.Duration) map[string]*sessionActivity {
+	uid := userID.String()
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	l := map[string]*sessionActivity{}
+	for id, a := range st.activity {
+		if idle > 0 && now.Sub(a.seen) > idle {
+			delete(st.activity, id)
+			continue
+		}
+		if a.userID == uid {
+			c := *a
+			l[id] = &c
+		}
+	}
+
+	return l
+}
+
+// sessionTrackerFromRequest - The tracker of the App serving the request,
+// an empty one if there is none
+func sessionTrackerFromRequest(r *http.Request) *sessionTracker {
+	if app := appFromContext(r.Context()); app != nil {
+		return app.sessionActivity
+	}
+
+	return newSessionTracker()
+}
+
+// UserSessions - The sessions of the user, newest first. current is the
+// id of the session making the request, nil if none
+func UserSessions(r *http.Request, userID ustore.SIDType, current ustore.SIDType) ([]*SessionInfo, error) {
+	activity := sessionTrackerFromRequest(r).list(userID, sessionConfig(r).Idle)
+
+	infos := make([]*SessionInfo, 0)
+	if sl, ok := sessionStore(r).(SessionLister); ok {
+		sessions, err := sl.UserSessions(r.Context(), userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sessions {
+			infos = append(infos, &SessionInfo{ID: s.ID.String(), CreationTime: s.CreationTime})
+		}
+	} else {
+		for id, a := range activity {
+			infos = append(infos, &SessionInfo{ID: id, CreationTime: a.created})
+		}
+	}
+
+	for _, info := range infos {
+		if a, ok := activity[info.ID]; ok {
+			seen := a.seen
+			info.LastActivity = &seen
+			info.UserAgent = a.ua
+			info.IP = a.ip
+		}
+		info.Current = len(current) > 0 && info.ID == current.String()
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreationTime.After(infos[j].CreationTime) })
+
+	return infos, nil
+}
+
+// RevokeSession - Ends a session of the user, its next request is
+// anonymous. The persistent logins linked to the session are dropped too.
+// Returns ustore.ErrNotFound if the user has no such session
+func RevokeSession(r *http.Request, userID ustore.SIDType, sessionID string) error {
+	infos, err := UserSessions(r, userID, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.ID == sessionID {
+			return revokeSession(r, sessionID)
+		}
+	}
+
+	return ustore.ErrNotFound
+}
+
+// RevokeOtherSessions - Ends every session of the user but keep, usually
+// the one making the request, with their persistent logins. Returns the
+// number of sessions ended
+func RevokeOtherSessions(r *http.Request, userID ustore.SIDType, keep ustore.SIDType) (int, error) {
+	infos, err := UserSessions(r, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, info := range infos {
+		if info.Current {
+			continue
+		}
+		if err := revokeSession(r, info.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// revokeSession - Ends the session in the store, if it can, and refuses it
+// from now on. Its persistent logins would sign it in again, they go too
+func revokeSession(r *http.Request, sessionID string) error {
+	id, err := ustore.SIDFromString(sessionID)
+	if err != nil {
+		return err
+	}
+
+	if sl, ok := sessionStore(r).(SessionLister); ok {
+		if err := sl.RevokeSession(r.Context(), id); err != nil {
+			return err
+		}
+	}
+	if err := forgetSession(r, id); err != nil {
+		return err
+	}
+	sessionTrackerFromRequest(r).revoke(id, revokedTTL(sessionConfig(r)))
+
+	return nil
+}
+
+// Sessions - The sessions of the signed in user, the view one flagged as
+// current. Empty for anonymous views
+func (view *DefaultView) Sessions(r *http.Request) ([]*SessionInfo, error) {
+	if view.User == nil || view.Session == nil {
+		return []*SessionInfo{}, nil
+	}
+
+	return UserSessions(r, view.User.ID, view.Session.ID)
+}
+
+// RevokeSession - Ends a session of the signed in user
+func (view *DefaultView) RevokeSession(r *http.Request, sessionID string) error {
+	if view.User == nil {
+		return ustore.ErrNotFound
+	}
+
+	return RevokeSession(r, view.User.ID, sessionID)
+}
+
+// RevokeOtherSessions - Ends every session of the signed in user but the
+// view one
+func (view *DefaultView) RevokeOtherSessions(r *http.Request) (int, error) {
+	if view.User == nil || view.Session == nil {
+		return 0, nil
+	}
+
+	return RevokeOtherSessions(r, view.User.ID, view.Session.ID)
+}
+
+// ApiSessionList - Lists the view sessions of the user.
+// Mount it on /users/{0}/sessions with ustore.NewUser
+func ApiSessionList(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "sessions"
+
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
+		return
+	}
+
+	infos, err := UserSessions(r, ancestors[0], nil)
+	if err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	ApiResponseWrite(w, r, origin, infos, nil, http.StatusOK)
+}
+
+// ApiSessionRevoke - Ends a view session of the user. Mount it on
+// /users/{0}/sessions/{session} with ustore.NewUser and the "0" ancestor var
+func ApiSessionRevoke(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "session-revoke"
+
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
+		return
+	}
+
+	if err := RevokeSession(r, ancestors[0], Params(r)[sessionParam]); err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	ApiResponseWrite(w, r, origin, nil, nil, http.StatusOK)
+}
+
+// ApiSessionRevokeOthers - Ends every view session of the user but the one
+// in the path. Mount it on /users/{0}/sessions/{session}/revoke-others with
+// ustore.NewUser and the "0" ancestor var
+func ApiSessionRevokeOthers(w http.ResponseWriter, r *http.Request, ent ustore.Entity, u *ustore.User, ancestors []ustore.SIDType) {
+	const origin = "session-revoke-others"
+
+	if !apiValidate(w, r, origin, checkAncestors(ent, ancestors, 1)) {
+		return
+	}
+
+	keep, err := ustore.SIDFromString(Params(r)[sessionParam])
+	if err != nil {
+		ApiResponseWrite(w, r, origin, nil, []*ApiError{newApiError(ErrCodeBadID, err.Error())}, http.StatusBadRequest)
+		return
+	}
+
+	n, err := RevokeOtherSessions(r, ancestors[0], keep)
+	if err != nil {
+		ApiResponseStoreError(w, r, origin, err)
+		return
+	}
+
+	ApiResponseWrite(w, r, origin, map[string]interface{}{"revoked": n}, nil, http.StatusOK)
+}
+
+// UserSessions - The signed in sessions of userID in the DB
+func (dbSessionStore) UserSessions(ctx context.Context, userID ustore.SIDType) ([]*ustore.Session, error) {
+	sessions := make([]*ustore.Session, 0)
+	if err := (&ustore.Session{}).List(ctx, &ustore.Filter{}, &sessions, userID); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession - Deletes the session from the DB
+func (dbSessionStore) RevokeSession(ctx context.Context, sessionID ustore.SIDType) error {
+	s := &ustore.Session{Base: ustore.Base{ID: sessionID}}
+	if err := s.Delete(ctx, time.Now().In(time.UTC)); err != nil && !errors.Is(err, ustore.ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// UserSessions - The sessions of userID in the store
+func (ms *MemorySessionStore) UserSessions(ctx context.Context, userID ustore.SIDType) ([]*ustore.Session, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	sessions := make([]*ustore.Session, 0)
+	for _, s := range ms.sessions {
+		if len(s.UserID) > 0 && s.UserID.String() == userID.String() {
+			sessions = append(sessions, copySession(s))
+		}
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession - Deletes the session
+func (ms *MemorySessionStore) RevokeSession(ctx context.Context, sessionID ustore.SIDType) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if key, ok := ms.keys[sessionID.String()]; ok {
+		delete(ms.sessions, key)
+		delete(ms.keys, sessionID.String())
+	}
+
+	return nil
+}
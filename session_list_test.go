@@ -0,0 +1,147 @@
+package uviews
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestUserSessions(t *testing.T) {
+	cookieStore, err := NewCookieSessionStore([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, store := range []SessionStore{NewMemorySessionStore(), cookieStore} {
+		napp := NewApp("list_app", []byte("1234"), "11743", "", "", "")
+		napp.SetSessionStore(store)
+		remember := NewMemoryRememberStore()
+		napp.EnableRememberMe(remember, 0)
+
+		bases := make([]*ustore.Base, 2)
+		for i := range bases {
+			if bases[i], err = ustore.NewBase(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		uid, other := bases[0].ID, bases[1].ID
+
+		newReq := func(ua string, c *http.Cookie) *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("User-Agent", ua)
+			if c != nil {
+				r.AddCookie(c)
+			}
+			return r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+		}
+		sessions := make([]*ustore.Session, 0)
+		cookies := make([]*http.Cookie, 0)
+		for _, ua := range []string{"laptop", "phone", "tablet"} {
+			w := httptest.NewRecorder()
+			s, err := InitSession(w, newReq(ua, nil), uid)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sessions = append(sessions, s)
+			cookies = append(cookies, w.Result().Cookies()[0])
+		}
+		if _, err := InitSession(httptest.NewRecorder(), newReq("anonymous", nil), nil); err != nil {
+			t.Error(err)
+			return
+		}
+
+		r := newReq("laptop", cookies[0])
+		infos, err := UserSessions(r, uid, sessions[0].ID)
+		if err != nil || len(infos) != 3 {
+			t.Errorf("%T: expected 3 sessions, got %v %v\n", store, infos, err)
+			return
+		}
+		for _, info := range infos {
+			if info.LastActivity == nil || info.UserAgent == "" || info.Current != (info.ID == sessions[0].ID.String()) {
+				t.Errorf("%T: unexpected session %+v\n", store, info)
+				return
+			}
+		}
+
+		// Sessions of other users cannot be revoked
+		if err := RevokeSession(r, other, sessions[1].ID.String()); !errors.Is(err, ustore.ErrNotFound) {
+			t.Errorf("%T: expected not found, got %v\n", store, err)
+			return
+		}
+
+		if err := RevokeSession(r, uid, sessions[1].ID.String()); err != nil {
+			t.Error(err)
+			return
+		}
+		if s, err := LoadSession(httptest.NewRecorder(), newReq("phone", cookies[1])); s != nil || err != nil {
+			t.Errorf("%T: expected the revoked session to be refused, got %v %v\n", store, s, err)
+			return
+		}
+
+		// A remembered login would sign the revoked sessions in again, the
+		// one of the current session is kept
+		for _, s := range []*ustore.Session{sessions[0], sessions[2]} {
+			if err := Remember(httptest.NewRecorder(), newReq("tablet", nil), s); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if n, err := RevokeOtherSessions(r, uid, sessions[0].ID); n != 1 || err != nil {
+			t.Errorf("%T: expected 1 session revoked, got %d %v\n", store, n, err)
+			return
+		}
+		if s, err := LoadSession(httptest.NewRecorder(), newReq("tablet", cookies[2])); s != nil || err != nil {
+			t.Errorf("%T: expected the revoked session to be refused, got %v %v\n", store, s, err)
+			return
+		}
+		if s, err := LoadSession(httptest.NewRecorder(), r); s == nil || err != nil {
+			t.Errorf("%T: expected the current session to be kept, got %v\n", store, err)
+			return
+		}
+		if len(remember.tokens) != 1 {
+			t.Errorf("%T: expected only the current remembered login kept, got %d\n", store, len(remember.tokens))
+			return
+		}
+		for _, tok := range remember.tokens {
+			if tok.SessionID.String() != sessions[0].ID.String() {
+				t.Errorf("%T: expected the current remembered login kept, got %s\n", store, tok.SessionID)
+				return
+			}
+		}
+	}
+
+	// Revocations are forgotten once the session would have expired
+	st := newSessionTracker()
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s := &ustore.Session{Base: *b}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	st.revoke(s.ID, time.Hour)
+	if st.seen(r, s) {
+		t.Error("expected the revoked session to be refused")
+		return
+	}
+	st.revoked[s.ID.String()] = time.Now().Add(-time.Second)
+	if !st.seen(r, s) || len(st.revoked) != 0 {
+		t.Errorf("expected the revocation to expire, got %v\n", st.revoked)
+		return
+	}
+	if ttl := revokedTTL(&SessionConfig{Lifetime: time.Hour, Idle: time.Minute}); ttl != time.Minute {
+		t.Errorf("expected the shorter timeout, got %v\n", ttl)
+		return
+	}
+
+	fmt.Printf("TestUserSessions: OK\n")
+}
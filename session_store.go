@@ -0,0 +1,430 @@
+package uviews
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/usfsci/uauth"
+	"github.com/usfsci/ustore"
+)
+
+const (
+	// Browsers drop cookies larger than this
+	maxCookieSize = 4096
+	// Memory sessions not saved for this long are dropped even if the App
+	// timeouts are disabled
+	memorySessionAbandoned = 30 * 24 * time.Hour
+)
+
+var (
+	// ErrSessionTooLarge - The session does not fit in a cookie
+	ErrSessionTooLarge = errors.New("session too large for a cookie")
+	// ErrInvalidSessionCookie - The session cookie cannot be decoded, or
+	// its session is gone: tampered with, expired or sealed with another
+	// key. Stores wrap the cause with it
+	ErrInvalidSessionCookie = errors.New("invalid session cookie")
+)
+
+// SessionStore - Where the sessions of the views live. The session id
+// travels in the session cookie, or the whole session for cookie stores
+type SessionStore interface {
+	// Create - Starts a session of userID, nil for anonymous users, and
+	// sets its cookie
+	Create(w http.ResponseWriter, r *http.Request, userID ustore.SIDType) (*ustore.Session, error)
+	// Load - The session of the request cookie, nil if there is none.
+	// Returns an error wrapping ErrInvalidSessionCookie if the cookie
+	// does not lead to a session
+	Load(w http.ResponseWriter, r *http.Request) (*ustore.Session, error)
+	// Save - Persists the changes to s. Cookie stores set the cookie again,
+	// so it must be called before the response is written
+	Save(w http.ResponseWriter, r *http.Request, s *ustore.Session) error
+	// Destroy - Ends s and clears its cookie
+	Destroy(w http.ResponseWriter, r *http.Request, s *ustore.Session) error
+}
+
+// SetSessionStore - Keeps the sessions of the App views in store.
+// Sessions are kept in the DB by default
+func (app *App) SetSessionStore(store SessionStore) {
+	app.sessions = store
+}
+
+// sessionStore - The store of the App serving the request, the DB store
+// outside of an App
+func sessionStore(r *http.Request) SessionStore {
+	if app := appFromContext(r.Context()); app != nil && app.sessions != nil {
+		return app.sessions
+	}
+
+	return dbSessionStore{}
+}
+
+// newSessionCookie - The session cookie of the App serving r
+func newSessionCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	c := sessionConfig(r)
+
+	return &http.Cookie{
+		Name:     c.CookieName,
+		Value:    value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		MaxAge:   maxAge,
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: c.SameSite,
+	}
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string) {
+	http.SetCookie(w, newSessionCookie(r, value, sessionConfig(r).MaxAge))
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, newSessionCookie(r, "", -1))
+}
+
+// sessionCookie - The value of the session cookie, "" if there is none
+func sessionCookie(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(sessionConfig(r).CookieName)
+	if err != nil {
+		if errors.Is(err, http.ErrNoCookie) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return cookie.Value, nil
+}
+
+// dbSessionStore - Sessions in the ustore DB, the cookie holds the
+// uauth encoded session id
+type dbSessionStore struct{}
+
+// NewDBSessionStore - Returns the store keeping the sessions in the DB
+func NewDBSessionStore() SessionStore {
+	return dbSessionStore{}
+}
+
+func (dbSessionStore) Create(w http.ResponseWriter, r *http.Request, userID ustore.SIDType) (*ustore.Session, error) {
+	s := &ustore.Session{}
+	if err := s.Add(r.Context(), userID, ""); err != nil {
+		return nil, err
+	}
+
+	tokenStr, err := uauth.EncodeToken(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	setSessionCookie(w, r, tokenStr)
+
+	return s, nil
+}
+
+func (dbSessionStore) Load(w http.ResponseWriter, r *http.Request) (*ustore.Session, error) {
+	v, err := sessionCookie(r)
+	if err != nil || v == "" {
+		return nil, err
+	}
+
+	var id ustore.SIDType
+	if err := uauth.DecodeToken(&id, v); err != nil {
+		// Wrong or expired token
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSessionCookie, err)
+	}
+
+	session := &ustore.Session{
+		Base: ustore.Base{
+			ID: id,
+		},
+	}
+	if err := session.Get(r.Context(), nil); err != nil {
+		if errors.Is(err, ustore.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSessionCookie, err)
+		}
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (dbSessionStore) Save(w http.ResponseWriter, r *http.Request, s *ustore.Session) error {
+	// The idle timeout slides from the modification time
+	s.ModificationTime = time.Now().In(time.UTC)
+
+	return s.Update(r.Context())
+}
+
+// Destroy - The DB session is kept, without user nor data
+func (dbSessionStore) Destroy(w http.ResponseWriter, r *http.Request, s *ustore.Session) error {
+	s.UserID = nil
+	s.Data = nil
+	if err := s.Update(r.Context()); err != nil {
+		return err
+	}
+	clearSessionCookie(w, r)
+
+	return nil
+}
+
+// MemorySessionStore - Sessions in the process memory, for tests and
+// single instance apps. The cookie holds a random key. Sessions past the
+// App timeouts, or not saved for 30 days, are dropped when sessions are
+// created or saved, at most once a minute
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*ustore.Session
+	// Cookie key by session id
+	keys map[string]string
+	// Last time the expired sessions were dropped
+	pruned time.Time
+}
+
+// NewMemorySessionStore - Returns an empty in-memory store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]*ustore.Session{},
+		keys:     map[string]string{},
+	}
+}
+
+// copySession - Callers get their own copy, changes are kept on Save
+func copySession(s *ustore.Session) *ustore.Session {
+	c := *s
+	c.Data = append([]byte(nil), s.Data...)
+
+	return &c
+}
+
+func (ms *MemorySessionStore) Create(w http.ResponseWriter, r *http.Request, userID ustore.SIDType) (*ustore.Session, error) {
+	b, err := ustore.NewBase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ustore.Session{Base: *b, UserID: userID}
+
+	ms.mu.Lock()
+	ms.prune(sessionConfig(r))
+	ms.sessions[key] = copySession(s)
+	ms.keys[s.ID.String()] = key
+	ms.mu.Unlock()
+
+	setSessionCookie(w, r, key)
+
+	return s, nil
+}
+
+func (ms *MemorySessionStore) Load(w http.ResponseWriter, r *http.Request) (*ustore.Session, error) {
+	key, err := sessionCookie(r)
+	if err != nil || key == "" {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	s, ok := ms.sessions[key]
+	if !ok {
+		// Unknown, expired or lost on restart
+		return nil, fmt.Errorf("%w: no memory session", ErrInvalidSessionCookie)
+	}
+
+	return copySession(s), nil
+}
+
+func (ms *MemorySessionStore) Save(w http.ResponseWriter, r *http.Request, s *ustore.Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.prune(sessionConfig(r))
+
+	key, ok := ms.keys[s.ID.String()]
+	if !ok {
+		return ustore.ErrNotFound
+	}
+
+	s.ModificationTime = time.Now().In(time.UTC)
+	ms.sessions[key] = copySession(s)
+
+	return nil
+}
+
+// prune - Drops the expired and abandoned sessions, at most once a minute.
+// Must be called with the lock held
+func (ms *MemorySessionStore) prune(c *SessionConfig) {
+	now := time.Now()
+	if now.Sub(ms.pruned) < time.Minute {
+		return
+	}
+	ms.pruned = now
+
+	for key, s := range ms.sessions {
+		if c.expired(s, now) || now.Sub(s.ModificationTime) > memorySessionAbandoned {
+			delete(ms.sessions, key)
+			delete(ms.keys, s.ID.String())
+		}
+	}
+}
+
+func (ms *MemorySessionStore) Destroy(w http.ResponseWriter, r *http.Request, s *ustore.Session) error {
+	ms.mu.Lock()
+	if key, ok := ms.keys[s.ID.String()]; ok {
+		delete(ms.sessions, key)
+		delete(ms.keys, s.ID.String())
+	}
+	ms.mu.Unlock()
+
+	clearSessionCookie(w, r)
+
+	return nil
+}
+
+// CookieSessionStore - Sessions kept by the browser in the session cookie,
+// encrypted and authenticated with AES-GCM. Nothing is stored server side,
+// so sessions cannot be listed nor revoked, and must fit in a cookie
+type CookieSessionStore struct {
+	aead cipher.AEAD
+}
+
+// NewCookieSessionStore - key must be 16, 24 or 32 bytes long
+func NewCookieSessionStore(key []byte) (*CookieSessionStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CookieSessionStore{aead: aead}, nil
+}
+
+// cookieSession - The session as sealed in the cookie
+type cookieSession struct {
+	ID       string    `json:"id"`
+	UserID   string    `json:"uid,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+	Created  time.Time `json:"c"`
+	Modified time.Time `json:"m"`
+}
+
+func (cs *CookieSessionStore) Create(w http.ResponseWriter, r *http.Request, userID ustore.SIDType) (*ustore.Session, error) {
+	b, err := ustore.NewBase()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ustore.Session{Base: *b, UserID: userID}
+	if err := cs.Save(w, r, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (cs *CookieSessionStore) Load(w http.ResponseWriter, r *http.Request) (*ustore.Session, error) {
+	v, err := sessionCookie(r)
+	if err != nil || v == "" {
+		return nil, err
+	}
+
+	s, err := cs.open(r, v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSessionCookie, err)
+	}
+
+	return s, nil
+}
+
+// open - Decrypts and decodes the session of the cookie value v
+func (cs *CookieSessionStore) open(r *http.Request, v string) (*ustore.Session, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	n := cs.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, fmt.Errorf("session cookie too short")
+	}
+
+	plain, err := cs.aead.Open(nil, sealed[:n], sealed[n:], []byte(sessionConfig(r).CookieName))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cookieSession{}
+	if err := json.Unmarshal(plain, c); err != nil {
+		return nil, err
+	}
+
+	id, err := ustore.SIDFromString(c.ID)
+	if err != nil {
+		return nil, err
+	}
+	s := &ustore.Session{
+		Base: ustore.Base{ID: id, CreationTime: c.Created, ModificationTime: c.Modified},
+		Data: c.Data,
+	}
+	if c.UserID != "" {
+		if s.UserID, err = ustore.SIDFromString(c.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (cs *CookieSessionStore) Save(w http.ResponseWriter, r *http.Request, s *ustore.Session) error {
+	s.ModificationTime = time.Now().In(time.UTC)
+
+	c := &cookieSession{
+		ID:       s.ID.String(),
+		Data:     s.Data,
+		Created:  s.CreationTime,
+		Modified: s.ModificationTime,
+	}
+	if len(s.UserID) > 0 {
+		c.UserID = s.UserID.String()
+	}
+
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, cs.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	// The cookie name is authenticated so that the cookie of an App
+	// cannot be replayed on another App sharing the key
+	name := sessionConfig(r).CookieName
+	v := base64.RawURLEncoding.EncodeToString(cs.aead.Seal(nonce, nonce, plain, []byte(name)))
+	if len(v)+len(name) > maxCookieSize {
+		return ErrSessionTooLarge
+	}
+	setSessionCookie(w, r, v)
+
+	return nil
+}
+
+func (cs *CookieSessionStore) Destroy(w http.ResponseWriter, r *http.Request, s *ustore.Session) error {
+	clearSessionCookie(w, r)
+
+	return nil
+}
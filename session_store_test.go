@@ -0,0 +1,340 @@
+package uviews
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+// sessionRoundTrip - Creates a session, stores data in it and loads it back
+// with the cookie the browser would send
+func sessionRoundTrip(t *testing.T, store SessionStore) {
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	s, err := store.Create(w, r, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cookie set on Create is the one to send, Save may set a newer one
+	cookies := w.Result().Cookies()
+	w = httptest.NewRecorder()
+	s.Data = []byte(`{"a":1}`)
+	if err := store.Save(w, r, s); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.Result().Cookies(); len(c) > 0 {
+		cookies = c
+	}
+	if len(cookies) != 1 || cookies[0].Name != sessionConfig(r).CookieName {
+		t.Fatalf("expected the session cookie, got %v", cookies)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookies[0])
+	s1, err := store.Load(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1 == nil || s1.ID.String() != s.ID.String() || s1.UserID.String() != b.ID.String() || string(s1.Data) != `{"a":1}` {
+		t.Fatalf("unexpected session %+v", s1)
+	}
+
+	// Destroyed sessions clear the cookie
+	w = httptest.NewRecorder()
+	if err := store.Destroy(w, r, s1); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Fatalf("expected the cookie to be cleared, got %v", c)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+	sessionRoundTrip(t, store)
+
+	if len(store.sessions) != 0 {
+		t.Errorf("expected the session to be destroyed, got %v\n", store.sessions)
+		return
+	}
+
+	// Unknown keys are invalid cookies
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionConfig(r).CookieName, Value: "unknown"})
+	if s, err := store.Load(httptest.NewRecorder(), r); s != nil || !errors.Is(err, ErrInvalidSessionCookie) {
+		t.Errorf("expected an invalid cookie error, got %v %v\n", s, err)
+		return
+	}
+
+	// Expired sessions are dropped on the next write
+	w := httptest.NewRecorder()
+	s, err := store.Create(w, r, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	store.sessions[store.keys[s.ID.String()]].ModificationTime = time.Now().Add(-3 * time.Hour)
+	store.pruned = time.Time{}
+	if _, err := store.Create(httptest.NewRecorder(), r, nil); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := store.keys[s.ID.String()]; ok || len(store.sessions) != 1 {
+		t.Errorf("expected the idle session to be dropped, got %v\n", store.sessions)
+		return
+	}
+
+	fmt.Printf("TestMemorySessionStore: OK\n")
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	store, err := NewCookieSessionStore([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sessionRoundTrip(t, store)
+
+	// Tampered cookies are rejected
+	napp := NewApp("cookie_app", []byte("1234"), "11743", "", "", "")
+	napp.SetSessionStore(store)
+	newReq := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		return r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+	}
+
+	w := httptest.NewRecorder()
+	if _, err := store.Create(w, newReq(), nil); err != nil {
+		t.Error(err)
+		return
+	}
+	c := w.Result().Cookies()[0]
+	v := []byte(c.Value)
+	v[len(v)-1] ^= 1
+	c.Value = string(v)
+
+	r := newReq()
+	r.AddCookie(c)
+	if _, err := store.Load(httptest.NewRecorder(), r); !errors.Is(err, ErrInvalidSessionCookie) {
+		t.Errorf("expected an invalid cookie error on a tampered cookie, got %v\n", err)
+		return
+	}
+
+	// Views get no session, and the cookie is cleared
+	w = httptest.NewRecorder()
+	if s, err := LoadSession(w, r); s != nil || err != nil || w.Code != http.StatusOK {
+		t.Errorf("expected no session, got %v %v %d\n", s, err, w.Code)
+		return
+	}
+	if cs := w.Result().Cookies(); len(cs) != 1 || cs[0].Name != c.Name || cs[0].MaxAge >= 0 {
+		t.Errorf("expected the cookie cleared, got %v\n", cs)
+		return
+	}
+
+	fmt.Printf("TestCookieSessionStore: OK\n")
+}
+
+func TestSessionTimeoutsAndRotation(t *testing.T) {
+	napp := NewApp("session_app", []byte("1234"), "11743", "", "", "")
+	store := NewMemorySessionStore()
+	napp.SetSessionStore(store)
+	napp.SetSessionTimeouts(time.Hour, 10*time.Minute)
+
+	newReq := func(c *http.Cookie) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c != nil {
+			r.AddCookie(c)
+		}
+		return r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+	}
+	age := func(c *http.Cookie, created time.Duration, modified time.Duration) {
+		s := store.sessions[c.Value]
+		s.CreationTime = time.Now().Add(-created)
+		s.ModificationTime = time.Now().Add(-modified)
+	}
+
+	w := httptest.NewRecorder()
+	s, err := InitSession(w, newReq(nil), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c := w.Result().Cookies()[0]
+
+	// Idle past half the timeout slides it
+	age(c, 0, 6*time.Minute)
+	if s1, err := LoadSession(httptest.NewRecorder(), newReq(c)); err != nil || s1 == nil {
+		t.Errorf("expected the session, got %v %v\n", s1, err)
+		return
+	}
+	if idle := time.Since(store.sessions[c.Value].ModificationTime); idle > time.Minute {
+		t.Errorf("expected the idle timeout to slide, idle for %v\n", idle)
+		return
+	}
+
+	// Expired sessions are destroyed
+	for _, d := range [][2]time.Duration{{0, 11 * time.Minute}, {61 * time.Minute, 0}} {
+		w = httptest.NewRecorder()
+		if _, err := InitSession(w, newReq(nil), nil); err != nil {
+			t.Error(err)
+			return
+		}
+		ec := w.Result().Cookies()[0]
+		age(ec, d[0], d[1])
+		if s1, err := LoadSession(httptest.NewRecorder(), newReq(ec)); err != nil || s1 != nil {
+			t.Errorf("expected the session to expire after %v, got %v %v\n", d, s1, err)
+			return
+		}
+		if _, ok := store.sessions[ec.Value]; ok {
+			t.Errorf("expected the expired session to be destroyed\n")
+			return
+		}
+	}
+
+	// Signing in moves the session to a new ID, keeping its data
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	r := newReq(c)
+	s.UserID = b.ID
+	w = httptest.NewRecorder()
+	if err := StoreFormInSession(w, r, s, map[string]string{"k": "v"}); err != nil {
+		t.Error(err)
+		return
+	}
+	cookies := w.Result().Cookies()
+	nc := cookies[len(cookies)-1]
+	if _, ok := store.sessions[c.Value]; ok || nc.Value == c.Value || nc.MaxAge < 0 {
+		t.Errorf("expected a new session cookie, got %v\n", cookies)
+		return
+	}
+
+	s1, err := LoadSession(httptest.NewRecorder(), newReq(nc))
+	if err != nil || s1 == nil || s1.ID.String() != s.ID.String() || s1.UserID.String() != b.ID.String() {
+		t.Errorf("expected the rotated session, got %+v %v\n", s1, err)
+		return
+	}
+	data := map[string]string{}
+	if err := RestoreFormFromSession(httptest.NewRecorder(), newReq(nc), s1, &data); err != nil || data["k"] != "v" {
+		t.Errorf("expected the session data, got %v %v\n", data, err)
+		return
+	}
+
+	fmt.Printf("TestSessionTimeoutsAndRotation: OK\n")
+}
+
+func TestSessionConfigPerApp(t *testing.T) {
+	public := NewApp("public", []byte("1234"), "11743", "", "", "")
+	admin := NewApp("admin", []byte("1234"), "11744", "", "", "")
+	admin.SetSessionConfig(SessionConfig{
+		CookieName: "_adminsid",
+		Domain:     "admin.example.com",
+		Path:       "/admin",
+		SameSite:   http.SameSiteStrictMode,
+		Secure:     true,
+		MaxAge:     3600,
+	})
+
+	for _, napp := range []*App{public, admin} {
+		napp.SetSessionStore(NewMemorySessionStore())
+	}
+
+	newReq := func(napp *App, c *http.Cookie) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c != nil {
+			r.AddCookie(c)
+		}
+		return r.WithContext(context.WithValue(r.Context(), appContextKey, napp))
+	}
+
+	cookies := map[*App]*http.Cookie{}
+	for _, napp := range []*App{public, admin} {
+		w := httptest.NewRecorder()
+		if _, err := InitSession(w, newReq(napp, nil), nil); err != nil {
+			t.Error(err)
+			return
+		}
+		cookies[napp] = w.Result().Cookies()[0]
+	}
+
+	if c := cookies[public]; c.Name != "_publicsessionid" || c.Path != "/" || c.MaxAge != 0 || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("unexpected public cookie %v\n", c)
+		return
+	}
+	if c := cookies[admin]; c.Name != "_adminsid" || c.Domain != "admin.example.com" || c.Path != "/admin" ||
+		c.MaxAge != 3600 || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("unexpected admin cookie %v\n", c)
+		return
+	}
+
+	// Zero timeouts take the defaults
+	if c := admin.sessionConfig; c.Lifetime != defaultSessionLifetime || c.Idle != defaultSessionIdle {
+		t.Errorf("expected the default timeouts, got %v %v\n", c.Lifetime, c.Idle)
+		return
+	}
+
+	// Each App sees its own cookie only
+	r := newReq(admin, cookies[public])
+	r.AddCookie(cookies[admin])
+	if s, err := LoadSession(httptest.NewRecorder(), r); err != nil || s == nil {
+		t.Errorf("expected the admin session, got %v %v\n", s, err)
+		return
+	}
+	if s, err := LoadSession(httptest.NewRecorder(), newReq(public, cookies[admin])); err != nil || s != nil {
+		t.Errorf("expected no public session, got %v %v\n", s, err)
+		return
+	}
+
+	// Cookie names must be tokens
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic on an invalid cookie name")
+			}
+		}()
+		public.SetSessionConfig(SessionConfig{CookieName: "session id"})
+	}()
+	if err := public.SetupSessions("session id"); err == nil {
+		t.Error("expected an error on an invalid cookie name")
+		return
+	}
+
+	// The legacy setup names the cookie of its App only
+	if err := public.SetupSessions("_legacysid"); err != nil {
+		t.Error(err)
+		return
+	}
+	if n, a := sessionConfig(newReq(public, nil)).CookieName, sessionConfig(newReq(admin, nil)).CookieName; n != "_legacysid" || a != "_adminsid" {
+		t.Errorf("unexpected cookie names %s %s\n", n, a)
+		return
+	}
+
+	// Timeouts can change while requests are served
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			public.SetSessionTimeouts(time.Hour, time.Duration(i)*time.Minute)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		sessionConfig(newReq(public, nil))
+	}
+	<-done
+
+	fmt.Printf("TestSessionConfigPerApp: OK\n")
+}
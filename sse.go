@@ -0,0 +1,215 @@
+package uviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+const (
+	MediaTypeEventStream = "text/event-stream"
+
+	lastEventIDHeaderKey = "Last-Event-ID"
+	// Query alternative to the header, for clients that cannot set it
+	lastEventIDQueryKey = "last_event_id"
+
+	// Idle streams get a comment line so that proxies keep them open
+	sseHeartbeatPeriod = 15 * time.Second
+)
+
+// eventsHandler - Streams the changes on the resource collection as
+// Server-Sent Events. The collection ancestors and the user authorization
+// are checked as for OpList, and every event is checked against the
+// entity it reports before it is sent.
+// A Last-Event-ID resumes the stream after that event. If the event is no
+// longer logged a "reset" event is sent first: the client must then reload
+// the collection
+func (res *Resource) eventsHandler(authenticate bool, checkEmail bool, withEntity bool) http.HandlerFunc {
+	entType := reflect.TypeOf(res.newEntity())
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		const origin = "events"
+
+		if !negotiateEventStream(w, r, origin) {
+			return
+		}
+
+		var usr *ustore.User
+		if authenticate {
+			var ok bool
+			if usr, ok = authenticateUser(r, checkEmail); !ok {
+				responseNotAuthenticated(w, r, res.app.name)
+				return
+			}
+
+			if !res.app.checkDevice(w, r, usr.ID, false) {
+				return
+			}
+		}
+
+		ancestors, _, code, apiErr := listAncestors(r, nil)
+		if apiErr != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
+			return
+		}
+
+		if !apiValidate(w, r, origin, checkAncestorsLen(ancestors, res.depth)) {
+			return
+		}
+
+		if authenticate {
+			if code, apiErr := isAuthorized(r, res.newEntity(), usr, ancestors...); apiErr != nil {
+				ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
+				return
+			}
+		}
+
+		lastID, apiErr := lastEventID(r)
+		if apiErr != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, http.StatusBadRequest)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			e := newApiError(ErrCodeInternal, "streaming not supported")
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusInternalServerError)
+			return
+		}
+
+		sub, missed, complete := res.app.events.subscribe(lastID)
+		defer res.app.events.unsubscribe(sub)
+
+		w.Header().Set(contentTypeKey, MediaTypeEventStream)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		if !complete {
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		}
+
+		// Writes e if it belongs to the collection and the user can read it
+		send := func(e *Event) error {
+			if e.entityType != entType || !sameAncestors(e.Ancestors, ancestors) {
+				return nil
+			}
+
+			if authenticate {
+				item := append(append([]ustore.SIDType{}, ancestors...), e.EntityID)
+				if _, apiErr := isAuthorized(r, res.newEntity(), usr, item...); apiErr != nil {
+					return nil
+				}
+			}
+
+			return writeSSE(w, e, withEntity)
+		}
+
+		for _, e := range missed {
+			if err := send(e); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeatPeriod)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case e, ok := <-sub.C:
+				if !ok {
+					// Dropped as too slow, the client reconnects with its Last-Event-ID
+					return
+				}
+				if err := send(e); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// negotiateEventStream - Writes a 406 response unless the request accepts
+// an event stream. Returns false if the request should not be processed
+// any further
+func negotiateEventStream(w http.ResponseWriter, r *http.Request, origin string) bool {
+	accept := r.Header.Get(acceptHeaderKey)
+	if accept == "" {
+		return true
+	}
+
+	for _, mt := range parseAccept(accept) {
+		if mt == MediaTypeEventStream || mt == "text/*" || mt == "*/*" {
+			return true
+		}
+	}
+
+	e := newApiError(ErrCodeNotAcceptable, accept)
+	ApiResponseWrite(w, r, origin, nil, []*ApiError{e}, http.StatusNotAcceptable)
+	return false
+}
+
+// writeSSE - Writes e as an event of its type, with the event as JSON data
+func writeSSE(w http.ResponseWriter, e *Event, withEntity bool) error {
+	if !withEntity && e.Entity != nil {
+		c := *e
+		c.Entity = nil
+		e = &c
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
+
+// lastEventID - The ID of the last event the client received, 0 if none
+func lastEventID(r *http.Request) (uint64, *ApiError) {
+	v := r.Header.Get(lastEventIDHeaderKey)
+	if v == "" {
+		v = r.URL.Query().Get(lastEventIDQueryKey)
+	}
+	if v == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		e := ApiErrBadRequest(err.Error())
+		e.Field = lastEventIDHeaderKey
+		return 0, e
+	}
+
+	return id, nil
+}
+
+// sameAncestors - Reports whether a and b hold the same ids
+func sameAncestors(a []ustore.SIDType, b []ustore.SIDType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,113 @@
+package uviews
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/usfsci/ustore"
+)
+
+// StoreErrorMapping - Maps errors returned by the store, or by any
+// app code called from the handlers, to an HTTP status and an ApiError
+type StoreErrorMapping struct {
+	// Match - Reports whether err is handled by this mapping
+	Match func(err error) bool
+	// HTTP status code of the response
+	Status int
+	// Stable error code, one of the ErrCode constants or app defined
+	Code string
+	// Description, defaults to the catalog description of Code
+	Desc string
+}
+
+// apiError - Builds the ApiError for err
+func (m *StoreErrorMapping) apiError(err error) *ApiError {
+	e := &ApiError{
+		Code: m.Code,
+		Desc: m.Desc,
+	}
+	if e.Desc == "" {
+		e.Desc = errorCatalog[m.Code]
+	}
+
+	if debugMode {
+		e.Debug = err.Error()
+	}
+
+	return e
+}
+
+func isError(target error) func(error) bool {
+	return func(err error) bool {
+		return errors.Is(err, target)
+	}
+}
+
+// defaultStoreErrors - Mappings for every ustore error
+var defaultStoreErrors = []*StoreErrorMapping{
+	// The requested entity was not found
+	{Match: isError(ustore.ErrNotFound), Status: http.StatusNotFound, Code: ErrCodeNotFound},
+	// A foreign key is required and was not provided or the one
+	// provided does not exist
+	{Match: isError(ustore.ErrConstraint), Status: http.StatusBadRequest, Code: ErrCodeConstraint},
+	{Match: isError(ustore.ErrDuplicatedKey), Status: http.StatusConflict, Code: ErrCodeDuplicatedEntry},
+	{Match: isError(ustore.ErrTermsNotAccepted), Status: http.StatusBadRequest, Code: ErrCodeTermsNotAccepted},
+	{Match: isError(ustore.ErrBadRequest), Status: http.StatusBadRequest, Code: ErrCodeBadRequest},
+	{Match: isError(ustore.ErrInternal), Status: http.StatusInternalServerError, Code: ErrCodeInternal},
+}
+
+// unknownStoreError - Used when no mapping matches
+var unknownStoreError = &StoreErrorMapping{
+	Match:  func(error) bool { return true },
+	Status: http.StatusInternalServerError,
+	Code:   ErrCodeUnknown,
+}
+
+// storeErrors - Mappings registered by the apps
+var storeErrors = struct {
+	sync.RWMutex
+	l []*StoreErrorMapping
+}{}
+
+// RegisterStoreError - Maps a sentinel error, matched with errors.Is, to a
+// status code and error code. An empty desc uses the catalog description.
+// Registered mappings take precedence over the defaults and over the
+// mappings registered before them
+func RegisterStoreError(target error, status int, code string, desc string) {
+	RegisterStoreErrorMapping(&StoreErrorMapping{
+		Match:  isError(target),
+		Status: status,
+		Code:   code,
+		Desc:   desc,
+	})
+}
+
+// RegisterStoreErrorMapping - Registers a mapping. Use a Match func with
+// errors.As to map typed errors
+func RegisterStoreErrorMapping(m *StoreErrorMapping) {
+	storeErrors.Lock()
+	defer storeErrors.Unlock()
+
+	storeErrors.l = append([]*StoreErrorMapping{m}, storeErrors.l...)
+}
+
+// storeErrorMapping - Finds the mapping for err
+func storeErrorMapping(err error) *StoreErrorMapping {
+	storeErrors.RLock()
+	defer storeErrors.RUnlock()
+
+	for _, m := range storeErrors.l {
+		if m.Match(err) {
+			return m
+		}
+	}
+
+	for _, m := range defaultStoreErrors {
+		if m.Match(err) {
+			return m
+		}
+	}
+
+	return unknownStoreError
+}
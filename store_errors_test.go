@@ -0,0 +1,64 @@
+package uviews
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/usfsci/ustore"
+)
+
+var errTestQuota = errors.New("quota exceeded")
+
+type testLockedError struct {
+	Resource string
+}
+
+func (e *testLockedError) Error() string {
+	return e.Resource + " is locked"
+}
+
+func TestStoreErrorMappings(t *testing.T) {
+	RegisterStoreError(errTestQuota, http.StatusTooManyRequests, "quota_exceeded", "quota exceeded")
+	RegisterStoreErrorMapping(&StoreErrorMapping{
+		Match: func(err error) bool {
+			var le *testLockedError
+			return errors.As(err, &le)
+		},
+		Status: http.StatusLocked,
+		Code:   "locked",
+	})
+
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("get: %w", ustore.ErrNotFound), http.StatusNotFound, ErrCodeNotFound},
+		{ustore.ErrConstraint, http.StatusBadRequest, ErrCodeConstraint},
+		{ustore.ErrDuplicatedKey, http.StatusConflict, ErrCodeDuplicatedEntry},
+		{ustore.ErrBadRequest, http.StatusBadRequest, ErrCodeBadRequest},
+		{ustore.ErrInternal, http.StatusInternalServerError, ErrCodeInternal},
+		{errors.New("boom"), http.StatusInternalServerError, ErrCodeUnknown},
+		{fmt.Errorf("add: %w", errTestQuota), http.StatusTooManyRequests, "quota_exceeded"},
+		{fmt.Errorf("update: %w", &testLockedError{Resource: "user"}), http.StatusLocked, "locked"},
+	}
+
+	for _, c := range cases {
+		status, e := ApiErrFromStoreErr(c.err)
+		if status != c.status || e.Code != c.code {
+			t.Errorf("%v: expected %d %s, got %d %s\n", c.err, c.status, c.code, status, e.Code)
+			return
+		}
+
+		// The HTML path must agree with the JSON path
+		w := httptest.NewRecorder()
+		HandleStoreError(w, c.err)
+		if w.Code != c.status {
+			t.Errorf("%v: expected HTML status %d, got %d\n", c.err, c.status, w.Code)
+			return
+		}
+	}
+}
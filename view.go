@@ -73,12 +73,18 @@ func (view *DefaultView) Load(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if session == nil {
-		// nil session means that there was no session cookie
-		// Init a session with user nil
-		session, err = InitSession(w, r, nil)
+		// nil session means that there was no session cookie, or it expired
+		// Init a session with the remembered user, if any
+		session, err = RememberedSession(w, r)
 		if err != nil {
+			HandleStoreError(w, err)
 			return err
 		}
+		if session == nil {
+			if session, err = InitSession(w, r, nil); err != nil {
+				return err
+			}
+		}
 	}
 
 	view.Session = session
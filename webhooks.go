@@ -0,0 +1,344 @@
+package uviews
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+const (
+	WebhookSignatureHeaderKey = "X-Webhook-Signature"
+	WebhookTimestampHeaderKey = "X-Webhook-Timestamp"
+	WebhookEventHeaderKey     = "X-Webhook-Event"
+	WebhookDeliveryHeaderKey  = "X-Webhook-Delivery"
+
+	// Deliveries kept in the log, all subscriptions included
+	webhookLogSize = 1000
+	// Attempts per delivery, the first one included
+	defaultWebhookMaxAttempts = 6
+	// Wait before the first retry, doubled on every retry
+	defaultWebhookBackoff = time.Second
+	webhookTimeout        = 10 * time.Second
+)
+
+// WebhookSubscription - Where and which events are delivered
+type WebhookSubscription struct {
+	ID string `json:"id"`
+	// Events of this user only, every event of the App if empty.
+	// The user of an event is its first ancestor, or the entity itself
+	// for root entities such as users
+	UserID ustore.SIDType `json:"user_id,omitempty"`
+	URL    string         `json:"url"`
+	// Event names, e.g. "user.email_confirmed" or "client.add". All if empty
+	Events []string `json:"events,omitempty"`
+	// Key of the HMAC-SHA256 delivery signature
+	Secret string `json:"-"`
+}
+
+// WebhookPayload - Body of a delivery
+type WebhookPayload struct {
+	// Delivery ID, the same on every attempt
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Data  *Event    `json:"data"`
+}
+
+// WebhookDelivery - Outcome of a delivery attempt
+type WebhookDelivery struct {
+	ID             string    `json:"id"`
+	SubscriptionID string    `json:"subscription_id"`
+	Event          string    `json:"event"`
+	EventID        uint64    `json:"event_id"`
+	Attempt        int       `json:"attempt"`
+	Time           time.Time `json:"time"`
+	// Receiver response status, 0 if there was no response
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Delivered  bool   `json:"delivered"`
+}
+
+// webhookDispatcher - Delivers the App events to the subscriptions
+type webhookDispatcher struct {
+	events      *eventHub
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	start       sync.Once
+
+	mu   sync.RWMutex
+	subs map[string]*WebhookSubscription
+	// Last deliveries, in order
+	deliveries []*WebhookDelivery
+}
+
+func newWebhookDispatcher(events *eventHub) *webhookDispatcher {
+	return &webhookDispatcher{
+		events:      events,
+		client:      &http.Client{Timeout: webhookTimeout},
+		maxAttempts: defaultWebhookMaxAttempts,
+		backoff:     defaultWebhookBackoff,
+		subs:        map[string]*WebhookSubscription{},
+	}
+}
+
+// AddWebhook - Subscribes sub to the App events. An ID is assigned if sub
+// has none. Delivery starts with the events published from now on
+func (app *App) AddWebhook(sub *WebhookSubscription) error {
+	u, err := url.Parse(sub.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url %s is not an absolute http url", sub.URL)
+	}
+	if sub.Secret == "" {
+		return errors.New("webhook secret cannot be empty")
+	}
+
+	if sub.ID == "" {
+		if sub.ID, err = randomHex(16); err != nil {
+			return err
+		}
+	}
+
+	d := app.webhooks
+	d.mu.Lock()
+	d.subs[sub.ID] = sub
+	d.mu.Unlock()
+
+	// Subscribed before returning so that no event published after
+	// AddWebhook returns is missed
+	d.start.Do(func() {
+		sub, _, _ := d.events.subscribe(0)
+		go d.run(sub)
+	})
+
+	return nil
+}
+
+// RemoveWebhook - Cancels the subscription. Deliveries under way still
+// complete their attempts
+func (app *App) RemoveWebhook(id string) {
+	app.webhooks.mu.Lock()
+	defer app.webhooks.mu.Unlock()
+
+	delete(app.webhooks.subs, id)
+}
+
+// Webhooks - The subscriptions of the user, or those of the whole App if
+// userID is empty
+func (app *App) Webhooks(userID ustore.SIDType) []*WebhookSubscription {
+	app.webhooks.mu.RLock()
+	defer app.webhooks.mu.RUnlock()
+
+	subs := make([]*WebhookSubscription, 0)
+	for _, sub := range app.webhooks.subs {
+		if sub.UserID.String() == userID.String() {
+			subs = append(subs, sub)
+		}
+	}
+
+	return subs
+}
+
+// WebhookDeliveries - The logged delivery attempts of a subscription,
+// oldest first
+func (app *App) WebhookDeliveries(subscriptionID string) []*WebhookDelivery {
+	app.webhooks.mu.RLock()
+	defer app.webhooks.mu.RUnlock()
+
+	l := make([]*WebhookDelivery, 0)
+	for _, dl := range app.webhooks.deliveries {
+		if dl.SubscriptionID == subscriptionID {
+			l = append(l, dl)
+		}
+	}
+
+	return l
+}
+
+// SignWebhook - Signature of a delivery: the hex HMAC-SHA256 of the
+// timestamp, a dot and the body, keyed with the subscription secret
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook - Checks a delivery signature, for receivers
+func VerifyWebhook(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// run - Dispatches the events of sub as they are published. Resumes from
+// the event log if the hub drops it as too slow
+func (d *webhookDispatcher) run(sub *eventSubscription) {
+	var lastID uint64
+	for {
+		for e := range sub.C {
+			d.dispatch(e)
+			lastID = e.ID
+		}
+
+		var missed []*Event
+		var complete bool
+		sub, missed, complete = d.events.subscribe(lastID)
+		if !complete {
+			log.Printf("webhooks: events after %d were lost\n", lastID)
+		}
+		for _, e := range missed {
+			d.dispatch(e)
+			lastID = e.ID
+		}
+	}
+}
+
+// dispatch - Starts the delivery of e to every matching subscription
+func (d *webhookDispatcher) dispatch(e *Event) {
+	name := e.Kind + "." + string(e.Type)
+	owner := eventUser(e)
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, sub := range d.subs {
+		if len(sub.UserID) > 0 && sub.UserID.String() != owner {
+			continue
+		}
+		if !sub.wants(name) {
+			continue
+		}
+
+		go d.deliver(sub, name, e)
+	}
+}
+
+// wants - Reports whether the subscription takes the event
+func (sub *WebhookSubscription) wants(name string) bool {
+	if len(sub.Events) == 0 {
+		return true
+	}
+
+	for _, ev := range sub.Events {
+		if ev == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventUser - The id of the user an event belongs to
+func eventUser(e *Event) string {
+	if len(e.Ancestors) > 0 {
+		return e.Ancestors[0].String()
+	}
+
+	return e.EntityID.String()
+}
+
+// deliver - Posts the event until the receiver answers 2xx or the attempts
+// are exhausted, waiting twice as long after every failure
+func (d *webhookDispatcher) deliver(sub *WebhookSubscription, name string, e *Event) {
+	id, err := randomHex(16)
+	if err != nil {
+		log.Printf("webhooks: %v\n", err)
+		return
+	}
+
+	body, err := json.Marshal(&WebhookPayload{
+		ID:    id,
+		Event: name,
+		Time:  time.Now().In(time.UTC),
+		Data:  e,
+	})
+	if err != nil {
+		log.Printf("webhooks: %v\n", err)
+		return
+	}
+
+	wait := d.backoff
+	for attempt := 1; ; attempt++ {
+		dl := &WebhookDelivery{
+			ID:             id,
+			SubscriptionID: sub.ID,
+			Event:          name,
+			EventID:        e.ID,
+			Attempt:        attempt,
+			Time:           time.Now().In(time.UTC),
+		}
+
+		dl.StatusCode, err = d.post(sub, dl, body)
+		if err != nil {
+			dl.Error = err.Error()
+		}
+		dl.Delivered = err == nil && dl.StatusCode >= 200 && dl.StatusCode < 300
+		d.log(dl)
+
+		if dl.Delivered || attempt >= d.maxAttempts {
+			return
+		}
+
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post - Sends a signed attempt, returns the receiver status
+func (d *webhookDispatcher) post(sub *WebhookSubscription, dl *WebhookDelivery, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	ts := strconv.FormatInt(dl.Time.Unix(), 10)
+	req.Header.Set(contentTypeKey, MediaTypeJSON)
+	req.Header.Set(WebhookEventHeaderKey, dl.Event)
+	req.Header.Set(WebhookDeliveryHeaderKey, dl.ID)
+	req.Header.Set(WebhookTimestampHeaderKey, ts)
+	req.Header.Set(WebhookSignatureHeaderKey, SignWebhook(sub.Secret, ts, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func (d *webhookDispatcher) log(dl *WebhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deliveries = append(d.deliveries, dl)
+	if len(d.deliveries) > webhookLogSize {
+		d.deliveries = d.deliveries[len(d.deliveries)-webhookLogSize:]
+	}
+}
+
+// randomHex - n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,122 @@
+package uviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usfsci/ustore"
+)
+
+func TestWebhooks(t *testing.T) {
+	wapp := NewApp("webhooks_app", []byte("1234"), "11742", "", "", "")
+	wapp.webhooks.backoff = 10 * time.Millisecond
+
+	const secret = "s3cr3t"
+
+	// The receiver fails twice before accepting the delivery
+	var mu sync.Mutex
+	var payloads []*WebhookPayload
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ts := r.Header.Get(WebhookTimestampHeaderKey)
+		if !VerifyWebhook(secret, ts, body, r.Header.Get(WebhookSignatureHeaderKey)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		p := &WebhookPayload{}
+		if err := json.Unmarshal(body, p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		payloads = append(payloads, p)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	if err := wapp.AddWebhook(&WebhookSubscription{URL: "ftp://example.com", Secret: secret}); err == nil {
+		t.Error("expected an error on a non http url")
+		return
+	}
+
+	ids := make([]ustore.SIDType, 2)
+	for i := range ids {
+		b, err := ustore.NewBase()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ids[i] = b.ID
+	}
+
+	sub := &WebhookSubscription{
+		UserID: ids[0],
+		URL:    srv.URL,
+		Events: []string{"user.email_confirmed"},
+		Secret: secret,
+	}
+	if err := wapp.AddWebhook(sub); err != nil {
+		t.Error(err)
+		return
+	}
+	if subs := wapp.Webhooks(ids[0]); len(subs) != 1 || subs[0].ID == "" {
+		t.Errorf("expected the user subscription, got %v\n", subs)
+		return
+	}
+
+	// Only the first one matches the subscription
+	wapp.events.publish(&Event{Type: EventEmailConfirmed, Kind: "user", EntityID: ids[1]})
+	wapp.events.publish(&Event{Type: EventUpdate, Kind: "user", EntityID: ids[0]})
+	wapp.events.publish(&Event{Type: EventEmailConfirmed, Kind: "user", EntityID: ids[0]})
+
+	var dls []*WebhookDelivery
+	for i := 0; i < 100; i++ {
+		if dls = wapp.WebhookDeliveries(sub.ID); len(dls) == 3 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if len(dls) != 3 {
+		t.Errorf("expected 3 attempts, got %d\n", len(dls))
+		return
+	}
+	for i, dl := range dls {
+		if dl.Attempt != i+1 || dl.Delivered != (i == 2) || dl.ID != dls[0].ID {
+			t.Errorf("unexpected attempt %+v\n", dl)
+			return
+		}
+	}
+	if dls[0].StatusCode != http.StatusServiceUnavailable || dls[2].StatusCode != http.StatusOK {
+		t.Errorf("unexpected statuses %d, %d\n", dls[0].StatusCode, dls[2].StatusCode)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(payloads) != 3 || payloads[2].Event != "user.email_confirmed" || payloads[2].Data.EntityID.String() != ids[0].String() {
+		t.Errorf("unexpected payloads %v\n", payloads)
+		return
+	}
+
+	fmt.Printf("TestWebhooks: OK\n")
+}
@@ -0,0 +1,306 @@
+package uviews
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/usfsci/ustore"
+)
+
+const (
+	// Time allowed to write a message to the peer
+	wsWriteWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer
+	wsPongWait = 60 * time.Second
+	// Pings are sent within the pong wait
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// Largest message accepted from the peer
+	wsMaxMessageSize = 64 * 1024
+	// Messages queued per connection. A connection with a full queue is
+	// closed, the client reconnects once it catches up
+	wsSendBuffer = 64
+)
+
+// WebSocketHandler - Handles a message received from a connected client.
+// data is the Message data
+type WebSocketHandler func(u *ustore.User, client *ustore.Client, data json.RawMessage)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsConn - A live connection of a Client
+type wsConn struct {
+	conn   *websocket.Conn
+	user   *ustore.User
+	client *ustore.Client
+	send   chan []byte
+	// Closes send only once, from the hub or the connection
+	closeOnce sync.Once
+}
+
+func (c *wsConn) close() {
+	c.closeOnce.Do(func() { close(c.send) })
+}
+
+// wsHub - Live connections by user and client id
+type wsHub struct {
+	mu    sync.RWMutex
+	conns map[string]map[string]map[*wsConn]bool
+	// Handler of the messages received, if any
+	handler WebSocketHandler
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{conns: map[string]map[string]map[*wsConn]bool{}}
+}
+
+func (h *wsHub) register(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	uid, cid := c.user.ID.String(), c.client.ID.String()
+	if h.conns[uid] == nil {
+		h.conns[uid] = map[string]map[*wsConn]bool{}
+	}
+	if h.conns[uid][cid] == nil {
+		h.conns[uid][cid] = map[*wsConn]bool{}
+	}
+	h.conns[uid][cid][c] = true
+}
+
+func (h *wsHub) unregister(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	uid, cid := c.user.ID.String(), c.client.ID.String()
+	if h.conns[uid] == nil {
+		return
+	}
+	delete(h.conns[uid][cid], c)
+	if len(h.conns[uid][cid]) == 0 {
+		delete(h.conns[uid], cid)
+	}
+	if len(h.conns[uid]) == 0 {
+		delete(h.conns, uid)
+	}
+}
+
+// send - Queues b on the connections of the user, only those of clientID
+// if not empty. Returns the number of connections the message was queued on.
+// Holds the write lock: slow connections are closed and removed here
+func (h *wsHub) send(userID string, clientID string, b []byte) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for cid, conns := range h.conns[userID] {
+		if clientID != "" && cid != clientID {
+			continue
+		}
+
+		for c := range conns {
+			select {
+			case c.send <- b:
+				n++
+			default:
+				// Slow consumer, the write pump closes the connection
+				delete(conns, c)
+				c.close()
+			}
+		}
+	}
+
+	return n
+}
+
+// closeClient - Closes the connections of a client
+func (h *wsHub) closeClient(userID string, clientID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.conns[userID][clientID] {
+		c.close()
+	}
+	delete(h.conns[userID], clientID)
+	if len(h.conns[userID]) == 0 {
+		delete(h.conns, userID)
+	}
+}
+
+// OnWebSocketMessage - Sets the handler of the messages sent by clients
+func (app *App) OnWebSocketMessage(h WebSocketHandler) {
+	app.ws.mu.Lock()
+	defer app.ws.mu.Unlock()
+
+	app.ws.handler = h
+}
+
+// SendToUser - Sends data in a Message to every connection of the user.
+// Returns the number of connections it was queued on
+func (app *App) SendToUser(userID ustore.SIDType, data interface{}) (int, error) {
+	b, err := wsMessage(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return app.ws.send(userID.String(), "", b), nil
+}
+
+// SendToClient - Sends data in a Message to the connections of a client of
+// the user. Returns the number of connections it was queued on
+func (app *App) SendToClient(userID ustore.SIDType, clientID ustore.SIDType, data interface{}) (int, error) {
+	b, err := wsMessage(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return app.ws.send(userID.String(), clientID.String(), b), nil
+}
+
+func wsMessage(data interface{}) ([]byte, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&Message{
+		Timestamp: time.Now().UnixNano(),
+		Data:      raw,
+	})
+}
+
+// ApiWebSocket - Upgrades the request to a WebSocket connection of the
+// client, once the Basic Auth user is authenticated and authorized on it.
+// Mount it on a path with the user and client ids as ancestors, e.g.
+// /users/{0}/clients/{1}/ws
+func (app *App) ApiWebSocket(checkEmail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const origin = "websocket"
+
+		usr, ok := authenticateUser(r, checkEmail)
+		if !ok {
+			responseNotAuthenticated(w, r, app.name)
+			return
+		}
+
+		if !app.checkDevice(w, r, usr.ID, false) {
+			return
+		}
+
+		ancestors, _, code, apiErr := listAncestors(r, nil)
+		if apiErr != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
+			return
+		}
+
+		client := ustore.NewClient().(*ustore.Client)
+		if !apiValidate(w, r, origin, checkAncestors(client, ancestors, 1)) {
+			return
+		}
+
+		if code, apiErr := isAuthorized(r, client, usr, ancestors...); apiErr != nil {
+			ApiResponseWrite(w, r, origin, nil, []*ApiError{apiErr}, code)
+			return
+		}
+
+		if err := client.Get(r.Context(), &ustore.Filter{}, ancestors...); err != nil {
+			ApiResponseStoreError(w, r, origin, err)
+			return
+		}
+
+		// The upgrader writes the error response
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("websocket upgrade: %v\n", err)
+			return
+		}
+
+		c := &wsConn{
+			conn:   conn,
+			user:   usr,
+			client: client,
+			send:   make(chan []byte, wsSendBuffer),
+		}
+		app.ws.register(c)
+
+		go app.wsWritePump(c)
+		app.wsReadPump(c)
+	}
+}
+
+// wsReadPump - Reads the client messages until the connection fails or the
+// client stops answering pings
+func (app *App) wsReadPump(c *wsConn) {
+	// Unregistered first so that no send can use the closed queue
+	defer func() {
+		app.ws.unregister(c)
+		c.close()
+	}()
+
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, b, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket read: %v\n", err)
+			}
+			return
+		}
+
+		app.ws.mu.RLock()
+		h := app.ws.handler
+		app.ws.mu.RUnlock()
+		if h == nil {
+			continue
+		}
+
+		msg := &Message{}
+		if err := json.Unmarshal(b, msg); err != nil {
+			log.Printf("websocket message: %v\n", err)
+			continue
+		}
+
+		h(c.user, c.client, msg.Data)
+	}
+}
+
+// wsWritePump - Writes the queued messages and the pings. Closes the
+// connection once send is closed
+func (app *App) wsWritePump(c *wsConn) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case b, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package uviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/usfsci/ustore"
+)
+
+// newTestWSConn - A connection of a new client of u, not attached to a socket
+func newTestWSConn(t *testing.T, u *ustore.User) *wsConn {
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &wsConn{
+		user:   u,
+		client: &ustore.Client{Base: *b},
+		send:   make(chan []byte, wsSendBuffer),
+	}
+}
+
+func TestWebSocketHub(t *testing.T) {
+	h := newWSHub()
+
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	u := &ustore.User{Base: *b}
+	c1, c2 := newTestWSConn(t, u), newTestWSConn(t, u)
+	h.register(c1)
+	h.register(c2)
+
+	if n := h.send(u.ID.String(), "", []byte("all")); n != 2 {
+		t.Errorf("expected 2 connections, got %d\n", n)
+		return
+	}
+	if n := h.send(u.ID.String(), c2.client.ID.String(), []byte("c2")); n != 1 {
+		t.Errorf("expected 1 connection, got %d\n", n)
+		return
+	}
+
+	// Fill c1 up: it is dropped, c2 keeps receiving
+	for i := 0; i < wsSendBuffer; i++ {
+		h.send(u.ID.String(), c1.client.ID.String(), []byte("fill"))
+	}
+	if n := h.send(u.ID.String(), "", []byte("all")); n != 1 {
+		t.Errorf("expected the slow connection to be dropped, got %d\n", n)
+		return
+	}
+	if _, ok := <-c1.send; !ok {
+		t.Error("expected the queued messages before the close")
+		return
+	}
+
+	h.unregister(c1)
+	h.unregister(c2)
+	if len(h.conns) != 0 {
+		t.Errorf("expected no connections left, got %v\n", h.conns)
+		return
+	}
+
+	fmt.Printf("TestWebSocketHub: OK\n")
+}
+
+func TestWebSocketSend(t *testing.T) {
+	wapp := NewApp("ws_app", []byte("1234"), "11741", "", "", "")
+
+	b, err := ustore.NewBase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	u := &ustore.User{Base: *b}
+
+	received := make(chan string, 1)
+	wapp.OnWebSocketMessage(func(u *ustore.User, client *ustore.Client, data json.RawMessage) {
+		received <- string(data)
+	})
+
+	// Upgrades without authentication, as ApiWebSocket does once the
+	// client is authorized
+	registered := make(chan *wsConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := newTestWSConn(t, u)
+		c.conn = conn
+		wapp.ws.register(c)
+		registered <- c
+
+		go wapp.wsWritePump(c)
+		wapp.wsReadPump(c)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ws.Close()
+	c := <-registered
+
+	if n, err := wapp.SendToClient(u.ID, c.client.ID, map[string]string{"hello": "client"}); err != nil || n != 1 {
+		t.Errorf("expected 1 connection, got %d %v\n", n, err)
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := &Message{}
+	if err := ws.ReadJSON(msg); err != nil {
+		t.Error(err)
+		return
+	}
+	if string(msg.Data) != `{"hello":"client"}` {
+		t.Errorf("unexpected message data %s\n", msg.Data)
+		return
+	}
+
+	if err := ws.WriteJSON(NewMessageSim("hi")); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case data := <-received:
+		if data != `"hi"` {
+			t.Errorf("unexpected data received %s\n", data)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("message not received")
+		return
+	}
+
+	fmt.Printf("TestWebSocketSend: OK\n")
+}